@@ -0,0 +1,381 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"reditlite/resp"
+)
+
+// aof is the append-only file, which logs the feed: the commands that
+// changed the keyspace, in RESP, in the order they ran, so that replaying
+// them rebuilds it.
+type aof struct {
+	srv     *server
+	f       *os.File
+	written atomic.Int64 // bytes appended
+
+	syncMu sync.Mutex
+	synced int64 // bytes known to be on disk
+}
+
+// feedsItself holds the write commands that feed what they did themselves,
+// as they wouldn't replay the same fed as sent: which members SPOP takes is
+// random, and BLPOP and BRPOP would block.
+var feedsItself = map[string]bool{"SPOP": true, "BLPOP": true, "BRPOP": true}
+
+// openAOF opens the log at path for appending, reporting whether it is new
+// or empty, and so needs the keyspace logged to start from.
+func openAOF(srv *server, path string) (*aof, bool, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, false, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, false, err
+	}
+	a := &aof{srv: srv, f: f}
+	go a.syncEverySecond()
+	return a, fi.Size() == 0, nil
+}
+
+// write appends p. With appendfsync always, it is synced by syncAlways,
+// which the writer calls once it holds no locks.
+func (a *aof) write(p []byte) {
+	n, err := a.f.Write(p)
+	a.written.Add(int64(n))
+	if err != nil {
+		log.Print("writing the append-only file: ", err)
+	}
+}
+
+// syncAlways syncs what has been appended so far if appendfsync is always.
+// Writers syncing at the same time share an fsync: one that finds what it
+// appended synced by another meanwhile returns without one of its own.
+func (a *aof) syncAlways() {
+	if a.srv.config.appendFsync() != "always" {
+		return
+	}
+	want := a.written.Load()
+	a.syncMu.Lock()
+	defer a.syncMu.Unlock()
+	if a.synced >= want {
+		return
+	}
+	end := a.written.Load()
+	err := a.f.Sync()
+	if errors.Is(err, os.ErrClosed) {
+		return // closeAOF synced it
+	}
+	if err != nil {
+		log.Print("syncing the append-only file: ", err)
+		return
+	}
+	a.synced = end
+}
+
+// close syncs the log and closes it.
+func (a *aof) close() error {
+	err := a.f.Sync()
+	if cerr := a.f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// syncEverySecond syncs the log once a second while appendfsync is
+// everysec, until it is closed.
+func (a *aof) syncEverySecond() {
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for range t.C {
+		if a.srv.config.appendFsync() != "everysec" {
+			continue
+		}
+		err := a.f.Sync()
+		if errors.Is(err, os.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Print("syncing the append-only file: ", err)
+		}
+	}
+}
+
+// keySpan is where the keys are among a command's arguments, as Redis's
+// first key, last key and step give it: a negative last counts back from
+// the end.
+type keySpan struct{ first, last, step int }
+
+// writeKeys holds the keys of the write commands that name them. The rest,
+// such as FLUSHDB and SWAPDB, may change any key.
+var writeKeys = map[string]keySpan{
+	"SET": {1, 1, 1}, "DEL": {1, -1, 1}, "UNLINK": {1, -1, 1},
+	"EXPIRE": {1, 1, 1}, "PEXPIRE": {1, 1, 1}, "EXPIREAT": {1, 1, 1}, "PEXPIREAT": {1, 1, 1},
+	"INCR": {1, 1, 1}, "DECR": {1, 1, 1}, "INCRBY": {1, 1, 1}, "DECRBY": {1, 1, 1},
+	"INCRBYFLOAT": {1, 1, 1}, "APPEND": {1, 1, 1}, "GETSET": {1, 1, 1}, "SETNX": {1, 1, 1},
+	"GETDEL": {1, 1, 1}, "GETEX": {1, 1, 1}, "SETRANGE": {1, 1, 1}, "SETBIT": {1, 1, 1},
+	"MSET": {1, -1, 2}, "MSETNX": {1, -1, 2},
+	"RENAME": {1, 2, 1}, "RENAMENX": {1, 2, 1}, "PERSIST": {1, 1, 1}, "COPY": {1, 2, 1},
+	"LPUSH": {1, 1, 1}, "RPUSH": {1, 1, 1}, "LPOP": {1, 1, 1}, "RPOP": {1, 1, 1},
+	"LINSERT": {1, 1, 1}, "LSET": {1, 1, 1}, "LREM": {1, 1, 1}, "LTRIM": {1, 1, 1},
+	"RPOPLPUSH": {1, 2, 1}, "LMOVE": {1, 2, 1}, "BLPOP": {1, -2, 1}, "BRPOP": {1, -2, 1},
+	"HSET": {1, 1, 1}, "HDEL": {1, 1, 1}, "HINCRBY": {1, 1, 1},
+	"SADD": {1, 1, 1}, "SREM": {1, 1, 1}, "SPOP": {1, 1, 1},
+	"ZADD": {1, 1, 1}, "ZINCRBY": {1, 1, 1},
+}
+
+// logShards returns the indexes of the shards the write command args may
+// change, sorted and distinct, or nil if it may change any.
+func (srv *server) logShards(cmd string, args []resp.Value) []int {
+	span, ok := writeKeys[cmd]
+	if !ok {
+		return nil
+	}
+	last := span.last
+	if last < 0 {
+		last += len(args)
+	}
+	var keys []string
+	for i := span.first; i <= last && i < len(args); i += span.step {
+		keys = append(keys, string(args[i].B))
+	}
+	return srv.shardsOf(keys)
+}
+
+// shardsOf returns the indexes of the shards holding keys, sorted and
+// distinct.
+func (srv *server) shardsOf(keys []string) []int {
+	idx := make([]int, len(keys))
+	for i, k := range keys {
+		idx[i] = srv.dbs[0].shardIndex(k)
+	}
+	slices.Sort(idx)
+	return slices.Compact(idx)
+}
+
+// lockLog takes the log locks of the shards at idx, or of every shard if idx
+// is nil, and returns the function that releases them.
+func (srv *server) lockLog(idx []int) (unlock func()) {
+	if idx == nil {
+		idx = srv.dbs[0].allShards()
+	}
+	for _, i := range idx {
+		srv.logmu[i].Lock()
+	}
+	return func() {
+		for _, i := range slices.Backward(idx) {
+			srv.logmu[i].Unlock()
+		}
+	}
+}
+
+// changesAt returns how many changes the shards at idx, or every shard if
+// idx is nil, have had across the databases.
+func (srv *server) changesAt(idx []int) uint64 {
+	if idx == nil {
+		idx = srv.dbs[0].allShards()
+	}
+	var n uint64
+	for _, db := range srv.dbs {
+		for _, i := range idx {
+			n += db.shards[i].changes.Load()
+		}
+	}
+	return n
+}
+
+// runLogged runs a write command while the feed is on. It holds the log
+// locks of the command's keys until the command is fed, so no other change
+// to them lands in between, and syncs the append-only file once it has let
+// go of them.
+func (c *client) runLogged(cmd string, spec command, args []resp.Value) {
+	srv := c.srv
+	srv.txmu.RLock()
+	idx := srv.logShards(cmd, args)
+	unlock := srv.lockLog(idx)
+	c.callLogged(cmd, spec, args, idx)
+	unlock()
+	srv.txmu.RUnlock()
+	srv.feed.syncAOF()
+}
+
+// callLogged runs a command and feeds it if it is a write and changed the
+// keyspace; a read that deleted a key it found expired has fed the DEL
+// itself. While the feed is on, the caller must hold srv.txmu exclusively,
+// with idx nil, or for reading with the log locks of the shards at idx, the
+// only ones the command changes.
+func (c *client) callLogged(cmd string, spec command, args []resp.Value, idx []int) {
+	if !c.srv.feed.on() {
+		spec.handler(c, args)
+		return
+	}
+	now := time.Now().UnixMilli()
+	changes := c.srv.changesAt(idx)
+	spec.handler(c, args)
+	if c.srv.changesAt(idx) != changes && spec.flags&cmdWrite != 0 && !feedsItself[cmd] {
+		c.srv.feed.log(c.db.index, absoluteExpiry(cmd, args, now))
+	}
+}
+
+// absoluteExpiry rewrites the relative expiries in args, a command run at
+// now (unix ms), as absolute ones, so that replaying it later sets the same
+// expiry.
+func absoluteExpiry(cmd string, args []resp.Value, now int64) []resp.Value {
+	at := func(v []byte, mul int64) resp.Value {
+		n, _ := strconv.ParseInt(string(v), 10, 64) // the command ran, so it parses
+		return resp.Value{T: resp.BulkString, B: strconv.AppendInt(nil, now+n*mul, 10)}
+	}
+	switch cmd {
+	case "EXPIRE", "PEXPIRE":
+		mul := int64(1)
+		if cmd == "EXPIRE" {
+			mul = 1000
+		}
+		return append(bulkStrings([]string{"PEXPIREAT"}), args[1], at(args[2].B, mul))
+	case "SET", "GETEX":
+		pxat := resp.Value{T: resp.BulkString, B: []byte("PXAT")}
+		out := append([]resp.Value(nil), args...)
+		first := 2 // past GETEX key, or SET key value
+		if cmd == "SET" {
+			first = 3
+		}
+		for i := first; i+1 < len(out); i++ {
+			switch strings.ToUpper(string(out[i].B)) {
+			case "EX":
+				out[i], out[i+1] = pxat, at(out[i+1].B, 1000)
+			case "PX":
+				out[i], out[i+1] = pxat, at(out[i+1].B, 1)
+			}
+		}
+		return out
+	}
+	return args
+}
+
+// replayAOF runs the commands in the log at path to rebuild the keyspace,
+// failing with an error satisfying errors.Is(err, fs.ErrNotExist) if there is
+// no log. It must be called before the log is fed, so the commands aren't
+// logged again. What a crash can leave at the end, a command or transaction
+// cut short, is dropped with a warning and cut from the file, for what is
+// logged next to follow on from the last whole command.
+func (srv *server) replayAOF(path string) error {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	a := newApplier(srv)
+	r := bufio.NewReader(f)
+	var end int64 // where the last command or transaction replayed ends
+	for {
+		if !a.inTx {
+			pos, err := f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			end = pos - int64(r.Buffered())
+		}
+		val, err := resp.Read(r, srv.config.readLimits())
+		if err == io.EOF && !a.inTx {
+			return nil
+		}
+		if err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) {
+			log.Print("the append-only file ends partway through a command or transaction, which is left out")
+			return f.Truncate(end)
+		}
+		if err != nil {
+			return err
+		}
+		if err := a.apply(val); err != nil {
+			return fmt.Errorf("the append-only file %w", err)
+		}
+	}
+}
+
+// applier runs a stream of fed commands, from the append-only file or a
+// master, holding back those after MULTI to run together at EXEC.
+//
+// Keys don't expire while it runs them, as a command that ran before its
+// key expired must find it when applied after. Instead the feed has a DEL
+// where the key was found expired, and expiries past by then take effect
+// once the command is done.
+type applier struct {
+	c    *client // a client of its own, whose replies go nowhere
+	tx   [][]resp.Value
+	inTx bool
+	stop <-chan struct{} // closed once commands are no longer to be applied
+}
+
+func newApplier(srv *server) *applier {
+	return &applier{c: &client{
+		w:        bufio.NewWriter(io.Discard),
+		srv:      srv,
+		db:       srv.dbs[0],
+		authed:   true,
+		proto:    2,
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+	}}
+}
+
+// apply runs val, a command read from the stream, or holds it back in a
+// transaction.
+func (a *applier) apply(val resp.Value) error {
+	if val.T != resp.Array || len(val.A) == 0 {
+		return errors.New("holds something other than a command")
+	}
+	switch cmd := strings.ToUpper(string(val.A[0].B)); {
+	case cmd == "MULTI":
+		a.inTx = true
+	case cmd == "EXEC":
+		a.run(a.tx)
+		a.tx, a.inTx = a.tx[:0], false
+	case commands[cmd].handler == nil:
+		return errors.New("has unknown command '" + string(val.A[0].B) + "'")
+	case !commands[cmd].checkArity(val.A):
+		return errors.New("has the wrong number of arguments for '" + strings.ToLower(cmd) + "'")
+	case a.inTx:
+		a.tx = append(a.tx, val.A)
+	default:
+		a.run([][]resp.Value{val.A})
+	}
+	return nil
+}
+
+// run runs cmds as one, feeding them on in turn.
+func (a *applier) run(cmds [][]resp.Value) {
+	srv := a.c.srv
+	defer srv.feed.syncAOF() // once txmu is released
+	srv.txmu.Lock()
+	defer srv.txmu.Unlock()
+	select {
+	case <-a.stop:
+		return // REPLICAOF pointed elsewhere meanwhile
+	default:
+	}
+	srv.loading.Store(true)
+	defer srv.loading.Store(false)
+
+	if len(cmds) > 1 && srv.feed.on() {
+		srv.feed.beginTx()
+		defer srv.feed.endTx()
+	}
+	for _, args := range cmds {
+		cmd := strings.ToUpper(string(args[0].B))
+		a.c.callLogged(cmd, commands[cmd], args, nil)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"reditlite/resp"
+)
+
+// aofOf returns cmds as they are written to the append-only file.
+func aofOf(cmds ...[]string) []byte {
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	for _, c := range cmds {
+		_ = resp.WriteArray(w, cmdArgs(c...))
+	}
+	_ = w.Flush()
+	return b.Bytes()
+}
+
+// replayed writes log to a file and replays it on a new server.
+func replayed(t *testing.T, log []byte) (*server, string) {
+	t.Helper()
+	srv := newTestServer(t)
+	path := filepath.Join(srv.config.dir, "appendonly.aof")
+	if err := os.WriteFile(path, log, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.replayAOF(path); err != nil {
+		t.Fatal("replaying: ", err)
+	}
+	return srv, path
+}
+
+func TestReplayAOF(t *testing.T) {
+	past := strconv.FormatInt(time.Now().Add(-time.Minute).UnixMilli(), 10)
+	future := time.Now().Add(time.Hour).UnixMilli()
+	srv, _ := replayed(t, aofOf(
+		[]string{"SET", "a", "1"},
+		[]string{"SELECT", "2"},
+		[]string{"MULTI"},
+		[]string{"SET", "b", "2"},
+		[]string{"INCR", "b"},
+		[]string{"RPUSH", "l", "x", "y"},
+		[]string{"EXEC"},
+		[]string{"SET", "c", "v"},
+		// it expired after the APPEND ran, so the APPEND must still find it
+		[]string{"PEXPIREAT", "c", past},
+		[]string{"APPEND", "c", "w"},
+		[]string{"RENAME", "c", "d"},
+		[]string{"SET", "e", "v", "PXAT", strconv.FormatInt(future, 10)},
+		[]string{"SELECT", "0"},
+		[]string{"INCR", "a"},
+	))
+
+	db0, db2 := srv.dbs[0], srv.dbs[2]
+	if v, _, _ := db0.getString("a"); string(v) != "2" {
+		t.Errorf("a = %q in db 0, want 2", v)
+	}
+	if v, _, _ := db2.getString("b"); string(v) != "3" {
+		t.Errorf("b = %q in db 2, want 3", v)
+	}
+	if e, _ := db2.get("l"); !slices.EqualFunc(e.list, [][]byte{[]byte("x"), []byte("y")}, bytes.Equal) {
+		t.Errorf("l = %q in db 2, want [x y]", e.list)
+	}
+	if e, ok := db2.shardOf("d").data["d"]; !ok || string(e.val) != "vw" {
+		t.Errorf("d = %q, %v in db 2 while replaying, want vw", e.val, ok)
+	}
+	if _, ok := db2.get("d"); ok {
+		t.Error("d in db 2 didn't expire once replayed")
+	}
+	if e, ok := db2.get("e"); !ok || e.exp != future {
+		t.Errorf("e in db 2 expires at %d, want %d", e.exp, future)
+	}
+	for _, k := range []string{"b", "l", "e"} {
+		if _, ok := db0.get(k); ok {
+			t.Errorf("%s was set in db 0, not 2", k)
+		}
+	}
+}
+
+func TestReplayAOFCutShort(t *testing.T) {
+	whole := aofOf([]string{"SET", "a", "1"}, []string{"SELECT", "1"}, []string{"SET", "b", "2"})
+	for _, tt := range []struct {
+		name string
+		tail []byte
+	}{
+		{"command", aofOf([]string{"SET", "c", "3"})[:10]},
+		{"transaction", aofOf([]string{"MULTI"}, []string{"SET", "c", "3"}, []string{"INCR", "b"})},
+		{"transaction and command", aofOf([]string{"MULTI"}, []string{"SET", "c", "3"}, []string{"EXEC"})[:30]},
+	} {
+		srv, path := replayed(t, append(bytes.Clone(whole), tt.tail...))
+		if v, _, _ := srv.dbs[1].getString("b"); string(v) != "2" {
+			t.Errorf("cut short by a %s: b = %q, want 2", tt.name, v)
+		}
+		if _, ok := srv.dbs[1].get("c"); ok {
+			t.Errorf("cut short by a %s: c was set", tt.name)
+		}
+		if got, _ := os.ReadFile(path); !bytes.Equal(got, whole) {
+			t.Errorf("cut short by a %s: the file was left as %q, want %q", tt.name, got, whole)
+		}
+	}
+}
+
+func TestReplayAOFBad(t *testing.T) {
+	for _, log := range [][]byte{
+		aofOf([]string{"NOSUCHCOMMAND", "a"}),
+		aofOf([]string{"SET", "a"}),
+		[]byte("+OK\r\n"),
+	} {
+		srv := newTestServer(t)
+		path := filepath.Join(srv.config.dir, "appendonly.aof")
+		if err := os.WriteFile(path, log, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := srv.replayAOF(path); err == nil {
+			t.Errorf("replaying %q succeeded", log)
+		}
+	}
+}
+
+func TestWriteKeysCoverWrites(t *testing.T) {
+	anyKey := map[string]bool{"SWAPDB": true, "FLUSHDB": true, "FLUSHALL": true}
+	for name, spec := range commands {
+		if _, ok := writeKeys[name]; spec.flags&cmdWrite != 0 && !ok && !anyKey[name] {
+			t.Errorf("%s is a write, but writeKeys doesn't say where its keys are", name)
+		}
+	}
+}
+
+func TestLogShards(t *testing.T) {
+	srv := newTestServer(t)
+	for _, tt := range []struct {
+		args []string
+		keys []string
+	}{
+		{[]string{"SET", "a", "1", "EX", "10"}, []string{"a"}},
+		{[]string{"MSET", "a", "1", "b", "2", "c", "3"}, []string{"a", "b", "c"}},
+		{[]string{"DEL", "a", "b"}, []string{"a", "b"}},
+		{[]string{"BLPOP", "a", "b", "0"}, []string{"a", "b"}},
+		{[]string{"COPY", "a", "b", "DB", "3"}, []string{"a", "b"}},
+	} {
+		got := srv.logShards(tt.args[0], cmdArgs(tt.args...))
+		if want := srv.shardsOf(tt.keys); !slices.Equal(got, want) {
+			t.Errorf("logShards(%q) = %v, want %v", tt.args, got, want)
+		}
+	}
+	if got := srv.logShards("FLUSHALL", cmdArgs("FLUSHALL")); got != nil {
+		t.Errorf("logShards(FLUSHALL) = %v, want every shard", got)
+	}
+}
+
+// withAOF turns on the append-only file for srv and returns its path.
+func withAOF(t *testing.T, srv *server) string {
+	t.Helper()
+	path := filepath.Join(srv.config.dir, "appendonly.aof")
+	a, _, err := openAOF(srv, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.feed.setAOF(a)
+	return path
+}
+
+// runWrite runs args as c would had it sent them, with the feed on.
+func runWrite(c *client, args ...string) {
+	cmd := strings.ToUpper(args[0])
+	c.runLogged(cmd, commands[cmd], cmdArgs(args...))
+}
+
+// TestConcurrentWritesLogged checks that writes from many clients at once,
+// to shared keys in different shards, are fed in the order they changed
+// each key, so that replaying the log rebuilds the same keyspace.
+func TestConcurrentWritesLogged(t *testing.T) {
+	srv := newTestServer(t)
+	if err := srv.config.set("appendfsync", "always"); err != nil {
+		t.Fatal(err)
+	}
+	path := withAOF(t, srv)
+
+	var wg sync.WaitGroup
+	for g := range 8 {
+		c := newApplier(srv).c
+		wg.Go(func() {
+			for i := range 200 {
+				n := strconv.Itoa(i % 5)
+				v := strconv.Itoa(g*1000 + i)
+				runWrite(c, "RPUSH", "list:"+n, v)
+				runWrite(c, "INCRBY", "count:"+n, v)
+				runWrite(c, "SET", "last:"+n, v)
+				if i%7 == 0 {
+					runWrite(c, "LPOP", "list:"+n)
+					runWrite(c, "RENAME", "last:"+n, "renamed:"+n)
+				}
+				if i%50 == 0 {
+					runWrite(c, "MSET", "m:a", v, "m:b", v)
+				}
+			}
+		})
+	}
+	wg.Wait()
+	if err := srv.feed.closeAOF(); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded := newTestServer(t)
+	if err := loaded.replayAOF(path); err != nil {
+		t.Fatal("replaying: ", err)
+	}
+	checkSameKeyspace(t, srv, loaded)
+}
+
+// TestWritesToOtherShardsGoOn checks that a write doesn't wait for one to a
+// key in another shard to be fed.
+func TestWritesToOtherShardsGoOn(t *testing.T) {
+	srv := newTestServer(t)
+	withAOF(t, srv)
+	defer srv.feed.closeAOF()
+
+	a, b := "a", "b"
+	for i := 0; srv.shardsOf([]string{a})[0] == srv.shardsOf([]string{b})[0]; i++ {
+		b = "b" + strconv.Itoa(i)
+	}
+	// a write to a is partway through
+	unlock := srv.lockLog(srv.shardsOf([]string{a}))
+	defer unlock()
+	within(t, "a write to another shard", func() {
+		runWrite(newApplier(srv).c, "SET", b, "v")
+	})
+	if v, _, _ := srv.dbs[0].getString(b); string(v) != "v" {
+		t.Errorf("%s = %q, want v", b, v)
+	}
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"math/bits"
+	"strconv"
+	"strings"
+
+	"reditlite/resp"
+)
+
+// Bitmaps are plain strings addressed bit by bit, most significant bit of
+// each byte first, as in Redis.
+
+var errBitOffset = errors.New("ERR bit offset is not an integer or out of range")
+
+// parseBitOffset parses a bit offset, which must address a bit within a
+// string of at most max bytes.
+func parseBitOffset(b []byte, max int) (int64, error) {
+	off, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil || off < 0 || off>>3 >= int64(max) {
+		return 0, errBitOffset
+	}
+	return off, nil
+}
+
+// setBit sets the bit at offset in the string at key to bit, growing the
+// value with zero bytes as needed, and returns the previous bit.
+func (s *Store) setBit(key string, offset int64, bit byte) (byte, error) {
+	defer s.lock(key)()
+
+	e, ok, err := s.lookupKind(key, KindString)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		e = Entry{}
+	}
+	i, mask := int(offset>>3), byte(0x80)>>(offset&7)
+	e.val = writable(e.val, i, i+1)
+	old := e.val[i] & mask
+	if bit == 1 {
+		e.val[i] |= mask
+	} else {
+		e.val[i] &^= mask
+	}
+	s.put(key, e)
+	if old != 0 {
+		return 1, nil
+	}
+	return 0, nil
+}
+
+func handleSetBit(w *bufio.Writer, st *Store, args []resp.Value) {
+	// SETBIT key offset value
+	offset, err := parseBitOffset(args[2].B, st.srv.config.maxStringSize())
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	v := string(args[3].B)
+	if v != "0" && v != "1" {
+		_ = resp.WriteError(w, "ERR bit is not an integer or out of range")
+		return
+	}
+	old, err := st.setBit(string(args[1].B), offset, v[0]-'0')
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	_ = resp.WriteInteger(w, int64(old))
+}
+
+func handleGetBit(w *bufio.Writer, st *Store, args []resp.Value) {
+	// GETBIT key offset
+	offset, err := parseBitOffset(args[2].B, st.srv.config.maxStringSize())
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	v, _, err := st.getString(string(args[1].B))
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	if i := int(offset >> 3); i < len(v) && v[i]&(0x80>>(offset&7)) != 0 {
+		_ = resp.WriteInteger(w, 1)
+		return
+	}
+	_ = resp.WriteInteger(w, 0)
+}
+
+// popcount returns the number of set bits in b.
+func popcount(b []byte) int {
+	n := 0
+	for _, c := range b {
+		n += bits.OnesCount8(c)
+	}
+	return n
+}
+
+func bitAt(v []byte, i int) byte {
+	return v[i>>3] >> (7 - i&7) & 1
+}
+
+// parseBitRange parses the optional "start end [BYTE|BIT]" arguments of
+// BITCOUNT and BITPOS and returns the half-open range of bit positions of v
+// they select. Without arguments it selects all of v; a missing end means
+// the last byte.
+func parseBitRange(opts []resp.Value, v []byte) (lo, hi int, err error) {
+	if len(opts) > 3 {
+		return 0, 0, errors.New("ERR syntax error")
+	}
+	start, end := int64(0), int64(-1)
+	if len(opts) > 0 {
+		if start, err = strconv.ParseInt(string(opts[0].B), 10, 64); err != nil {
+			return 0, 0, errNotInteger
+		}
+	}
+	if len(opts) > 1 {
+		if end, err = strconv.ParseInt(string(opts[1].B), 10, 64); err != nil {
+			return 0, 0, errNotInteger
+		}
+	}
+	unit := 8 // BYTE
+	if len(opts) > 2 {
+		switch strings.ToUpper(string(opts[2].B)) {
+		case "BYTE":
+		case "BIT":
+			unit = 1
+		default:
+			return 0, 0, errors.New("ERR syntax error")
+		}
+	}
+	lo, hi = normalizeRange(start, end, len(v)*8/unit)
+	return lo * unit, hi * unit, nil
+}
+
+func handleBitCount(w *bufio.Writer, st *Store, args []resp.Value) {
+	// BITCOUNT key [start end [BYTE|BIT]]
+	if len(args) == 3 {
+		_ = resp.WriteError(w, "ERR syntax error")
+		return
+	}
+	v, _, err := st.getString(string(args[1].B))
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	lo, hi, err := parseBitRange(args[2:], v)
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	n := 0
+	// count the partial bytes at either end bit by bit
+	for ; lo < hi && lo&7 != 0; lo++ {
+		n += int(bitAt(v, lo))
+	}
+	for hi > lo && hi&7 != 0 {
+		hi--
+		n += int(bitAt(v, hi))
+	}
+	n += popcount(v[lo>>3 : hi>>3])
+	_ = resp.WriteInteger(w, int64(n))
+}
+
+func handleBitPos(w *bufio.Writer, st *Store, args []resp.Value) {
+	// BITPOS key bit [start [end [BYTE|BIT]]]
+	b := string(args[2].B)
+	if b != "0" && b != "1" {
+		_ = resp.WriteError(w, "ERR The bit argument must be 1 or 0.")
+		return
+	}
+	bit := b[0] - '0'
+	v, _, err := st.getString(string(args[1].B))
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	lo, hi, err := parseBitRange(args[3:], v)
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	if len(v) == 0 {
+		// a missing key is all zeros
+		_ = resp.WriteInteger(w, -int64(bit))
+		return
+	}
+	skip := byte(0) // bytes that cannot contain the bit
+	if bit == 0 {
+		skip = 0xff
+	}
+	for i := lo; i < hi; {
+		if i&7 == 0 && i+8 <= hi && v[i>>3] == skip {
+			i += 8
+			continue
+		}
+		if bitAt(v, i) == bit {
+			_ = resp.WriteInteger(w, int64(i))
+			return
+		}
+		i++
+	}
+	if bit == 0 && len(args) < 5 && lo < hi {
+		// without an explicit end the string counts as padded with zeros
+		_ = resp.WriteInteger(w, int64(hi))
+		return
+	}
+	_ = resp.WriteInteger(w, -1)
+}
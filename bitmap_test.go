@@ -0,0 +1,106 @@
+package main
+
+import "testing"
+
+func TestPopcount(t *testing.T) {
+	for _, tt := range []struct {
+		b    string
+		want int
+	}{
+		{"", 0},
+		{"\x00", 0},
+		{"\xff", 8},
+		{"\x01\x80\x55", 6},
+	} {
+		if got := popcount([]byte(tt.b)); got != tt.want {
+			t.Errorf("popcount(%q) = %d, want %d", tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestParseBitRange(t *testing.T) {
+	v := []byte("\xff\xf0\x00") // 24 bits
+	tests := []struct {
+		opts   []string
+		lo, hi int
+	}{
+		{nil, 0, 24},
+		{[]string{"0", "0"}, 0, 8},
+		{[]string{"1", "-1"}, 8, 24},
+		{[]string{"-1", "-1"}, 16, 24},
+		{[]string{"-100", "100"}, 0, 24},
+		{[]string{"2", "1"}, 0, 0},
+		{[]string{"1", "1", "byte"}, 8, 16},
+		{[]string{"5", "10", "BIT"}, 5, 11},
+		{[]string{"-1", "-1", "BIT"}, 23, 24},
+		{[]string{"-13", "-1", "bit"}, 11, 24},
+		{[]string{"-24", "-24", "BIT"}, 0, 1},
+		{[]string{"-25", "-24", "BIT"}, 0, 1},
+		{[]string{"0", "23", "BIT"}, 0, 24},
+		{[]string{"0", "24", "BIT"}, 0, 24},
+		{[]string{"3", "2", "BIT"}, 0, 0},
+	}
+	for _, tt := range tests {
+		lo, hi, err := parseBitRange(cmdArgs(tt.opts...), v)
+		if err != nil || lo != tt.lo || hi != tt.hi {
+			t.Errorf("parseBitRange(%q) = %d, %d, %v, want %d, %d", tt.opts, lo, hi, err, tt.lo, tt.hi)
+		}
+	}
+
+	for _, opts := range [][]string{
+		{"a", "1"},
+		{"0", "b"},
+		{"0", "1", "WORD"},
+		{"0", "1", "BIT", "x"},
+	} {
+		if _, _, err := parseBitRange(cmdArgs(opts...), v); err == nil {
+			t.Errorf("parseBitRange(%q) accepted it", opts)
+		}
+	}
+}
+
+func TestBitCountAndPos(t *testing.T) {
+	st := newTestServer(t).dbs[0]
+	st.put("b", Entry{val: []byte("\xff\xf0\x00")})
+	st.put("ones", Entry{val: []byte("\xff\xff")})
+	tests := []struct {
+		args []string
+		want string
+	}{
+		{[]string{"BITCOUNT", "b"}, ":12\r\n"},
+		{[]string{"BITCOUNT", "b", "1", "1"}, ":4\r\n"},
+		{[]string{"BITCOUNT", "b", "-2", "-1"}, ":4\r\n"},
+		{[]string{"BITCOUNT", "b", "0", "0", "BIT"}, ":1\r\n"},
+		{[]string{"BITCOUNT", "b", "5", "10", "BIT"}, ":6\r\n"},
+		{[]string{"BITCOUNT", "b", "-13", "-1", "BIT"}, ":1\r\n"},
+		{[]string{"BITCOUNT", "b", "-12", "-1", "BIT"}, ":0\r\n"},
+		{[]string{"BITCOUNT", "b", "-100", "-1", "BIT"}, ":12\r\n"},
+		{[]string{"BITCOUNT", "b", "3", "2", "BIT"}, ":0\r\n"},
+		{[]string{"BITCOUNT", "b", "1"}, "-ERR syntax error\r\n"},
+		{[]string{"BITCOUNT", "missing"}, ":0\r\n"},
+
+		{[]string{"BITPOS", "b", "1"}, ":0\r\n"},
+		{[]string{"BITPOS", "b", "0"}, ":12\r\n"},
+		{[]string{"BITPOS", "b", "1", "1"}, ":8\r\n"},
+		{[]string{"BITPOS", "b", "0", "0", "0"}, ":-1\r\n"},
+		{[]string{"BITPOS", "b", "1", "9", "-1", "BIT"}, ":9\r\n"},
+		{[]string{"BITPOS", "b", "1", "12", "-1", "BIT"}, ":-1\r\n"},
+		{[]string{"BITPOS", "b", "0", "-13", "-1", "BIT"}, ":12\r\n"},
+		{[]string{"BITPOS", "b", "1", "-13", "-13", "BIT"}, ":11\r\n"},
+		{[]string{"BITPOS", "b", "0", "2", "5", "BIT"}, ":-1\r\n"},
+		{[]string{"BITPOS", "ones", "0"}, ":16\r\n"},            // padded with zeros
+		{[]string{"BITPOS", "ones", "0", "0", "-1"}, ":-1\r\n"}, // but not with an end
+		{[]string{"BITPOS", "missing", "0"}, ":0\r\n"},
+		{[]string{"BITPOS", "missing", "1"}, ":-1\r\n"},
+		{[]string{"BITPOS", "b", "2"}, "-ERR The bit argument must be 1 or 0.\r\n"},
+	}
+	for _, tt := range tests {
+		handler := handleBitCount
+		if tt.args[0] == "BITPOS" {
+			handler = handleBitPos
+		}
+		if got := run(st, handler, tt.args...); got != tt.want {
+			t.Errorf("%q = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
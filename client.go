@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"reditlite/resp"
+)
+
+// client holds the state of one connection. It belongs to the connection's
+// handleConn goroutine, so apart from the writer it needs no locking, and
+// everything in it goes away with the connection, including a transaction
+// left open. The exceptions are db and name, which CLIENT LIST reads from
+// other connections, so they are only written holding srv.clientsMu.
+type client struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	wmu  sync.Mutex // guards w, which c's pusher writes to as well
+
+	pushes pushes // messages and MONITOR lines for c, from other clients
+
+	id      int64 // unique, in order of connection, for CLIENT ID
+	created time.Time
+
+	srv     *server
+	db      *Store // the SELECTed database
+	authed  bool   // passed AUTH, or no password is required
+	proto   int    // RESP version, 2 or 3 after HELLO 3
+	name    string // set by CLIENT SETNAME
+	closing bool   // CLIENT KILL hit this client, so close once replied
+
+	monitoring bool // in MONITOR mode
+
+	channels map[string]struct{} // channels SUBSCRIBEd to
+	patterns map[string]struct{} // patterns PSUBSCRIBEd to
+
+	multi  bool           // between MULTI and EXEC/DISCARD
+	queued [][]resp.Value // commands queued for EXEC
+	dirty  bool           // a command could not be queued, so EXEC aborts
+
+	watching []watch // keys under WATCH, for EXEC to check
+}
+
+func newClient(conn net.Conn, srv *server) *client {
+	return &client{
+		conn:     conn,
+		r:        bufio.NewReader(conn),
+		w:        bufio.NewWriter(conn),
+		id:       srv.nextClientID.Add(1),
+		created:  time.Now(),
+		srv:      srv,
+		db:       srv.dbs[0],
+		proto:    2,
+		authed:   srv.config.password() == "",
+		channels: make(map[string]struct{}),
+		patterns: make(map[string]struct{}),
+		pushes:   pushes{ready: make(chan struct{}, 1)},
+	}
+}
+
+// addr and laddr return the peer and local addresses of c's connection. A
+// Unix socket has no peer address, so for one both are its path, with port
+// 0, as in Redis.
+func (c *client) addr() string {
+	if _, ok := c.conn.LocalAddr().(*net.UnixAddr); ok {
+		return c.laddr()
+	}
+	return c.conn.RemoteAddr().String()
+}
+
+func (c *client) laddr() string {
+	if a, ok := c.conn.LocalAddr().(*net.UnixAddr); ok {
+		return a.Name + ":0"
+	}
+	return c.conn.LocalAddr().String()
+}
+
+func (c *client) auth(args []resp.Value) {
+	// AUTH [username] password
+	if c.srv.config.password() == "" {
+		_ = resp.WriteError(c.w, "ERR Client sent AUTH, but no password is set")
+		return
+	}
+	user := "default"
+	if len(args) == 3 {
+		user = string(args[1].B)
+	}
+	if err := c.authenticate(user, args[len(args)-1].B); err != nil {
+		_ = resp.WriteError(c.w, err.Error())
+		return
+	}
+	_ = resp.WriteSimpleString(c.w, "OK")
+}
+
+// authenticate logs c in as user with pass, for AUTH and HELLO. There are
+// no ACL users, only the default one, which takes any password if none is
+// set.
+func (c *client) authenticate(user string, pass []byte) error {
+	password := c.srv.config.password()
+	if user != "default" || (password != "" && subtle.ConstantTimeCompare(pass, []byte(password)) != 1) {
+		return errors.New("WRONGPASS invalid username-password pair or user is disabled.")
+	}
+	c.authed = true
+	return nil
+}
+
+// hello runs HELLO, which switches the connection's protocol version and
+// optionally authenticates and names it in one go, replying with a map
+// describing the server.
+func (c *client) hello(args []resp.Value) {
+	// HELLO [protover [AUTH username password] [SETNAME clientname]]
+	proto := c.proto
+	if len(args) > 1 {
+		v, err := strconv.Atoi(string(args[1].B))
+		if err != nil {
+			_ = resp.WriteError(c.w, "ERR Protocol version is not an integer or out of range")
+			return
+		}
+		if v != 2 && v != 3 {
+			_ = resp.WriteError(c.w, "NOPROTO unsupported protocol version")
+			return
+		}
+		proto = v
+	}
+	var user, pass, name []byte
+	for i := 2; i < len(args); i++ {
+		switch opt := strings.ToUpper(string(args[i].B)); {
+		case opt == "AUTH" && i+2 < len(args):
+			user, pass = args[i+1].B, args[i+2].B
+			i += 2
+		case opt == "SETNAME" && i+1 < len(args):
+			name = args[i+1].B
+			i++
+		default:
+			_ = resp.WriteError(c.w, "ERR Syntax error in HELLO option '"+string(args[i].B)+"'")
+			return
+		}
+	}
+	if name != nil && !validClientName(name) {
+		_ = resp.WriteError(c.w, errClientName.Error())
+		return
+	}
+	if user != nil {
+		if err := c.authenticate(string(user), pass); err != nil {
+			_ = resp.WriteError(c.w, err.Error())
+			return
+		}
+	}
+	if !c.authed {
+		_ = resp.WriteError(c.w, "NOAUTH HELLO must be called with the client already authenticated, otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate the client and select the RESP protocol version at the same time")
+		return
+	}
+	if name != nil {
+		c.srv.clientsMu.Lock()
+		c.name = string(name)
+		c.srv.clientsMu.Unlock()
+	}
+
+	c.proto = proto
+	c.writeMapHeader(7)
+	_ = resp.WriteBulk(c.w, []byte("server"))
+	_ = resp.WriteBulk(c.w, []byte("redis"))
+	_ = resp.WriteBulk(c.w, []byte("version"))
+	_ = resp.WriteBulk(c.w, []byte(serverVersion))
+	_ = resp.WriteBulk(c.w, []byte("proto"))
+	_ = resp.WriteInteger(c.w, int64(c.proto))
+	_ = resp.WriteBulk(c.w, []byte("id"))
+	_ = resp.WriteInteger(c.w, c.id)
+	_ = resp.WriteBulk(c.w, []byte("mode"))
+	_ = resp.WriteBulk(c.w, []byte("standalone"))
+	_ = resp.WriteBulk(c.w, []byte("role"))
+	_ = resp.WriteBulk(c.w, []byte("master"))
+	_ = resp.WriteBulk(c.w, []byte("modules"))
+	_ = resp.WriteArrayHeader(c.w, 0)
+}
+
+// writeMapHeader starts a reply of n key/value pairs: a map in RESP3, or
+// a flat array of 2n elements in RESP2.
+func (c *client) writeMapHeader(n int) {
+	if c.proto == 3 {
+		_ = resp.WriteMapHeader(c.w, n)
+		return
+	}
+	_ = resp.WriteArrayHeader(c.w, 2*n)
+}
+
+// reset returns c to the state of a new connection: out of any transaction,
+// subscriptions and MONITOR mode, with no watches or name, on database 0
+// and RESP2, and needing to AUTH again if there is a password.
+func (c *client) reset() {
+	// RESET
+	c.endMulti()
+	c.unsubscribeAll()
+	c.unmonitor()
+	c.srv.clientsMu.Lock()
+	c.db, c.name = c.srv.dbs[0], ""
+	c.srv.clientsMu.Unlock()
+	c.authed = c.srv.config.password() == ""
+	c.proto = 2
+	_ = resp.WriteSimpleString(c.w, "RESET")
+}
+
+var errClientName = errors.New("ERR Client names cannot contain spaces, newlines or special characters.")
+
+// validClientName reports whether name may be given to a connection. As in
+// Redis, it must be printable ASCII without spaces, so it can't break up a
+// CLIENT LIST line.
+func validClientName(name []byte) bool {
+	for _, b := range name {
+		if b < '!' || b > '~' {
+			return false
+		}
+	}
+	return true
+}
+
+func handleClient(c *client, args []resp.Value) {
+	// CLIENT ID / CLIENT SETNAME name / CLIENT GETNAME / CLIENT LIST / CLIENT KILL ...
+	switch strings.ToUpper(string(args[1].B)) {
+	case "ID":
+		if len(args) != 2 {
+			_ = resp.WriteError(c.w, "ERR wrong number of arguments for 'client|id'")
+			return
+		}
+		_ = resp.WriteInteger(c.w, c.id)
+	case "SETNAME":
+		if len(args) != 3 {
+			_ = resp.WriteError(c.w, "ERR wrong number of arguments for 'client|setname'")
+			return
+		}
+		if !validClientName(args[2].B) {
+			_ = resp.WriteError(c.w, errClientName.Error())
+			return
+		}
+		c.srv.clientsMu.Lock()
+		c.name = string(args[2].B)
+		c.srv.clientsMu.Unlock()
+		_ = resp.WriteSimpleString(c.w, "OK")
+	case "GETNAME":
+		if len(args) != 2 {
+			_ = resp.WriteError(c.w, "ERR wrong number of arguments for 'client|getname'")
+			return
+		}
+		if c.name == "" {
+			_ = resp.WriteBulk(c.w, nil)
+			return
+		}
+		_ = resp.WriteBulk(c.w, []byte(c.name))
+	case "LIST":
+		if len(args) != 2 {
+			_ = resp.WriteError(c.w, "ERR syntax error")
+			return
+		}
+		var b strings.Builder
+		for _, cl := range c.srv.clientList() {
+			b.WriteString(cl)
+			b.WriteByte('\n')
+		}
+		_ = resp.WriteBulk(c.w, []byte(b.String()))
+	case "KILL":
+		c.kill(args[2:])
+	default:
+		_ = resp.WriteError(c.w, "ERR unknown subcommand '"+string(args[1].B)+"'. Try CLIENT HELP.")
+	}
+}
+
+// addClient registers c as connected; removeClient unregisters it.
+func (srv *server) addClient(c *client) {
+	srv.clientsMu.Lock()
+	srv.clients[c.id] = c
+	srv.clientsMu.Unlock()
+}
+
+func (srv *server) removeClient(c *client) {
+	srv.clientsMu.Lock()
+	delete(srv.clients, c.id)
+	srv.clientsMu.Unlock()
+}
+
+// clientList describes each connected client in the field=value format of
+// CLIENT LIST, in order of connection.
+func (srv *server) clientList() []string {
+	srv.clientsMu.Lock()
+	defer srv.clientsMu.Unlock()
+
+	ids := slices.Sorted(maps.Keys(srv.clients))
+	out := make([]string, len(ids))
+	for i, id := range ids {
+		c := srv.clients[id]
+		out[i] = fmt.Sprintf("id=%d addr=%s laddr=%s name=%s age=%d db=%d",
+			c.id, c.addr(), c.laddr(), c.name,
+			int64(time.Since(c.created).Seconds()), c.db.index)
+	}
+	return out
+}
+
+// kill runs CLIENT KILL with filters, the arguments after KILL: either the
+// old form, a lone addr, or pairs of ID id, ADDR addr and SKIPME yes|no.
+// Closing a connection makes its handleConn return, even from a blocking
+// command, since that watches the connection too.
+func (c *client) kill(filters []resp.Value) {
+	var (
+		id      int64
+		addr    string
+		skipMe  = true
+		oldForm = len(filters) == 1
+	)
+	if oldForm {
+		addr, skipMe = string(filters[0].B), false
+	} else {
+		if len(filters) == 0 || len(filters)%2 != 0 {
+			_ = resp.WriteError(c.w, "ERR syntax error")
+			return
+		}
+		for i := 0; i < len(filters); i += 2 {
+			v := string(filters[i+1].B)
+			switch strings.ToUpper(string(filters[i].B)) {
+			case "ID":
+				n, err := strconv.ParseInt(v, 10, 64)
+				if err != nil || n <= 0 {
+					_ = resp.WriteError(c.w, "ERR client-id should be greater than 0")
+					return
+				}
+				id = n
+			case "ADDR":
+				addr = v
+			case "SKIPME":
+				switch strings.ToLower(v) {
+				case "yes":
+					skipMe = true
+				case "no":
+					skipMe = false
+				default:
+					_ = resp.WriteError(c.w, "ERR syntax error")
+					return
+				}
+			default:
+				_ = resp.WriteError(c.w, "ERR syntax error")
+				return
+			}
+		}
+	}
+
+	c.srv.clientsMu.Lock()
+	var victims []*client
+	for _, cl := range c.srv.clients {
+		if (id != 0 && cl.id != id) || (addr != "" && cl.addr() != addr) || (skipMe && cl == c) {
+			continue
+		}
+		victims = append(victims, cl)
+	}
+	c.srv.clientsMu.Unlock()
+
+	for _, cl := range victims {
+		if cl == c {
+			c.closing = true // after this reply
+		} else {
+			_ = cl.conn.Close()
+		}
+	}
+	if oldForm {
+		if len(victims) == 0 {
+			_ = resp.WriteError(c.w, "ERR No such client")
+			return
+		}
+		_ = resp.WriteSimpleString(c.w, "OK")
+		return
+	}
+	_ = resp.WriteInteger(c.w, int64(len(victims)))
+}
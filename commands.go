@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bufio"
+	"slices"
+	"strings"
+
+	"reditlite/resp"
+)
+
+// command is an entry in the command table.
+type command struct {
+	handler func(c *client, args []resp.Value)
+	// minArgs and maxArgs bound the number of arguments, counting the
+	// command name, maxArgs being -1 for no bound. handleConn checks them
+	// before the command runs or is queued by MULTI, and the applier before
+	// it runs a fed command, so handlers can rely on them.
+	minArgs, maxArgs int
+	flags            cmdFlags
+}
+
+// cmdFlags describe a command for COMMAND, after Redis's command flags.
+type cmdFlags uint8
+
+const (
+	cmdWrite    cmdFlags = 1 << iota // may modify the keyspace
+	cmdReadonly                      // only reads keys
+	cmdAdmin                         // administrative, like CONFIG
+	cmdPubsub                        // part of Pub/Sub
+	cmdBlocking                      // may block the client
+	cmdDenyOOM                       // may grow the dataset, so refused or evicted for over maxmemory
+)
+
+// cmdFlagNames are the Redis names of the flags, by bit.
+var cmdFlagNames = []string{"write", "readonly", "admin", "pubsub", "blocking", "denyoom"}
+
+// commands holds every command by name. handleConn dispatches to the
+// handler, except for the commands with none, which act on the connection
+// itself (transactions, subscriptions, MONITOR, AUTH, HELLO, RESET and a
+// replica's SYNC or PSYNC) and which it runs.
+var commands = map[string]command{
+	"AUTH":         {nil, 2, 3, 0},
+	"MULTI":        {nil, 1, 1, 0},
+	"EXEC":         {nil, 1, 1, 0},
+	"DISCARD":      {nil, 1, 1, 0},
+	"WATCH":        {nil, 2, -1, 0},
+	"SUBSCRIBE":    {nil, 2, -1, cmdPubsub},
+	"PSUBSCRIBE":   {nil, 2, -1, cmdPubsub},
+	"UNSUBSCRIBE":  {nil, 1, -1, cmdPubsub},
+	"PUNSUBSCRIBE": {nil, 1, -1, cmdPubsub},
+	"MONITOR":      {nil, 1, 1, cmdAdmin},
+	"RESET":        {nil, 1, 1, 0},
+	"HELLO":        {nil, 1, -1, 0},
+	"SYNC":         {nil, 1, 1, cmdAdmin},
+	"PSYNC":        {nil, 3, -1, cmdAdmin},
+	"PING":         {onDB(handlePing), 1, 2, 0},
+	"ECHO":         {onDB(handleEcho), 2, 2, 0},
+	"SET":          {onDB(handleSet), 3, -1, cmdWrite | cmdDenyOOM},
+	"GET":          {onDB(handleGet), 2, 2, cmdReadonly},
+	"DEL":          {onDB(handleDel), 2, -1, cmdWrite},
+	"UNLINK":       {onDB(handleUnlink), 2, -1, cmdWrite},
+	"EXPIRE":       {func(c *client, a []resp.Value) { handleExpire(c.w, c.db, a, 1000) }, 3, 3, cmdWrite},
+	"PEXPIRE":      {func(c *client, a []resp.Value) { handleExpire(c.w, c.db, a, 1) }, 3, 3, cmdWrite},
+	"EXPIREAT":     {func(c *client, a []resp.Value) { handleExpireAt(c.w, c.db, a, 1000) }, 3, 3, cmdWrite},
+	"PEXPIREAT":    {func(c *client, a []resp.Value) { handleExpireAt(c.w, c.db, a, 1) }, 3, 3, cmdWrite},
+	"TTL":          {onDB(handleTTL), 2, 2, cmdReadonly},
+	"PTTL":         {onDB(handlePTTL), 2, 2, cmdReadonly},
+	"INCR":         {func(c *client, a []resp.Value) { handleIncr(c.w, c.db, a, 1) }, 2, 2, cmdWrite | cmdDenyOOM},
+	"DECR":         {func(c *client, a []resp.Value) { handleIncr(c.w, c.db, a, -1) }, 2, 2, cmdWrite | cmdDenyOOM},
+	"INCRBY":       {func(c *client, a []resp.Value) { handleIncrBy(c.w, c.db, a, 1) }, 3, 3, cmdWrite | cmdDenyOOM},
+	"DECRBY":       {func(c *client, a []resp.Value) { handleIncrBy(c.w, c.db, a, -1) }, 3, 3, cmdWrite | cmdDenyOOM},
+	"INCRBYFLOAT":  {onDB(handleIncrByFloat), 3, 3, cmdWrite | cmdDenyOOM},
+	"APPEND":       {onDB(handleAppend), 3, 3, cmdWrite | cmdDenyOOM},
+	"STRLEN":       {onDB(handleStrlen), 2, 2, cmdReadonly},
+	"GETSET":       {onDB(handleGetSet), 3, 3, cmdWrite | cmdDenyOOM},
+	"SETNX":        {onDB(handleSetNX), 3, 3, cmdWrite | cmdDenyOOM},
+	"GETDEL":       {onDB(handleGetDel), 2, 2, cmdWrite},
+	"GETEX":        {onDB(handleGetEx), 2, -1, cmdWrite},
+	"SETRANGE":     {onDB(handleSetRange), 4, 4, cmdWrite | cmdDenyOOM},
+	"GETRANGE":     {onDB(handleGetRange), 4, 4, cmdReadonly},
+	"SETBIT":       {onDB(handleSetBit), 4, 4, cmdWrite | cmdDenyOOM},
+	"GETBIT":       {onDB(handleGetBit), 3, 3, cmdReadonly},
+	"BITCOUNT":     {onDB(handleBitCount), 2, -1, cmdReadonly},
+	"BITPOS":       {onDB(handleBitPos), 3, -1, cmdReadonly},
+	"MSET":         {onDB(handleMSet), 3, -1, cmdWrite | cmdDenyOOM},
+	"MGET":         {onDB(handleMGet), 2, -1, cmdReadonly},
+	"MSETNX":       {onDB(handleMSetNX), 3, -1, cmdWrite | cmdDenyOOM},
+	"EXISTS":       {onDB(handleExists), 2, -1, cmdReadonly},
+	"KEYS":         {onDB(handleKeys), 2, 2, cmdReadonly},
+	"SCAN":         {onDB(handleScan), 2, -1, cmdReadonly},
+	"TYPE":         {onDB(handleType), 2, 2, cmdReadonly},
+	"RENAME":       {func(c *client, a []resp.Value) { handleRename(c.w, c.db, a, false) }, 3, 3, cmdWrite},
+	"RENAMENX":     {func(c *client, a []resp.Value) { handleRename(c.w, c.db, a, true) }, 3, 3, cmdWrite},
+	"PERSIST":      {onDB(handlePersist), 2, 2, cmdWrite},
+	"COPY":         {onDB(handleCopy), 3, -1, cmdWrite | cmdDenyOOM},
+	"RANDOMKEY":    {onDB(handleRandomKey), 1, 1, cmdReadonly},
+	"DBSIZE":       {onDB(handleDBSize), 1, 1, cmdReadonly},
+	"TOUCH":        {onDB(handleTouch), 2, -1, cmdReadonly},
+	"LPUSH":        {func(c *client, a []resp.Value) { handlePush(c.w, c.db, a, true) }, 3, -1, cmdWrite | cmdDenyOOM},
+	"RPUSH":        {func(c *client, a []resp.Value) { handlePush(c.w, c.db, a, false) }, 3, -1, cmdWrite | cmdDenyOOM},
+	"LRANGE":       {onDB(handleLRange), 4, 4, cmdReadonly},
+	"LPOP":         {func(c *client, a []resp.Value) { handlePop(c.w, c.db, a, true) }, 2, 3, cmdWrite},
+	"RPOP":         {func(c *client, a []resp.Value) { handlePop(c.w, c.db, a, false) }, 2, 3, cmdWrite},
+	"LLEN":         {onDB(handleLLen), 2, 2, cmdReadonly},
+	"LINDEX":       {onDB(handleLIndex), 3, 3, cmdReadonly},
+	"LINSERT":      {onDB(handleLInsert), 5, 5, cmdWrite | cmdDenyOOM},
+	"LSET":         {onDB(handleLSet), 4, 4, cmdWrite | cmdDenyOOM},
+	"LREM":         {onDB(handleLRem), 4, 4, cmdWrite},
+	"LTRIM":        {onDB(handleLTrim), 4, 4, cmdWrite},
+	"RPOPLPUSH":    {onDB(handleRPopLPush), 3, 3, cmdWrite | cmdDenyOOM},
+	"LMOVE":        {onDB(handleLMove), 5, 5, cmdWrite | cmdDenyOOM},
+	// Outside a transaction handleConn runs BLPOP and BRPOP itself, since
+	// they need the connection to block on; these entries are what EXEC
+	// runs, where they never block.
+	"BLPOP":         {func(c *client, a []resp.Value) { handleBPop(c.w, c.db, a, true, nil, nil) }, 3, -1, cmdWrite | cmdBlocking},
+	"BRPOP":         {func(c *client, a []resp.Value) { handleBPop(c.w, c.db, a, false, nil, nil) }, 3, -1, cmdWrite | cmdBlocking},
+	"HSET":          {onDB(handleHSet), 4, -1, cmdWrite | cmdDenyOOM},
+	"HGET":          {onDB(handleHGet), 3, 3, cmdReadonly},
+	"HGETALL":       {handleHGetAll, 2, 2, cmdReadonly},
+	"HMGET":         {onDB(handleHMGet), 3, -1, cmdReadonly},
+	"HDEL":          {onDB(handleHDel), 3, -1, cmdWrite},
+	"HEXISTS":       {onDB(handleHExists), 3, 3, cmdReadonly},
+	"HKEYS":         {onDB(handleHKeys), 2, 2, cmdReadonly},
+	"HVALS":         {onDB(handleHKeys), 2, 2, cmdReadonly},
+	"HLEN":          {onDB(handleHLen), 2, 2, cmdReadonly},
+	"HINCRBY":       {onDB(handleHIncrBy), 4, 4, cmdWrite | cmdDenyOOM},
+	"HSCAN":         {func(c *client, a []resp.Value) { handleKeyScan(c.w, c.db, a, KindHash) }, 3, -1, cmdReadonly},
+	"SADD":          {onDB(handleSAdd), 3, -1, cmdWrite | cmdDenyOOM},
+	"SREM":          {onDB(handleSRem), 3, -1, cmdWrite},
+	"SMEMBERS":      {onDB(handleSMembers), 2, 2, cmdReadonly},
+	"SCARD":         {onDB(handleSCard), 2, 2, cmdReadonly},
+	"SISMEMBER":     {onDB(handleSIsMember), 3, 3, cmdReadonly},
+	"SINTER":        {func(c *client, a []resp.Value) { handleSetOp(c.w, c.db, a, setInter) }, 2, -1, cmdReadonly},
+	"SUNION":        {func(c *client, a []resp.Value) { handleSetOp(c.w, c.db, a, setUnion) }, 2, -1, cmdReadonly},
+	"SDIFF":         {func(c *client, a []resp.Value) { handleSetOp(c.w, c.db, a, setDiff) }, 2, -1, cmdReadonly},
+	"SPOP":          {onDB(handleSPop), 2, 3, cmdWrite},
+	"SRANDMEMBER":   {onDB(handleSRandMember), 2, 3, cmdReadonly},
+	"SSCAN":         {func(c *client, a []resp.Value) { handleKeyScan(c.w, c.db, a, KindSet) }, 3, -1, cmdReadonly},
+	"ZADD":          {onDB(handleZAdd), 4, -1, cmdWrite | cmdDenyOOM},
+	"ZINCRBY":       {onDB(handleZIncrBy), 4, 4, cmdWrite | cmdDenyOOM},
+	"ZRANGE":        {onDB(handleZRange), 4, -1, cmdReadonly},
+	"ZRANGEBYSCORE": {onDB(handleZRangeByScore), 4, -1, cmdReadonly},
+	"ZSCORE":        {onDB(handleZScore), 3, 3, cmdReadonly},
+	"ZRANK":         {func(c *client, a []resp.Value) { handleZRank(c.w, c.db, a, false) }, 3, 3, cmdReadonly},
+	"ZREVRANK":      {func(c *client, a []resp.Value) { handleZRank(c.w, c.db, a, true) }, 3, 3, cmdReadonly},
+	"ZSCAN":         {func(c *client, a []resp.Value) { handleKeyScan(c.w, c.db, a, KindZSet) }, 3, -1, cmdReadonly},
+	"PUBLISH":       {onDB(handlePublish), 3, 3, cmdPubsub},
+	// Outside a transaction handleConn runs UNWATCH. Queued in one it has
+	// nothing left to do by the time it runs, as EXEC drops the watches.
+	"UNWATCH":  {func(c *client, a []resp.Value) { _ = resp.WriteSimpleString(c.w, "OK") }, 1, 1, 0},
+	"SELECT":   {handleSelect, 2, 2, 0},
+	"SWAPDB":   {handleSwapDB, 3, 3, cmdWrite},
+	"CONFIG":   {handleConfig, 2, -1, cmdAdmin},
+	"INFO":     {handleInfo, 1, -1, 0},
+	"CLIENT":   {handleClient, 2, -1, 0},
+	"DEBUG":    {handleDebug, 2, -1, cmdAdmin},
+	"OBJECT":   {onDB(handleObject), 2, -1, cmdReadonly},
+	"SLOWLOG":  {handleSlowlog, 2, -1, cmdAdmin},
+	"FLUSHDB":  {handleFlush, 1, -1, cmdWrite},
+	"FLUSHALL": {handleFlush, 1, -1, cmdWrite},
+	"SAVE":     {handleSave, 1, 1, cmdAdmin},
+	"BGSAVE":   {handleBGSave, 1, 2, cmdAdmin},
+	"REPLCONF": {handleReplconf, 1, -1, cmdAdmin},
+	// Outside a transaction handleConn runs WAIT, which blocks; this entry
+	// is what EXEC runs, where it never does.
+	"WAIT": {func(c *client, a []resp.Value) { handleWait(c, a, false) }, 3, 3, cmdBlocking},
+}
+
+// onDB adapts a handler for a command on a single database to run on the
+// client's SELECTed one.
+func onDB(h func(w *bufio.Writer, st *Store, args []resp.Value)) func(c *client, args []resp.Value) {
+	return func(c *client, args []resp.Value) { h(c.w, c.db, args) }
+}
+
+func init() {
+	// COMMAND reads the table, so it can only be added once the table exists
+	commands["COMMAND"] = command{handleCommand, 1, -1, 0}
+	// and likewise REPLICAOF, as a replica runs what its master feeds it
+	// from the table
+	commands["REPLICAOF"] = command{handleReplicaOf, 3, 3, cmdAdmin}
+	commands["SLAVEOF"] = command{handleReplicaOf, 3, 3, cmdAdmin}
+}
+
+// checkArity reports whether args has a number of arguments the command
+// accepts.
+func (c command) checkArity(args []resp.Value) bool {
+	return len(args) >= c.minArgs && (c.maxArgs < 0 || len(args) <= c.maxArgs)
+}
+
+// arity returns the command's arity as Redis reports it: the exact number
+// of arguments if there is one, else the minimum negated.
+func (c command) arity() int {
+	if c.minArgs == c.maxArgs {
+		return c.minArgs
+	}
+	return -c.minArgs
+}
+
+// writeInfo writes the reply of COMMAND INFO for the command called name.
+func (c command) writeInfo(w *bufio.Writer, name string) {
+	_ = resp.WriteArrayHeader(w, 3)
+	_ = resp.WriteBulk(w, []byte(strings.ToLower(name)))
+	_ = resp.WriteInteger(w, int64(c.arity()))
+	c.writeFlags(w)
+}
+
+// writeFlags writes the names of c's flags as an array.
+func (c command) writeFlags(w *bufio.Writer) {
+	var names []resp.Value
+	for i, name := range cmdFlagNames {
+		if c.flags&(1<<i) != 0 {
+			names = append(names, resp.Value{T: resp.SimpleString, S: name})
+		}
+	}
+	_ = resp.WriteArray(w, names)
+}
+
+func handleCommand(c *client, args []resp.Value) {
+	// COMMAND / COMMAND COUNT / COMMAND INFO [name ...] / COMMAND DOCS [name ...]
+	var sub string
+	if len(args) > 1 {
+		sub = strings.ToUpper(string(args[1].B))
+	}
+	// with no names, INFO and DOCS describe every command
+	names := make([]string, 0, len(commands))
+	if len(args) > 2 {
+		for _, a := range args[2:] {
+			names = append(names, strings.ToUpper(string(a.B)))
+		}
+	} else {
+		for name := range commands {
+			names = append(names, name)
+		}
+		slices.Sort(names)
+	}
+
+	switch sub {
+	case "COUNT":
+		if len(args) != 2 {
+			_ = resp.WriteError(c.w, "ERR wrong number of arguments for 'command|count'")
+			return
+		}
+		_ = resp.WriteInteger(c.w, int64(len(commands)))
+	case "", "INFO":
+		// unknown names get a null entry
+		_ = resp.WriteArrayHeader(c.w, len(names))
+		for _, name := range names {
+			if spec, ok := commands[name]; ok {
+				spec.writeInfo(c.w, name)
+			} else {
+				_ = resp.WriteNullArray(c.w)
+			}
+		}
+	case "DOCS":
+		// a flat array of name, docs pairs, leaving unknown names out
+		names = slices.DeleteFunc(names, func(name string) bool {
+			_, ok := commands[name]
+			return !ok
+		})
+		_ = resp.WriteArrayHeader(c.w, 2*len(names))
+		for _, name := range names {
+			spec := commands[name]
+			_ = resp.WriteBulk(c.w, []byte(strings.ToLower(name)))
+			_ = resp.WriteArrayHeader(c.w, 4)
+			_ = resp.WriteBulk(c.w, []byte("arity"))
+			_ = resp.WriteInteger(c.w, int64(spec.arity()))
+			_ = resp.WriteBulk(c.w, []byte("flags"))
+			spec.writeFlags(c.w)
+		}
+	default:
+		_ = resp.WriteError(c.w, "ERR unknown subcommand '"+string(args[1].B)+"'. Try COMMAND HELP.")
+	}
+}
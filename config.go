@@ -0,0 +1,466 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"reditlite/resp"
+)
+
+// config holds the server's settings. The command-line flags set them at
+// startup and CONFIG SET changes the mutable ones while running, so they are
+// read through the methods below rather than copied once.
+type config struct {
+	mu sync.RWMutex
+
+	databases       int    // number of databases, fixed at startup
+	shards          int    // shards per database, a power of two, fixed at startup
+	requirepass     string // password clients must AUTH with, "" if none
+	notifyClasses   uint32 // keyspace notification classes enabled, 0 if off
+	maxmemory       int64  // memory limit in bytes, 0 for none
+	maxmemoryPolicy string // what to do when maxmemory is reached
+	slowlogSlower   int64  // µs a command must take to be logged, < 0 for none
+	slowlogMaxLen   int    // entries the slow log keeps
+	protoMaxBulkLen int64  // longest bulk string a client may send
+	dir             string // directory the snapshot is kept in
+	dbfilename      string // name of the snapshot file
+	appendonly      bool   // log writes to the append-only file, fixed at startup
+	appendfilename  string // name of the append-only file, fixed at startup
+	appendfsync     string // when to sync the append-only file: always, everysec or no
+	replicaReadOnly bool   // a replica refuses writes from its clients
+	masterauth      string // password to AUTH with to the master, "" if none
+	timeout         int    // seconds a client may idle before it is hung up on, 0 for ever
+	maxclients      int    // most clients connected at once
+	shutdownSigterm string // what shutting down on SIGTERM does: save or nosave
+	shutdownSigint  string // the same for SIGINT
+}
+
+// configParam is a setting as CONFIG GET and CONFIG SET see it. get and set
+// are called with config.mu held.
+type configParam struct {
+	get func(cfg *config) string
+	set func(cfg *config, v string) error // nil if the setting is read-only
+}
+
+// configParams holds the settings CONFIG knows, by name.
+var configParams = map[string]configParam{
+	"databases": {
+		get: func(cfg *config) string { return strconv.Itoa(cfg.databases) },
+	},
+	"requirepass": {
+		get: func(cfg *config) string { return cfg.requirepass },
+		set: func(cfg *config, v string) error {
+			cfg.requirepass = v
+			return nil
+		},
+	},
+	"notify-keyspace-events": {
+		get: func(cfg *config) string { return formatNotifyFlags(cfg.notifyClasses) },
+		set: func(cfg *config, v string) error {
+			flags, err := parseNotifyFlags(v)
+			if err != nil {
+				return err
+			}
+			cfg.notifyClasses = flags
+			return nil
+		},
+	},
+	"maxmemory": {
+		get: func(cfg *config) string { return strconv.FormatInt(cfg.maxmemory, 10) },
+		set: func(cfg *config, v string) error {
+			n, err := parseMemory(v)
+			if err != nil {
+				return err
+			}
+			cfg.maxmemory = n
+			return nil
+		},
+	},
+	"maxmemory-policy": {
+		get: func(cfg *config) string { return cfg.maxmemoryPolicy },
+		set: func(cfg *config, v string) error {
+			v = strings.ToLower(v)
+			if !slices.Contains(maxmemoryPolicies, v) {
+				return errors.New("argument(s) must be one of the following: " + strings.Join(maxmemoryPolicies, ", "))
+			}
+			cfg.maxmemoryPolicy = v
+			return nil
+		},
+	},
+	"proto-max-bulk-len": {
+		get: func(cfg *config) string { return strconv.FormatInt(cfg.protoMaxBulkLen, 10) },
+		set: func(cfg *config, v string) error {
+			n, err := parseMemory(v)
+			if err != nil {
+				return err
+			}
+			if n < 1<<20 || n > math.MaxInt32 {
+				return errors.New("argument must be between 1048576 and 2147483647 inclusive")
+			}
+			cfg.protoMaxBulkLen = n
+			return nil
+		},
+	},
+	"dir": {
+		get: func(cfg *config) string { return cfg.dir },
+		set: func(cfg *config, v string) error {
+			if fi, err := os.Stat(v); err != nil || !fi.IsDir() {
+				return errors.New("No such file or directory")
+			}
+			cfg.dir = v
+			return nil
+		},
+	},
+	"dbfilename": {
+		get: func(cfg *config) string { return cfg.dbfilename },
+		set: func(cfg *config, v string) error {
+			if v == "" || filepath.Base(v) != v {
+				return errors.New("dbfilename can't be a path, just a filename")
+			}
+			cfg.dbfilename = v
+			return nil
+		},
+	},
+	"appendonly": {
+		get: func(cfg *config) string { return formatYesNo(cfg.appendonly) },
+	},
+	"appendfilename": {
+		get: func(cfg *config) string { return cfg.appendfilename },
+	},
+	"appendfsync": {
+		get: func(cfg *config) string { return cfg.appendfsync },
+		set: func(cfg *config, v string) error {
+			v = strings.ToLower(v)
+			if v != "always" && v != "everysec" && v != "no" {
+				return errors.New("argument(s) must be one of the following: always, everysec, no")
+			}
+			cfg.appendfsync = v
+			return nil
+		},
+	},
+	"replica-read-only": {
+		get: func(cfg *config) string { return formatYesNo(cfg.replicaReadOnly) },
+		set: func(cfg *config, v string) (err error) {
+			cfg.replicaReadOnly, err = parseYesNo(v)
+			return err
+		},
+	},
+	"masterauth": {
+		get: func(cfg *config) string { return cfg.masterauth },
+		set: func(cfg *config, v string) error {
+			cfg.masterauth = v
+			return nil
+		},
+	},
+	"timeout": {
+		get: func(cfg *config) string { return strconv.Itoa(cfg.timeout) },
+		set: func(cfg *config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return errors.New("argument must be a non-negative integer")
+			}
+			cfg.timeout = n
+			return nil
+		},
+	},
+	"maxclients": {
+		get: func(cfg *config) string { return strconv.Itoa(cfg.maxclients) },
+		set: func(cfg *config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 1 {
+				return errors.New("argument must be a positive integer")
+			}
+			cfg.maxclients = n
+			return nil
+		},
+	},
+	"shutdown-on-sigterm": {
+		get: func(cfg *config) string { return cfg.shutdownSigterm },
+		set: func(cfg *config, v string) (err error) {
+			cfg.shutdownSigterm, err = parseShutdownMode(v)
+			return err
+		},
+	},
+	"shutdown-on-sigint": {
+		get: func(cfg *config) string { return cfg.shutdownSigint },
+		set: func(cfg *config, v string) (err error) {
+			cfg.shutdownSigint, err = parseShutdownMode(v)
+			return err
+		},
+	},
+	"slowlog-log-slower-than": {
+		get: func(cfg *config) string { return strconv.FormatInt(cfg.slowlogSlower, 10) },
+		set: func(cfg *config, v string) error {
+			n, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return errors.New("argument couldn't be parsed into an integer")
+			}
+			cfg.slowlogSlower = n
+			return nil
+		},
+	},
+	"slowlog-max-len": {
+		get: func(cfg *config) string { return strconv.Itoa(cfg.slowlogMaxLen) },
+		set: func(cfg *config, v string) error {
+			n, err := strconv.Atoi(v)
+			if err != nil || n < 0 {
+				return errors.New("argument must be a non-negative integer")
+			}
+			cfg.slowlogMaxLen = n
+			return nil
+		},
+	},
+}
+
+// maxmemoryPolicies are the values maxmemory-policy accepts, those of
+// Redis's that are implemented.
+var maxmemoryPolicies = []string{"allkeys-lru", "noeviction"}
+
+func newConfig() *config {
+	return &config{
+		databases:       16,
+		shards:          16,
+		maxmemoryPolicy: "noeviction",
+		slowlogSlower:   10000,
+		slowlogMaxLen:   128,
+		protoMaxBulkLen: int64(resp.DefaultLimits.MaxBulkLen),
+		dir:             ".",
+		dbfilename:      "dump.rdb",
+		appendfilename:  "appendonly.aof",
+		appendfsync:     "everysec",
+		replicaReadOnly: true,
+		maxclients:      10000,
+		shutdownSigterm: "save",
+		shutdownSigint:  "save",
+	}
+}
+
+// set sets the parameter called name to v.
+func (cfg *config) set(name, v string) error {
+	p, ok := configParams[name]
+	if !ok {
+		return errors.New("unknown parameter")
+	}
+	if p.set == nil {
+		return errors.New("can't set immutable config")
+	}
+	cfg.mu.Lock()
+	defer cfg.mu.Unlock()
+	return p.set(cfg, v)
+}
+
+// password returns the password clients must AUTH with, "" if none.
+func (cfg *config) password() string {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return cfg.requirepass
+}
+
+// notifyFlags returns the keyspace notification classes enabled, 0 if
+// notifications are off.
+func (cfg *config) notifyFlags() uint32 {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return cfg.notifyClasses
+}
+
+// readLimits returns the limits on what clients may send.
+func (cfg *config) readLimits() resp.Limits {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	lim := resp.DefaultLimits
+	lim.MaxBulkLen = int(cfg.protoMaxBulkLen)
+	return lim
+}
+
+// memoryLimit returns maxmemory and maxmemory-policy.
+func (cfg *config) memoryLimit() (int64, string) {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return cfg.maxmemory, cfg.maxmemoryPolicy
+}
+
+// dumpPath returns the path of the snapshot file.
+func (cfg *config) dumpPath() string {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return filepath.Join(cfg.dir, cfg.dbfilename)
+}
+
+// aofPath returns the path of the append-only file.
+func (cfg *config) aofPath() string {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return filepath.Join(cfg.dir, cfg.appendfilename)
+}
+
+// appendFsync returns when to sync the append-only file.
+func (cfg *config) appendFsync() string {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return cfg.appendfsync
+}
+
+// masterAuth returns the password to AUTH with to the master, "" if none.
+func (cfg *config) masterAuth() string {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return cfg.masterauth
+}
+
+// readOnlyReplica reports whether a replica refuses writes from its clients.
+func (cfg *config) readOnlyReplica() bool {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return cfg.replicaReadOnly
+}
+
+// idleTimeout returns how long a client may idle before it is hung up on, 0
+// for ever.
+func (cfg *config) idleTimeout() time.Duration {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return time.Duration(cfg.timeout) * time.Second
+}
+
+// maxStringSize returns proto-max-bulk-len, which bounds how long commands
+// such as SETRANGE and APPEND may make a string, as well as what clients
+// send, as in Redis.
+func (cfg *config) maxStringSize() int {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return int(cfg.protoMaxBulkLen)
+}
+
+// maxClients returns the most clients that may be connected at once.
+func (cfg *config) maxClients() int {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return cfg.maxclients
+}
+
+// saveOnShutdown reports whether shutting down on sig saves a snapshot.
+func (cfg *config) saveOnShutdown(sig os.Signal) bool {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	if sig == os.Interrupt {
+		return cfg.shutdownSigint == "save"
+	}
+	return cfg.shutdownSigterm == "save"
+}
+
+// slowlogSettings returns the slow log's threshold in microseconds and its
+// length.
+func (cfg *config) slowlogSettings() (threshold int64, maxLen int) {
+	cfg.mu.RLock()
+	defer cfg.mu.RUnlock()
+	return cfg.slowlogSlower, cfg.slowlogMaxLen
+}
+
+// parseShutdownMode parses a shutdown-on-sigterm or shutdown-on-sigint
+// value.
+func parseShutdownMode(v string) (string, error) {
+	v = strings.ToLower(v)
+	if v != "save" && v != "nosave" {
+		return "", errors.New("argument(s) must be one of the following: save, nosave")
+	}
+	return v, nil
+}
+
+// parseMemory parses a memory size such as "100mb" the way Redis does: a
+// plain number of bytes, or one with a k, kb, m, mb, g or gb suffix, where
+// the "b" forms are powers of 1024 and the others of 1000.
+func parseMemory(s string) (int64, error) {
+	units := []struct {
+		suffix string
+		mul    int64
+	}{
+		{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30},
+		{"k", 1e3}, {"m", 1e6}, {"g", 1e9}, {"b", 1},
+	}
+	s = strings.ToLower(s)
+	mul := int64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s, mul = strings.TrimSuffix(s, u.suffix), u.mul
+			break
+		}
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 || n > (1<<63-1)/mul {
+		return 0, errors.New("argument must be a memory value")
+	}
+	return n * mul, nil
+}
+
+// parseYesNo parses the value of a yes/no setting.
+func parseYesNo(v string) (bool, error) {
+	switch strings.ToLower(v) {
+	case "yes":
+		return true, nil
+	case "no":
+		return false, nil
+	}
+	return false, errors.New("argument must be 'yes' or 'no'")
+}
+
+func formatYesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func handleConfig(c *client, args []resp.Value) {
+	// CONFIG GET pattern [pattern ...] / CONFIG SET parameter value
+	cfg := c.srv.config
+	switch strings.ToUpper(string(args[1].B)) {
+	case "GET":
+		if len(args) < 3 {
+			_ = resp.WriteError(c.w, "ERR wrong number of arguments for 'config|get'")
+			return
+		}
+		var names []string
+		for name := range configParams {
+			for _, a := range args[2:] {
+				if matchPattern(strings.ToLower(string(a.B)), name) {
+					names = append(names, name)
+					break
+				}
+			}
+		}
+		slices.Sort(names)
+		cfg.mu.RLock()
+		c.writeMapHeader(len(names))
+		for _, name := range names {
+			_ = resp.WriteBulk(c.w, []byte(name))
+			_ = resp.WriteBulk(c.w, []byte(configParams[name].get(cfg)))
+		}
+		cfg.mu.RUnlock()
+	case "SET":
+		if len(args) != 4 {
+			_ = resp.WriteError(c.w, "ERR wrong number of arguments for 'config|set'")
+			return
+		}
+		name := strings.ToLower(string(args[2].B))
+		if _, ok := configParams[name]; !ok {
+			_ = resp.WriteError(c.w, "ERR Unknown option or number of arguments for CONFIG SET - '"+name+"'")
+			return
+		}
+		if err := cfg.set(name, string(args[3].B)); err != nil {
+			reason := strings.TrimPrefix(err.Error(), "ERR ")
+			_ = resp.WriteError(c.w, "ERR CONFIG SET failed (possibly related to argument '"+name+"') - "+reason)
+			return
+		}
+		_ = resp.WriteSimpleString(c.w, "OK")
+	default:
+		_ = resp.WriteError(c.w, "ERR unknown subcommand '"+string(args[1].B)+"'. Try CONFIG HELP.")
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"reditlite/resp"
+)
+
+// handleDebug runs DEBUG, the umbrella for hooks meant for testing.
+// handleConn runs it without srv.txmu, so a sleeping client holds up no one
+// else.
+func handleDebug(c *client, args []resp.Value) {
+	// DEBUG SLEEP seconds
+	switch strings.ToUpper(string(args[1].B)) {
+	case "SLEEP":
+		if len(args) != 3 {
+			_ = resp.WriteError(c.w, "ERR wrong number of arguments for 'debug|sleep'")
+			return
+		}
+		secs, err := parseFloat(args[2].B)
+		if err != nil {
+			_ = resp.WriteError(c.w, errNotFloat.Error())
+			return
+		}
+		if secs < 0 {
+			_ = resp.WriteError(c.w, "ERR sleep time is negative")
+			return
+		}
+		time.Sleep(time.Duration(secs * float64(time.Second)))
+		_ = resp.WriteSimpleString(c.w, "OK")
+	default:
+		_ = resp.WriteError(c.w, "ERR unknown subcommand '"+string(args[1].B)+"'. Try DEBUG HELP.")
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"errors"
+	"math/rand/v2"
+)
+
+var errOOM = errors.New("OOM command not allowed when used memory > 'maxmemory'.")
+
+// evictionSamples is how many keys eviction compares to find one to evict,
+// Redis's default maxmemory-samples.
+const evictionSamples = 5
+
+// entrySize approximates the memory key and e take: the bytes of the key
+// and of the value's strings, with 8 for each score of a sorted set. A
+// collection's are kept in elemSize as it changes, so that a command adding
+// one element doesn't count them all again.
+func entrySize(key string, e Entry) int64 {
+	return int64(len(key)+len(e.val)) + e.elemSize
+}
+
+// bytesSize returns the size of elems as entrySize counts it.
+func bytesSize(elems [][]byte) int64 {
+	n := 0
+	for _, el := range elems {
+		n += len(el)
+	}
+	return int64(n)
+}
+
+// zitemSize is the size entrySize counts for a member of a sorted set.
+func zitemSize(member string) int64 {
+	return int64(len(member)) + 8
+}
+
+// accountMemory adds delta to the memory used, by sh and by the server. The
+// caller must hold sh's lock.
+func (srv *server) accountMemory(sh *shard, delta int64) {
+	sh.used += delta
+	srv.usedMemory.Add(delta)
+}
+
+// freeMemory makes room for a command that may grow the dataset, if the
+// memory used is over maxmemory: allkeys-lru evicts keys until it is back
+// under, and noeviction refuses the command with errOOM, as does
+// allkeys-lru once there is nothing left to evict.
+func (srv *server) freeMemory() error {
+	limit, policy := srv.config.memoryLimit()
+	for limit > 0 && srv.usedMemory.Load() > limit {
+		if policy != "allkeys-lru" || !srv.evictOne() {
+			return errOOM
+		}
+	}
+	return nil
+}
+
+// evictOne evicts the least recently used of a sample of keys from across
+// the databases, which is how Redis approximates LRU without keeping the
+// keys in order, and reports whether there was a key to evict.
+func (srv *server) evictOne() bool {
+	srv.txmu.RLock() // keys don't go in the middle of a transaction
+	defer srv.txmu.RUnlock()
+
+	var (
+		victimDB *Store
+		victim   string
+		oldest   int64
+		sampled  int
+	)
+	// Take a key from each of the shards after a random one, as map
+	// iteration starts at a random key. Sampling across shards rather than
+	// within one keeps a shard whose older keys are all gone from being
+	// picked clean.
+	nshards := len(srv.dbs[0].shards)
+	total := len(srv.dbs) * nshards
+	start := rand.IntN(total)
+	for i := 0; i < total && sampled < evictionSamples; i++ {
+		j := (start + i) % total
+		db := srv.dbs[j/nshards]
+		sh := db.shards[j%nshards]
+		sh.mu.RLock()
+		for k, e := range sh.data {
+			if at := e.atime.Load(); victimDB == nil || at < oldest {
+				victimDB, victim, oldest = db, k, at
+			}
+			sampled++
+			break
+		}
+		sh.mu.RUnlock()
+	}
+	if victimDB == nil {
+		return false
+	}
+
+	unlockLog := srv.lockLog(srv.shardsOf([]string{victim}))
+	unlock := victimDB.lock(victim)
+	if _, ok := victimDB.shardOf(victim).data[victim]; ok {
+		victimDB.remove(victim)
+		srv.stats.evictedKeys.Add(1)
+		srv.feed.logCommand(victimDB.index, "DEL", victim)
+	}
+	unlock()
+	unlockLog()
+	return true
+}
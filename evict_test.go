@@ -0,0 +1,88 @@
+package main
+
+import (
+	"testing"
+)
+
+// countSize counts the memory key and e take from scratch, as entrySize
+// approximates it.
+func countSize(key string, e Entry) int64 {
+	n := len(key) + len(e.val)
+	for _, el := range e.list {
+		n += len(el)
+	}
+	for f, v := range e.hash {
+		n += len(f) + len(v)
+	}
+	for m := range e.set {
+		n += len(m)
+	}
+	if e.zset != nil {
+		for _, it := range e.zset.items {
+			n += len(it.member) + 8
+		}
+	}
+	return int64(n)
+}
+
+// TestMemoryAccounting checks that the sizes the commands keep as they
+// change values add up to what counting the values afresh gives.
+func TestMemoryAccounting(t *testing.T) {
+	srv := newTestServer(t)
+	st := srv.dbs[0]
+	steps := []func(){
+		func() { _, _ = st.push("l", cmdArgs("a", "bb", "ccc", "bb"), false) },
+		func() { _, _ = st.push("l", cmdArgs("dddd", "e"), true) },
+		func() { _, _, _ = st.pop("l", 2, true) },
+		func() { _, _, _ = st.pop("l", 1, false) },
+		func() { _, _ = st.listInsert("l", true, []byte("bb"), []byte("inserted")) },
+		func() { _ = st.listSet("l", 0, []byte("replaced by a longer one")) },
+		func() { _, _ = st.push("l", cmdArgs("x", "x", "y", "x"), false) },
+		func() { _, _ = st.listRem("l", -2, []byte("x")) },
+		func() { _ = st.listTrim("l", 1, -2) },
+		func() { _, _, _ = st.move("l", "l2", true, false) },
+		func() { _, _, _ = st.move("l", "l", false, true) },
+
+		func() { _, _ = st.hset("h", cmdArgs("f1", "v1", "f2", "value2", "f1", "longer v1")) },
+		func() { _, _ = st.hset("h", cmdArgs("f2", "v")) },
+		func() { _, _ = st.hincrBy("h", "n", 5) },
+		func() { _, _ = st.hincrBy("h", "n", 12345) },
+		func() { _, _ = st.hdel("h", cmdArgs("f1", "missing")) },
+
+		func() { _, _ = st.sadd("s", cmdArgs("a", "bb", "ccc", "a")) },
+		func() { _, _ = st.srem("s", cmdArgs("bb", "zz")) },
+		func() { _, _, _ = st.spop("s", 1) },
+
+		func() { _, _, _, _ = st.zadd("z", cmdArgs("1", "one", "2", "two"), zaddOptions{}) },
+		func() { _, _, _, _ = st.zadd("z", cmdArgs("3", "one", "4", "four"), zaddOptions{}) },
+		func() { _, _, _, _ = st.zadd("z", cmdArgs("5", "five"), zaddOptions{xx: true}) },
+
+		func() { _, _ = st.appendVal("str", []byte("abc")) },
+		func() { _, _ = st.setRange("str", 10, []byte("xyz")) },
+		func() { _, _ = st.setBit("str", 200, 1) },
+		func() { _, _ = st.incrBy("n", 1000) },
+		func() { _, _ = st.rename("str", "str2", false) },
+		func() { st.copyKey("h", "h2", false) },
+		func() { st.del("l2") },
+	}
+	for i, step := range steps {
+		step()
+		var want int64
+		for _, sh := range st.shards {
+			var used int64
+			for k, e := range sh.data {
+				if n := countSize(k, e); e.size != n {
+					t.Errorf("after step %d: %s is counted as %d bytes, but takes %d", i, k, e.size, n)
+				}
+				used += e.size
+			}
+			if sh.used != used {
+				t.Errorf("after step %d: shard counts %d bytes used, its entries %d", i, sh.used, used)
+			}
+			want += used
+		}
+		if got := srv.usedMemory.Load(); got != want {
+			t.Errorf("after step %d: used memory is %d, entries take %d", i, got, want)
+		}
+	}
+}
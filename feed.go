@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"reditlite/resp"
+)
+
+// feed is the stream of changes to the keyspace, as the commands that make
+// them, which the append-only file logs and replicas are sent. A command is
+// fed once it has changed the keyspace, after a SELECT if it ran on another
+// database than the last, and a transaction's commands go between MULTI and
+// EXEC. Feeding does nothing while there is no one to feed.
+type feed struct {
+	mu       sync.Mutex
+	buf      bytes.Buffer
+	w        *bufio.Writer // writes to buf
+	db       int           // the database last SELECTed, -1 to SELECT again
+	inTx     bool          // between beginTx and endTx
+	txLogged bool          // MULTI has been fed for the transaction
+
+	aof      *aof // nil if appendonly is off
+	replicas map[*replica]struct{}
+	active   atomic.Bool // there is an aof or a replica, to skip the lock when not
+
+	ackMu sync.Mutex
+	acks  chan struct{} // closed, and replaced, when a replica acknowledges
+}
+
+// feedItemsPerCommand is how many elements each command that rebuilds a
+// list, hash, set or sorted set carries.
+const feedItemsPerCommand = 64
+
+func newFeed() *feed {
+	f := &feed{db: -1, replicas: make(map[*replica]struct{}), acks: make(chan struct{})}
+	f.w = bufio.NewWriter(&f.buf)
+	return f
+}
+
+// on reports whether anything is fed.
+func (f *feed) on() bool {
+	return f.active.Load()
+}
+
+// log feeds args, a command run on database db. It is handed on before log
+// returns; with appendfsync always, the writer then calls syncAOF before it
+// replies, so a client never has the reply to a write the append-only file
+// could still lose.
+func (f *feed) log(db int, args []resp.Value) {
+	if !f.on() {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.inTx && !f.txLogged {
+		f.write(db, bulkStrings([]string{"MULTI"}))
+		f.txLogged = true
+	}
+	f.write(db, args)
+	f.send()
+}
+
+// logCommand is log for a command given as strings.
+func (f *feed) logCommand(db int, args ...string) {
+	if !f.on() {
+		return
+	}
+	f.log(db, bulkStrings(args))
+}
+
+// beginTx and endTx bracket the commands EXEC runs, which are fed between
+// MULTI and EXEC so that replaying applies all of them or, if the log was
+// cut short partway, none.
+func (f *feed) beginTx() {
+	f.mu.Lock()
+	f.inTx = true
+	f.mu.Unlock()
+}
+
+func (f *feed) endTx() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.txLogged {
+		f.write(f.db, bulkStrings([]string{"EXEC"}))
+		f.send()
+	}
+	f.inTx, f.txLogged = false, false
+}
+
+// logKeyspace feeds commands that rebuild every key of dbs as it is, for a
+// new append-only file to start from, or after a replica's full resync. The
+// caller must keep the keyspace from changing meanwhile.
+func (f *feed) logKeyspace(dbs []*Store) {
+	if !f.on() {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, db := range dbs {
+		for _, sh := range db.shards {
+			for k, e := range sh.data {
+				for _, cmd := range keyCommands(k, e) {
+					f.write(db.index, bulks(cmd))
+				}
+				if f.buf.Len() > 1<<20 {
+					f.send()
+				}
+			}
+		}
+	}
+	f.send()
+}
+
+// keyCommands returns commands that recreate key holding e.
+func keyCommands(key string, e Entry) [][][]byte {
+	k := []byte(key)
+	var cmds [][][]byte
+	add := func(name string, items [][]byte) {
+		for len(items) > 0 {
+			n := min(len(items), feedItemsPerCommand)
+			cmds = append(cmds, append([][]byte{[]byte(name), k}, items[:n]...))
+			items = items[n:]
+		}
+	}
+	var items [][]byte
+	switch e.kind {
+	case KindString:
+		cmds = append(cmds, [][]byte{[]byte("SET"), k, e.val})
+	case KindList:
+		add("RPUSH", e.list)
+	case KindHash:
+		for f, v := range e.hash {
+			items = append(items, []byte(f), v)
+		}
+		add("HSET", items)
+	case KindSet:
+		for m := range e.set {
+			items = append(items, []byte(m))
+		}
+		add("SADD", items)
+	case KindZSet:
+		for _, it := range e.zset.items {
+			items = append(items, []byte(formatScore(it.score)), []byte(it.member))
+		}
+		add("ZADD", items)
+	}
+	if e.exp > 0 {
+		cmds = append(cmds, [][]byte{[]byte("PEXPIREAT"), k, strconv.AppendInt(nil, e.exp, 10)})
+	}
+	return cmds
+}
+
+// write buffers args, SELECTing db first if need be. The caller must hold
+// f.mu.
+func (f *feed) write(db int, args []resp.Value) {
+	if db != f.db {
+		_ = resp.WriteArray(f.w, bulkStrings([]string{"SELECT", strconv.Itoa(db)}))
+		f.db = db
+	}
+	_ = resp.WriteArray(f.w, args)
+}
+
+// send hands what is buffered to the append-only file and the replicas.
+// The caller must hold f.mu.
+func (f *feed) send() {
+	_ = f.w.Flush()
+	if f.aof != nil {
+		f.aof.write(f.buf.Bytes())
+	}
+	for r := range f.replicas {
+		r.send(f.buf.Bytes())
+	}
+	f.buf.Reset()
+}
+
+// syncAOF syncs the append-only file, if appendfsync is always, up to
+// what has been fed. It takes no lock but f.mu, briefly, so a writer calls
+// it once it has let go of the rest, before replying.
+func (f *feed) syncAOF() {
+	if !f.on() {
+		return
+	}
+	f.mu.Lock()
+	a := f.aof
+	f.mu.Unlock()
+	if a != nil {
+		a.syncAlways()
+	}
+}
+
+// setAOF starts feeding a.
+func (f *feed) setAOF(a *aof) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.aof = a
+	f.active.Store(true)
+}
+
+// closeAOF stops feeding the append-only file, if there is one, and syncs
+// and closes it.
+func (f *feed) closeAOF() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.aof == nil {
+		return nil
+	}
+	a := f.aof
+	f.aof = nil
+	f.active.Store(len(f.replicas) > 0)
+	return a.close()
+}
+
+// addReplica starts feeding r, from the next command on. The caller must
+// hold srv.txmu exclusively, so nothing changes between r's snapshot being
+// taken and it being fed.
+func (f *feed) addReplica(r *replica) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.replicas[r] = struct{}{}
+	f.db = -1 // r starts out in database 0, whatever came before
+	f.active.Store(true)
+}
+
+func (f *feed) removeReplica(r *replica) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.replicas, r)
+	f.active.Store(f.aof != nil || len(f.replicas) > 0)
+}
+
+// replicaOffsets returns the offset of what has been fed to each replica.
+func (f *feed) replicaOffsets() map[*replica]int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	offs := make(map[*replica]int64, len(f.replicas))
+	for r := range f.replicas {
+		offs[r] = r.offset()
+	}
+	return offs
+}
+
+// getAck asks every replica to acknowledge what it has been fed.
+func (f *feed) getAck() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for r := range f.replicas {
+		r.send(replGetAck)
+	}
+}
+
+// nextAck returns a channel closed once a replica next acknowledges.
+func (f *feed) nextAck() <-chan struct{} {
+	f.ackMu.Lock()
+	defer f.ackMu.Unlock()
+	return f.acks
+}
+
+// acked wakes those waiting in nextAck.
+func (f *feed) acked() {
+	f.ackMu.Lock()
+	defer f.ackMu.Unlock()
+	close(f.acks)
+	f.acks = make(chan struct{})
+}
+
+// replicaCount returns the number of replicas fed.
+func (f *feed) replicaCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.replicas)
+}
@@ -0,0 +1,84 @@
+package main
+
+// matchPattern reports whether str matches the glob-style pattern, following
+// the rules of Redis's stringmatch: '*' matches any run of bytes, '?' any
+// single byte, "[...]" a byte class (with '^' negation and 'a-z' ranges), and
+// '\' escapes the next byte.
+func matchPattern(pattern, str string) bool {
+	p, s := pattern, str
+	for len(p) > 0 && len(s) > 0 {
+		switch p[0] {
+		case '*':
+			for len(p) > 1 && p[1] == '*' {
+				p = p[1:]
+			}
+			if len(p) == 1 {
+				return true
+			}
+			for len(s) > 0 {
+				if matchPattern(p[1:], s) {
+					return true
+				}
+				s = s[1:]
+			}
+			return false
+		case '?':
+			s = s[1:]
+		case '[':
+			p = p[1:]
+			not := len(p) > 0 && p[0] == '^'
+			if not {
+				p = p[1:]
+			}
+			match := false
+			for len(p) > 0 { // an unterminated class consumes the rest
+				if p[0] == '\\' && len(p) >= 2 {
+					p = p[1:]
+					if p[0] == s[0] {
+						match = true
+					}
+				} else if p[0] == ']' {
+					break
+				} else if len(p) >= 3 && p[1] == '-' {
+					start, end := p[0], p[2]
+					if start > end {
+						start, end = end, start
+					}
+					if s[0] >= start && s[0] <= end {
+						match = true
+					}
+					p = p[2:]
+				} else if p[0] == s[0] {
+					match = true
+				}
+				p = p[1:]
+			}
+			if not {
+				match = !match
+			}
+			if !match {
+				return false
+			}
+			s = s[1:]
+		case '\\':
+			if len(p) >= 2 {
+				p = p[1:]
+			}
+			fallthrough
+		default:
+			if p[0] != s[0] {
+				return false
+			}
+			s = s[1:]
+		}
+		if len(p) > 0 {
+			p = p[1:]
+		}
+	}
+	if len(s) == 0 {
+		for len(p) > 0 && p[0] == '*' { // stars left over match nothing
+			p = p[1:]
+		}
+	}
+	return len(p) == 0 && len(s) == 0
+}
@@ -0,0 +1,68 @@
+package main
+
+import "testing"
+
+func TestMatchPattern(t *testing.T) {
+	tests := []struct {
+		pattern, str string
+		want         bool
+	}{
+		{"", "", true},
+		{"", "a", false},
+		{"hello", "hello", true},
+		{"hello", "hell", false},
+
+		{"h?llo", "hello", true},
+		{"h?llo", "hllo", false},
+		{"?", "", false},
+		{"*", "", true},
+		{"*", "anything", true},
+		{"**x", "x", true},
+		{"h*llo", "hllo", true},
+		{"h*llo", "heeeello", true},
+		{"h*llo", "hellö", false},
+		{"*a*b", "xaxxb", true},
+		{"*a*b", "ab", true},
+		{"*a*b", "ba", false},
+		{"a*b*c", "abxbbc", true},
+		{"a*b*c", "ac", false},
+		{"*?", "a", true},
+		{"*?", "", false},
+		{"*ab", "aab", true}, // the first "a" must be given back to the '*'
+
+		{"h[ae]llo", "hello", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"h[^e]llo", "hallo", true},
+		{"h[^e]llo", "hello", false},
+		{"h[a-c]llo", "hbllo", true},
+		{"h[a-c]llo", "hdllo", false},
+		{"h[c-a]llo", "hbllo", true}, // a reversed range is read forwards
+		{"[a-c-e]", "d", false},
+		{"[a-c-e]", "-", true},
+		{"[^a-c]", "d", true},
+		{"[^a-c]", "b", false},
+
+		{`h\*llo`, "h*llo", true},
+		{`h\*llo`, "hello", false},
+		{`\?`, "?", true},
+		{`\?`, "a", false},
+		{`\[a]`, "[a]", true},
+		{`[\]]`, "]", true},
+		{`[a\-z]`, "-", true},
+		{`[a\-z]`, "b", false},
+		{`[\^]`, "^", true},
+		{`a\`, `a\`, true}, // a trailing backslash is literal
+
+		{"[ab", "a", true}, // an unterminated class ends with the pattern
+		{"[ab", "c", false},
+		{"[", "[", false},
+		{"x[", "x", false},
+		{"[^", "a", true},
+	}
+	for _, tt := range tests {
+		if got := matchPattern(tt.pattern, tt.str); got != tt.want {
+			t.Errorf("matchPattern(%q, %q) = %v, want %v", tt.pattern, tt.str, got, tt.want)
+		}
+	}
+}
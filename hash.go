@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+
+	"reditlite/resp"
+)
+
+// hset sets the field/value pairs in fv on the hash at key, creating it if
+// needed, and returns how many fields are new.
+func (s *Store) hset(key string, fv []resp.Value) (int, error) {
+	defer s.lock(key)()
+
+	e, ok, err := s.lookupKind(key, KindHash)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		e = Entry{kind: KindHash, hash: make(map[string][]byte), members: new(scanIndex)}
+	}
+	added := 0
+	for i := 0; i+1 < len(fv); i += 2 {
+		f := string(fv[i].B)
+		if old, exists := e.hash[f]; exists {
+			e.elemSize -= int64(len(old))
+		} else {
+			e.members.add(f)
+			e.elemSize += int64(len(f))
+			added++
+		}
+		e.hash[f] = fv[i+1].B
+		e.elemSize += int64(len(fv[i+1].B))
+	}
+	s.put(key, e)
+	return added, nil
+}
+
+// hget returns the value of field in the hash at key.
+func (s *Store) hget(key, field string) ([]byte, bool, error) {
+	defer s.rlock(key)()
+
+	e, _, err := s.lookupRead(key, KindHash)
+	v, ok := e.hash[field]
+	return v, ok, err
+}
+
+func handleHSet(w *bufio.Writer, st *Store, args []resp.Value) {
+	// HSET key field value [field value ...]
+	if len(args)%2 != 0 {
+		_ = resp.WriteError(w, "ERR wrong number of arguments for 'hset'")
+		return
+	}
+	n, err := st.hset(string(args[1].B), args[2:])
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	_ = resp.WriteInteger(w, int64(n))
+}
+
+func handleHGet(w *bufio.Writer, st *Store, args []resp.Value) {
+	// HGET key field
+	v, ok, err := st.hget(string(args[1].B), string(args[2].B))
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	if !ok {
+		_ = resp.WriteBulk(w, nil)
+		return
+	} // null bulk
+	_ = resp.WriteBulk(w, v)
+}
+
+// hgetall returns the fields and values of the hash at key as a flat
+// field, value, field, value... list. Go map iteration is unordered, so the
+// pairs come back in no particular order, which Redis doesn't promise either.
+func (s *Store) hgetall(key string) ([][]byte, error) {
+	defer s.rlock(key)()
+
+	e, _, err := s.lookupRead(key, KindHash)
+	out := make([][]byte, 0, 2*len(e.hash))
+	for f, v := range e.hash {
+		out = append(out, []byte(f), v)
+	}
+	return out, err
+}
+
+// hmget returns the value of each field in the hash at key, nil for missing
+// ones.
+func (s *Store) hmget(key string, fields []resp.Value) ([][]byte, error) {
+	defer s.rlock(key)()
+
+	e, _, err := s.lookupRead(key, KindHash)
+	if err != nil {
+		return nil, err
+	}
+	out := make([][]byte, len(fields))
+	for i, f := range fields {
+		out[i] = e.hash[string(f.B)]
+	}
+	return out, nil
+}
+
+func handleHGetAll(c *client, args []resp.Value) {
+	// HGETALL key
+	fv, err := c.db.hgetall(string(args[1].B))
+	if err != nil {
+		_ = resp.WriteError(c.w, err.Error())
+		return
+	}
+	// a map in RESP3, the flat field, value... array in RESP2
+	c.writeMapHeader(len(fv) / 2)
+	for _, b := range fv {
+		_ = resp.WriteBulk(c.w, b)
+	}
+}
+
+func handleHMGet(w *bufio.Writer, st *Store, args []resp.Value) {
+	// HMGET key field [field ...]
+	vals, err := st.hmget(string(args[1].B), args[2:])
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	_ = resp.WriteArray(w, bulks(vals))
+}
+
+// hdel removes fields from the hash at key and returns how many existed. A
+// hash left empty is deleted.
+func (s *Store) hdel(key string, fields []resp.Value) (int, error) {
+	defer s.lock(key)()
+
+	e, ok, err := s.lookupKind(key, KindHash)
+	if !ok {
+		return 0, err
+	}
+	n := 0
+	for _, f := range fields {
+		if v, exists := e.hash[string(f.B)]; exists {
+			delete(e.hash, string(f.B))
+			e.members.remove(string(f.B))
+			e.elemSize -= int64(len(f.B) + len(v))
+			n++
+		}
+	}
+	if len(e.hash) == 0 {
+		s.remove(key)
+	} else if n > 0 {
+		s.put(key, e)
+	}
+	return n, nil
+}
+
+func handleHDel(w *bufio.Writer, st *Store, args []resp.Value) {
+	// HDEL key field [field ...]
+	n, err := st.hdel(string(args[1].B), args[2:])
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	_ = resp.WriteInteger(w, int64(n))
+}
+
+func handleHExists(w *bufio.Writer, st *Store, args []resp.Value) {
+	// HEXISTS key field
+	_, ok, err := st.hget(string(args[1].B), string(args[2].B))
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	if ok {
+		_ = resp.WriteInteger(w, 1)
+		return
+	}
+	_ = resp.WriteInteger(w, 0)
+}
+
+// hlen returns the number of fields in the hash at key.
+func (s *Store) hlen(key string) (int, error) {
+	defer s.rlock(key)()
+
+	e, _, err := s.lookupRead(key, KindHash)
+	return len(e.hash), err
+}
+
+func handleHKeys(w *bufio.Writer, st *Store, args []resp.Value) {
+	// HKEYS key / HVALS key
+	fv, err := st.hgetall(string(args[1].B))
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	// fields sit at even offsets of the snapshot, values at odd ones
+	off := 0
+	if strings.EqualFold(string(args[0].B), "HVALS") {
+		off = 1
+	}
+	out := make([][]byte, 0, len(fv)/2)
+	for i := off; i < len(fv); i += 2 {
+		out = append(out, fv[i])
+	}
+	_ = resp.WriteArray(w, bulks(out))
+}
+
+func handleHLen(w *bufio.Writer, st *Store, args []resp.Value) {
+	// HLEN key
+	n, err := st.hlen(string(args[1].B))
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	_ = resp.WriteInteger(w, int64(n))
+}
+
+// hincrBy adds delta to the integer in field of the hash at key, treating a
+// missing field as 0, and returns the result.
+func (s *Store) hincrBy(key, field string, delta int64) (int64, error) {
+	defer s.lock(key)()
+
+	e, ok, err := s.lookupKind(key, KindHash)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		e = Entry{kind: KindHash, hash: make(map[string][]byte), members: new(scanIndex)}
+	}
+	var n int64
+	v, exists := e.hash[field]
+	if exists {
+		if n, err = strconv.ParseInt(string(v), 10, 64); err != nil {
+			return 0, errors.New("ERR hash value is not an integer")
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, errors.New("ERR increment or decrement would overflow")
+	}
+	n += delta
+	if !exists {
+		e.members.add(field)
+		e.elemSize += int64(len(field))
+	}
+	nv := strconv.AppendInt(nil, n, 10)
+	e.elemSize += int64(len(nv) - len(v))
+	e.hash[field] = nv
+	s.put(key, e)
+	return n, nil
+}
+
+func handleHIncrBy(w *bufio.Writer, st *Store, args []resp.Value) {
+	// HINCRBY key field increment
+	delta, err := strconv.ParseInt(string(args[3].B), 10, 64)
+	if err != nil {
+		_ = resp.WriteError(w, errNotInteger.Error())
+		return
+	}
+	n, err := st.hincrBy(string(args[1].B), string(args[2].B), delta)
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	_ = resp.WriteInteger(w, n)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"reditlite/resp"
+)
+
+// infoSections are the sections of INFO, in the order they are written.
+var infoSections = []string{"server", "clients", "memory", "persistence", "stats", "replication", "keyspace"}
+
+// keyspaceInfo returns the number of live keys, how many of them have a TTL,
+// and their average remaining TTL in milliseconds, going over one shard at
+// a time.
+func (s *Store) keyspaceInfo() (keys, expires int, avgTTL int64) {
+	now := time.Now().UnixMilli()
+	var ttls int64
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for _, e := range sh.data {
+			if e.exp > 0 && now > e.exp {
+				continue
+			}
+			keys++
+			if e.exp > 0 {
+				expires++
+				ttls += e.exp - now
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	if expires > 0 {
+		avgTTL = ttls / int64(expires)
+	}
+	return keys, expires, avgTTL
+}
+
+// writeInfoSection appends the lines of section to b, in the Redis INFO
+// layout: a "# Name" header followed by key:value lines.
+func (srv *server) writeInfoSection(b *strings.Builder, section string) {
+	fmt.Fprintf(b, "# %s\r\n", strings.ToUpper(section[:1])+section[1:])
+	switch section {
+	case "server":
+		uptime := time.Since(srv.started)
+		fmt.Fprintf(b, "redis_version:%s\r\n", serverVersion)
+		b.WriteString("redis_mode:standalone\r\n")
+		fmt.Fprintf(b, "os:%s %s\r\n", runtime.GOOS, runtime.GOARCH)
+		fmt.Fprintf(b, "go_version:%s\r\n", runtime.Version())
+		fmt.Fprintf(b, "process_id:%d\r\n", os.Getpid())
+		fmt.Fprintf(b, "uptime_in_seconds:%d\r\n", int64(uptime.Seconds()))
+		fmt.Fprintf(b, "uptime_in_days:%d\r\n", int64(uptime.Hours()/24))
+	case "clients":
+		srv.clientsMu.Lock()
+		connected := len(srv.clients)
+		srv.clientsMu.Unlock()
+		fmt.Fprintf(b, "connected_clients:%d\r\n", connected)
+		fmt.Fprintf(b, "maxclients:%d\r\n", srv.config.maxClients())
+	case "memory":
+		var ms runtime.MemStats
+		runtime.ReadMemStats(&ms)
+		maxmemory, policy := srv.config.memoryLimit()
+		fmt.Fprintf(b, "used_memory:%d\r\n", ms.HeapAlloc)
+		fmt.Fprintf(b, "used_memory_human:%s\r\n", humanBytes(int64(ms.HeapAlloc)))
+		// what maxmemory is checked against
+		fmt.Fprintf(b, "used_memory_dataset:%d\r\n", srv.usedMemory.Load())
+		fmt.Fprintf(b, "maxmemory:%d\r\n", maxmemory)
+		fmt.Fprintf(b, "maxmemory_human:%s\r\n", humanBytes(maxmemory))
+		fmt.Fprintf(b, "maxmemory_policy:%s\r\n", policy)
+	case "persistence":
+		saving, status, aofOn := 0, "ok", 0
+		if srv.saving.Load() {
+			saving = 1
+		}
+		if srv.feed.aof != nil {
+			aofOn = 1
+		}
+		if srv.lastSaveFailed.Load() {
+			status = "err"
+		}
+		fmt.Fprintf(b, "rdb_bgsave_in_progress:%d\r\n", saving)
+		fmt.Fprintf(b, "rdb_last_save_time:%d\r\n", srv.lastSave.Load())
+		fmt.Fprintf(b, "rdb_last_bgsave_status:%s\r\n", status)
+		fmt.Fprintf(b, "aof_enabled:%d\r\n", aofOn)
+	case "stats":
+		fmt.Fprintf(b, "total_connections_received:%d\r\n", srv.stats.totalConnections.Load())
+		fmt.Fprintf(b, "total_commands_processed:%d\r\n", srv.stats.commands.Load())
+		fmt.Fprintf(b, "rejected_connections:%d\r\n", srv.stats.rejected.Load())
+		fmt.Fprintf(b, "expired_keys:%d\r\n", srv.stats.expiredKeys.Load())
+		fmt.Fprintf(b, "evicted_keys:%d\r\n", srv.stats.evictedKeys.Load())
+		fmt.Fprintf(b, "keyspace_hits:%d\r\n", srv.stats.hits.Load())
+		fmt.Fprintf(b, "keyspace_misses:%d\r\n", srv.stats.misses.Load())
+	case "replication":
+		if l := srv.master.Load(); l != nil {
+			status := "down"
+			if l.up.Load() {
+				status = "up"
+			}
+			b.WriteString("role:slave\r\n")
+			fmt.Fprintf(b, "master_host:%s\r\n", l.host)
+			fmt.Fprintf(b, "master_port:%s\r\n", l.port)
+			fmt.Fprintf(b, "master_link_status:%s\r\n", status)
+		} else {
+			b.WriteString("role:master\r\n")
+		}
+		fmt.Fprintf(b, "connected_slaves:%d\r\n", srv.feed.replicaCount())
+		fmt.Fprintf(b, "master_replid:%s\r\n", srv.replid)
+	case "keyspace":
+		// as in Redis, empty databases are left out
+		for _, db := range srv.dbs {
+			if keys, expires, avgTTL := db.keyspaceInfo(); keys > 0 {
+				fmt.Fprintf(b, "db%d:keys=%d,expires=%d,avg_ttl=%d\r\n", db.index, keys, expires, avgTTL)
+			}
+		}
+	}
+}
+
+// humanBytes formats n bytes the way INFO's *_human fields do, e.g. "1.50M".
+func humanBytes(n int64) string {
+	const units = "BKMGTPE"
+	f, i := float64(n), 0
+	for f >= 1024 && i < len(units)-1 {
+		f /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%dB", n)
+	}
+	return fmt.Sprintf("%.2f%c", f, units[i])
+}
+
+func handleInfo(c *client, args []resp.Value) {
+	// INFO [section ...]
+	sections := infoSections
+	if len(args) > 1 {
+		sections = nil
+		for _, a := range args[1:] {
+			switch s := strings.ToLower(string(a.B)); s {
+			case "all", "default", "everything":
+				sections = infoSections
+			default:
+				if slices.Contains(infoSections, s) && !slices.Contains(sections, s) {
+					sections = append(sections, s)
+				}
+			}
+		}
+	}
+	var b strings.Builder
+	for i, s := range sections {
+		if i > 0 {
+			b.WriteString("\r\n")
+		}
+		c.srv.writeInfoSection(&b, s)
+	}
+	_ = resp.WriteBulk(c.w, []byte(b.String()))
+}
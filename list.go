@@ -0,0 +1,621 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"math"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"reditlite/resp"
+)
+
+// push adds elems to the head (left) or tail of the list at key, creating it
+// if needed, and returns the new length. Like LPUSH, pushing a, b, c to the
+// head leaves c first.
+func (s *Store) push(key string, elems []resp.Value, left bool) (int, error) {
+	defer s.lock(key)()
+
+	e, ok, err := s.lookupKind(key, KindList)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		e = Entry{kind: KindList}
+	}
+	if left {
+		l := make([][]byte, len(elems), len(elems)+len(e.list))
+		for i, el := range elems {
+			l[len(elems)-1-i] = el.B
+		}
+		e.list = append(l, e.list...)
+	} else {
+		for _, el := range elems {
+			e.list = append(e.list, el.B)
+		}
+	}
+	for _, el := range elems {
+		e.elemSize += int64(len(el.B))
+	}
+	s.put(key, e)
+	s.signalReady(key)
+	return len(e.list), nil
+}
+
+func handlePush(w *bufio.Writer, st *Store, args []resp.Value, left bool) {
+	// LPUSH key element [element ...] / RPUSH key element [element ...]
+	n, err := st.push(string(args[1].B), args[2:], left)
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	_ = resp.WriteInteger(w, int64(n))
+}
+
+// listRange returns a copy of the elements of the list at key between the
+// inclusive indices start and stop.
+func (s *Store) listRange(key string, start, stop int64) ([][]byte, error) {
+	defer s.rlock(key)()
+
+	e, _, err := s.lookupRead(key, KindList)
+	if err != nil {
+		return nil, err
+	}
+	lo, hi := normalizeRange(start, stop, len(e.list))
+	return append([][]byte(nil), e.list[lo:hi]...), nil
+}
+
+func handleLRange(w *bufio.Writer, st *Store, args []resp.Value) {
+	// LRANGE key start stop
+	start, err1 := strconv.ParseInt(string(args[2].B), 10, 64)
+	stop, err2 := strconv.ParseInt(string(args[3].B), 10, 64)
+	if err1 != nil || err2 != nil {
+		_ = resp.WriteError(w, errNotInteger.Error())
+		return
+	}
+	elems, err := st.listRange(string(args[1].B), start, stop)
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	_ = resp.WriteArray(w, bulks(elems))
+}
+
+// bulks wraps each element in a bulk string Value.
+func bulks(elems [][]byte) []resp.Value {
+	arr := make([]resp.Value, len(elems))
+	for i, el := range elems {
+		arr[i] = resp.Value{T: resp.BulkString, B: el}
+	}
+	return arr
+}
+
+// pop removes up to count elements from the head (left) or tail of the list
+// at key and returns them in pop order. A list left empty is deleted.
+func (s *Store) pop(key string, count int, left bool) ([][]byte, bool, error) {
+	defer s.lock(key)()
+
+	e, ok, err := s.lookupKind(key, KindList)
+	if !ok {
+		return nil, false, err
+	}
+	count = min(count, len(e.list))
+	out := make([][]byte, count)
+	for i := range out {
+		if left {
+			out[i] = e.list[i]
+		} else {
+			out[i] = e.list[len(e.list)-1-i]
+		}
+	}
+	if left {
+		e.list = e.list[count:]
+	} else {
+		e.list = e.list[:len(e.list)-count]
+	}
+	e.elemSize -= bytesSize(out)
+	if len(e.list) == 0 {
+		s.remove(key)
+	} else {
+		s.put(key, e)
+	}
+	return out, true, nil
+}
+
+func handlePop(w *bufio.Writer, st *Store, args []resp.Value, left bool) {
+	// LPOP key [count] / RPOP key [count]
+	count := 1
+	if len(args) == 3 {
+		var err error
+		if count, err = strconv.Atoi(string(args[2].B)); err != nil || count < 0 {
+			_ = resp.WriteError(w, "ERR value is out of range, must be positive")
+			return
+		}
+	}
+	elems, ok, err := st.pop(string(args[1].B), count, left)
+	switch {
+	case err != nil:
+		_ = resp.WriteError(w, err.Error())
+	case len(args) == 3 && !ok:
+		_ = resp.WriteNullArray(w)
+	case len(args) == 3:
+		_ = resp.WriteArray(w, bulks(elems))
+	case !ok:
+		_ = resp.WriteBulk(w, nil)
+	default:
+		_ = resp.WriteBulk(w, elems[0])
+	}
+}
+
+// listLen returns the length of the list at key, 0 if it does not exist.
+func (s *Store) listLen(key string) (int, error) {
+	defer s.rlock(key)()
+
+	e, _, err := s.lookupRead(key, KindList)
+	return len(e.list), err
+}
+
+func handleLLen(w *bufio.Writer, st *Store, args []resp.Value) {
+	// LLEN key
+	n, err := st.listLen(string(args[1].B))
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	_ = resp.WriteInteger(w, int64(n))
+}
+
+func handleLIndex(w *bufio.Writer, st *Store, args []resp.Value) {
+	// LINDEX key index
+	idx, err := strconv.ParseInt(string(args[2].B), 10, 64)
+	if err != nil {
+		_ = resp.WriteError(w, errNotInteger.Error())
+		return
+	}
+	elems, err := st.listRange(string(args[1].B), idx, idx)
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	if len(elems) == 0 {
+		_ = resp.WriteBulk(w, nil)
+		return
+	} // out of range
+	_ = resp.WriteBulk(w, elems[0])
+}
+
+// listInsert inserts elem before or after the first occurrence of pivot in
+// the list at key. It returns the new length, -1 if pivot was not found and
+// 0 if the key does not exist.
+func (s *Store) listInsert(key string, before bool, pivot, elem []byte) (int, error) {
+	defer s.lock(key)()
+
+	e, ok, err := s.lookupKind(key, KindList)
+	if !ok {
+		return 0, err
+	}
+	i := slices.IndexFunc(e.list, func(el []byte) bool { return bytes.Equal(el, pivot) })
+	if i < 0 {
+		return -1, nil
+	}
+	if !before {
+		i++
+	}
+	e.list = slices.Insert(e.list, i, elem)
+	e.elemSize += int64(len(elem))
+	s.put(key, e)
+	return len(e.list), nil
+}
+
+// listSet replaces the element at index in the list at key.
+func (s *Store) listSet(key string, index int64, elem []byte) error {
+	defer s.lock(key)()
+
+	e, ok, err := s.lookupKind(key, KindList)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errNoSuchKey
+	}
+	lo, hi := normalizeRange(index, index, len(e.list))
+	if lo == hi {
+		return errors.New("ERR index out of range")
+	}
+	e.elemSize += int64(len(elem) - len(e.list[lo]))
+	e.list[lo] = elem
+	s.put(key, e)
+	return nil
+}
+
+// listRem removes elements equal to elem from the list at key: the first
+// count from the head if count > 0, the last -count from the tail if
+// count < 0, and all of them if count == 0. It returns how many it removed.
+func (s *Store) listRem(key string, count int64, elem []byte) (int, error) {
+	defer s.lock(key)()
+
+	e, ok, err := s.lookupKind(key, KindList)
+	if !ok {
+		return 0, err
+	}
+	limit := count
+	if limit < 0 {
+		limit = -limit
+		slices.Reverse(e.list)
+	}
+	kept := e.list[:0]
+	removed := int64(0)
+	for _, el := range e.list {
+		if (limit == 0 || removed < limit) && bytes.Equal(el, elem) {
+			removed++
+			e.elemSize -= int64(len(el))
+			continue
+		}
+		kept = append(kept, el)
+	}
+	clear(e.list[len(kept):])
+	e.list = kept
+	if count < 0 {
+		slices.Reverse(e.list)
+	}
+	if len(e.list) == 0 {
+		s.remove(key)
+	} else {
+		s.put(key, e)
+	}
+	return int(removed), nil
+}
+
+func handleLInsert(w *bufio.Writer, st *Store, args []resp.Value) {
+	// LINSERT key BEFORE|AFTER pivot element
+	var before bool
+	switch strings.ToUpper(string(args[2].B)) {
+	case "BEFORE":
+		before = true
+	case "AFTER":
+	default:
+		_ = resp.WriteError(w, "ERR syntax error")
+		return
+	}
+	n, err := st.listInsert(string(args[1].B), before, args[3].B, args[4].B)
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	_ = resp.WriteInteger(w, int64(n))
+}
+
+func handleLSet(w *bufio.Writer, st *Store, args []resp.Value) {
+	// LSET key index element
+	idx, err := strconv.ParseInt(string(args[2].B), 10, 64)
+	if err != nil {
+		_ = resp.WriteError(w, errNotInteger.Error())
+		return
+	}
+	if err := st.listSet(string(args[1].B), idx, args[3].B); err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	_ = resp.WriteSimpleString(w, "OK")
+}
+
+func handleLRem(w *bufio.Writer, st *Store, args []resp.Value) {
+	// LREM key count element
+	count, err := strconv.ParseInt(string(args[2].B), 10, 64)
+	if err != nil {
+		_ = resp.WriteError(w, errNotInteger.Error())
+		return
+	}
+	n, err := st.listRem(string(args[1].B), count, args[3].B)
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	_ = resp.WriteInteger(w, int64(n))
+}
+
+// listTrim keeps only the elements between the inclusive indices start and
+// stop of the list at key, deleting the key if nothing is left.
+func (s *Store) listTrim(key string, start, stop int64) error {
+	defer s.lock(key)()
+
+	e, ok, err := s.lookupKind(key, KindList)
+	if !ok {
+		return err
+	}
+	lo, hi := normalizeRange(start, stop, len(e.list))
+	if lo == hi {
+		s.remove(key)
+		return nil
+	}
+	e.list = slices.Clone(e.list[lo:hi]) // release the trimmed elements
+	e.elemSize = bytesSize(e.list)
+	s.put(key, e)
+	return nil
+}
+
+func handleLTrim(w *bufio.Writer, st *Store, args []resp.Value) {
+	// LTRIM key start stop
+	start, err1 := strconv.ParseInt(string(args[2].B), 10, 64)
+	stop, err2 := strconv.ParseInt(string(args[3].B), 10, 64)
+	if err1 != nil || err2 != nil {
+		_ = resp.WriteError(w, errNotInteger.Error())
+		return
+	}
+	if err := st.listTrim(string(args[1].B), start, stop); err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	_ = resp.WriteSimpleString(w, "OK")
+}
+
+// move pops an element from one end of the list at src and pushes it onto
+// one end of the list at dst, atomically. src and dst may be the same list,
+// which rotates it.
+func (s *Store) move(src, dst string, fromLeft, toLeft bool) ([]byte, bool, error) {
+	defer s.lock(src, dst)()
+
+	se, ok, err := s.lookupKind(src, KindList)
+	if !ok {
+		return nil, false, err
+	}
+	if _, _, err := s.lookupKind(dst, KindList); err != nil {
+		return nil, false, err
+	}
+
+	var elem []byte
+	if fromLeft {
+		elem, se.list = se.list[0], se.list[1:]
+	} else {
+		elem, se.list = se.list[len(se.list)-1], se.list[:len(se.list)-1]
+	}
+	se.elemSize -= int64(len(elem))
+	if len(se.list) == 0 {
+		s.remove(src)
+	} else {
+		s.put(src, se)
+	}
+
+	de, ok, _ := s.lookupKind(dst, KindList) // re-read: dst may be src
+	if !ok {
+		de = Entry{kind: KindList}
+	}
+	if toLeft {
+		de.list = append([][]byte{elem}, de.list...)
+	} else {
+		de.list = append(de.list, elem)
+	}
+	de.elemSize += int64(len(elem))
+	s.put(dst, de)
+	s.signalReady(dst)
+	return elem, true, nil
+}
+
+func handleRPopLPush(w *bufio.Writer, st *Store, args []resp.Value) {
+	// RPOPLPUSH src dst
+	writeMoved(w, st, string(args[1].B), string(args[2].B), false, true)
+}
+
+func handleLMove(w *bufio.Writer, st *Store, args []resp.Value) {
+	// LMOVE src dst LEFT|RIGHT LEFT|RIGHT
+	fromLeft, ok1 := parseSide(args[3].B)
+	toLeft, ok2 := parseSide(args[4].B)
+	if !ok1 || !ok2 {
+		_ = resp.WriteError(w, "ERR syntax error")
+		return
+	}
+	writeMoved(w, st, string(args[1].B), string(args[2].B), fromLeft, toLeft)
+}
+
+func writeMoved(w *bufio.Writer, st *Store, src, dst string, fromLeft, toLeft bool) {
+	elem, ok, err := st.move(src, dst, fromLeft, toLeft)
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	if !ok {
+		_ = resp.WriteBulk(w, nil)
+		return
+	} // src empty
+	_ = resp.WriteBulk(w, elem)
+}
+
+// parseSide parses a LEFT|RIGHT argument, reporting true for LEFT.
+func parseSide(b []byte) (left, ok bool) {
+	switch strings.ToUpper(string(b)) {
+	case "LEFT":
+		return true, true
+	case "RIGHT":
+		return false, true
+	}
+	return false, false
+}
+
+// signalReady wakes the clients blocked on key, if any, after an element was
+// pushed to it. The caller must hold the lock of key's shard.
+func (s *Store) signalReady(key string) {
+	sh := s.shardOf(key)
+	for _, ch := range sh.waiters[key] {
+		select {
+		case ch <- struct{}{}:
+		default: // already signalled through another key
+		}
+	}
+	delete(sh.waiters, key)
+}
+
+// popFirst pops one element from the first non-empty list among keys. The
+// caller must hold the locks of their shards.
+func (s *Store) popFirst(keys []string, left bool) (string, []byte, bool, error) {
+	for _, k := range keys {
+		e, ok, err := s.lookupKind(k, KindList)
+		if err != nil {
+			return "", nil, false, err
+		}
+		if !ok {
+			continue
+		}
+		var elem []byte
+		if left {
+			elem, e.list = e.list[0], e.list[1:]
+		} else {
+			elem, e.list = e.list[len(e.list)-1], e.list[:len(e.list)-1]
+		}
+		e.elemSize -= int64(len(elem))
+		if len(e.list) == 0 {
+			s.remove(k)
+		} else {
+			s.put(k, e)
+		}
+		// BLPOP and BRPOP are logged as the pop they made, which doesn't
+		// block when replayed
+		if left {
+			s.srv.feed.logCommand(s.index, "LPOP", k)
+		} else {
+			s.srv.feed.logCommand(s.index, "RPOP", k)
+		}
+		return k, elem, true, nil
+	}
+	return "", nil, false, nil
+}
+
+// blockingPop pops from the first non-empty list among keys, waiting for a
+// push to one of them if they are all empty. A zero timeout waits forever.
+// The wait also ends, with nothing popped, when gone is closed or the server
+// shuts down.
+func (s *Store) blockingPop(keys []string, left bool, timeout time.Duration, gone <-chan struct{}) (string, []byte, bool, error) {
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	wake := make(chan struct{}, 1)
+	for {
+		// a woken client waits for a transaction in progress to finish
+		s.srv.txmu.RLock()
+		unlockLog := s.srv.lockLog(s.srv.shardsOf(keys))
+		unlock := s.lock(keys...)
+		k, elem, ok, err := s.popFirst(keys, left)
+		if ok || err != nil {
+			unlock()
+			unlockLog()
+			s.srv.txmu.RUnlock()
+			s.srv.feed.syncAOF() // the pop is fed, and synced before the reply
+			return k, elem, ok, err
+		}
+		for _, k := range keys {
+			sh := s.shardOf(k)
+			sh.waiters[k] = append(sh.waiters[k], wake)
+		}
+		unlock()
+		unlockLog()
+		s.srv.txmu.RUnlock()
+
+		woken := false
+		select {
+		case <-wake:
+			woken = true
+		case <-expired:
+		case <-gone:
+		case <-s.srv.quit:
+		}
+		unlock = s.lock(keys...)
+		for _, k := range keys {
+			sh := s.shardOf(k)
+			sh.waiters[k] = slices.DeleteFunc(sh.waiters[k], func(ch chan struct{}) bool { return ch == wake })
+			if len(sh.waiters[k]) == 0 {
+				delete(sh.waiters, k)
+			}
+		}
+		unlock()
+		if !woken {
+			return "", nil, false, nil
+		}
+		select {
+		case <-wake: // drain a second signal that raced with unregistering
+		default:
+		}
+		// another client may have popped first, so go round again
+	}
+}
+
+// watchDisconnect watches an idle connection for the client hanging up,
+// closing gone if it does. stop ends the watch; it must be called before r is
+// read from again.
+func watchDisconnect(conn net.Conn, r *bufio.Reader) (gone <-chan struct{}, stop func()) {
+	ch := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Peek leaves any pipelined input buffered for the next command.
+		if _, err := r.Peek(1); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			close(ch)
+		}
+	}()
+	return ch, func() {
+		_ = conn.SetReadDeadline(time.Now()) // unblock the Peek
+		<-done
+		_ = conn.SetReadDeadline(time.Time{})
+	}
+}
+
+func handleBPop(w *bufio.Writer, st *Store, args []resp.Value, left bool, conn net.Conn, r *bufio.Reader) {
+	// BLPOP key [key ...] timeout / BRPOP key [key ...] timeout
+	secs, err := strconv.ParseFloat(string(args[len(args)-1].B), 64)
+	if err != nil || math.IsNaN(secs) || math.IsInf(secs, 0) {
+		_ = resp.WriteError(w, "ERR timeout is not a float or out of range")
+		return
+	}
+	if secs < 0 {
+		_ = resp.WriteError(w, "ERR timeout is negative")
+		return
+	}
+	keys := make([]string, 0, len(args)-2)
+	for _, a := range args[1 : len(args)-1] {
+		keys = append(keys, string(a.B))
+	}
+
+	if conn == nil {
+		// Run by EXEC, which holds srv.txmu already. As in Redis, a blocking
+		// pop inside a transaction never blocks.
+		unlock := st.lock(keys...)
+		k, elem, ok, err := st.popFirst(keys, left)
+		unlock()
+		writePopped(w, k, elem, ok, err)
+		return
+	}
+	st.srv.txmu.RLock()
+	unlockLog := st.srv.lockLog(st.srv.shardsOf(keys))
+	unlock := st.lock(keys...)
+	k, elem, ok, err := st.popFirst(keys, left)
+	unlock()
+	unlockLog()
+	st.srv.txmu.RUnlock()
+	st.srv.feed.syncAOF()
+	if !ok && err == nil {
+		// replies to commands pipelined ahead of this one must not wait
+		_ = w.Flush()
+		gone, stop := watchDisconnect(conn, r)
+		k, elem, ok, err = st.blockingPop(keys, left, time.Duration(secs*float64(time.Second)), gone)
+		stop()
+	}
+	writePopped(w, k, elem, ok, err)
+}
+
+// writePopped replies with the outcome of a blocking pop.
+func writePopped(w *bufio.Writer, k string, elem []byte, ok bool, err error) {
+	switch {
+	case err != nil:
+		_ = resp.WriteError(w, err.Error())
+	case !ok:
+		_ = resp.WriteNullArray(w) // timed out, or the client is gone
+	default:
+		_ = resp.WriteArray(w, bulks([][]byte{[]byte(k), elem}))
+	}
+}
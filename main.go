@@ -2,252 +2,1867 @@ package main
 
 import (
 	"bufio"
+	"crypto/tls"
+	"errors"
+	"flag"
+	"io/fs"
 	"log"
+	"maps"
+	"math"
+	"math/rand/v2"
 	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"reditlite/resp"
 )
 
+// Kind is the data type held by an Entry.
+type Kind uint8
+
+const (
+	KindString Kind = iota
+	KindList
+	KindHash
+	KindSet
+	KindZSet
+)
+
+// String returns the name TYPE reports for k.
+func (k Kind) String() string {
+	switch k {
+	case KindString:
+		return "string"
+	case KindList:
+		return "list"
+	case KindHash:
+		return "hash"
+	case KindSet:
+		return "set"
+	case KindZSet:
+		return "zset"
+	}
+	return "unknown"
+}
+
+// An Entry's string value is never changed in place once stored: readers
+// write it out after releasing the lock, and the feed may still hold the
+// argument it was set from. A command that changes bytes of it stores a
+// changed copy instead. One that only adds bytes past its end, as APPEND
+// does, may extend it in place, as no holder of the slice sees past its
+// length.
 type Entry struct {
-	val []byte
-	exp int64 // unix ms, 0 means no expiry
+	kind Kind
+	val  []byte              // KindString payload
+	list [][]byte            // KindList payload, head first
+	hash map[string][]byte   // KindHash payload
+	set  map[string]struct{} // KindSet payload
+	zset *zset               // KindZSet payload
+	exp  int64               // unix ms, 0 means no expiry
+
+	members *scanIndex // of the hash's fields or the set's members, for HSCAN and SSCAN
+
+	// atime is when the key was last used, in unix ms, for OBJECT IDLETIME
+	// and LRU eviction. It is shared by the copies of the Entry, so reads,
+	// which hold only the read lock and can't put the entry back, can still
+	// bump it.
+	atime *atomic.Int64
+
+	size     int64 // of the key and value, as counted in the memory used when put
+	elemSize int64 // of a collection's elements, kept by the commands changing them, for size
+}
+
+// clone returns a deep copy of e that shares no memory with it.
+func (e Entry) clone() Entry {
+	c := e
+	c.atime = nil // put gives the copy its own
+	if e.val != nil {
+		c.val = append([]byte{}, e.val...)
+	}
+	if e.list != nil {
+		c.list = make([][]byte, len(e.list))
+		for i, el := range e.list {
+			c.list[i] = append([]byte{}, el...)
+		}
+	}
+	if e.hash != nil {
+		c.hash = make(map[string][]byte, len(e.hash))
+		for f, v := range e.hash {
+			c.hash[f] = append([]byte{}, v...)
+		}
+	}
+	if e.set != nil {
+		c.set = maps.Clone(e.set)
+	}
+	if e.members != nil {
+		c.members = e.members.clone()
+	}
+	if e.zset != nil {
+		c.zset = e.zset.clone()
+	}
+	return c
+}
+
+var (
+	errWrongType  = errors.New("WRONGTYPE Operation against a key holding the wrong kind of value")
+	errNoSuchKey  = errors.New("ERR no such key")
+	errNotInteger = errors.New("ERR value is not an integer or out of range")
+	errNotFloat   = errors.New("ERR value is not a valid float")
+	errDBIndex    = errors.New("ERR DB index is out of range")
+	errTooBig     = errors.New("ERR string exceeds maximum allowed size")
+)
+
+// Store is one logical database: a keyspace and what hangs off its keys,
+// split into shards.
+type Store struct {
+	shards []*shard
+
+	srv   *server // the server the database belongs to
+	index int     // the database's number, for SELECT
+}
+
+// newStore returns an empty database of srv with n shards, which must be a
+// power of two.
+func newStore(srv *server, index, n int) *Store {
+	s := &Store{
+		shards: make([]*shard, n),
+		srv:    srv,
+		index:  index,
+	}
+	for i := range s.shards {
+		s.shards[i] = newShard()
+	}
+	return s
+}
+
+// get returns the entry at key. One found expired is deleted on the way out.
+func (s *Store) get(key string) (Entry, bool) {
+	now := time.Now().UnixMilli()
+	unlock := s.rlock(key)
+	e, ok := s.lookupAt(key, now)
+	expired := !ok && s.expiredAt(key, now)
+	unlock()
+	if expired {
+		s.expireLazily(key)
+	}
+	return e, ok
+}
+
+// lookup is get without locking; the caller must hold the lock of key's
+// shard, as must the callers of the other helpers below.
+func (s *Store) lookup(key string) (Entry, bool) {
+	return s.lookupAt(key, time.Now().UnixMilli())
+}
+
+// lookupKind is lookup for commands that only apply to kind k: it fails with
+// errWrongType if key holds a value of another kind.
+func (s *Store) lookupKind(key string, k Kind) (Entry, bool, error) {
+	e, ok := s.lookup(key)
+	if ok && e.kind != k {
+		return Entry{}, false, errWrongType
+	}
+	return e, ok, nil
+}
+
+// lookupRead is lookupKind for commands that read key, counting whether it
+// was found in the keyspace hit and miss stats.
+func (s *Store) lookupRead(key string, k Kind) (Entry, bool, error) {
+	e, ok, err := s.lookupKind(key, k)
+	s.srv.stats.lookedUp(ok)
+	if ok {
+		e.atime.Store(time.Now().UnixMilli())
+	}
+	return e, ok, err
+}
+
+// put stores e at key, stamping its access time. Every change to the
+// keyspace goes through put or remove, so that WATCH sees it, the memory
+// used stays counted and the append-only file logs it.
+func (s *Store) put(key string, e Entry) {
+	sh := s.shardOf(key)
+	now := time.Now().UnixMilli()
+	old, ok := sh.data[key]
+	if ok && old.exp > 0 && now > old.exp && old.atime != e.atime {
+		// The key had expired, unswept, and e doesn't build on what it
+		// held. Applying the feed doesn't expire keys, so it says it went.
+		s.srv.feed.logCommand(s.index, "DEL", key)
+	}
+	if e.atime == nil {
+		e.atime = new(atomic.Int64)
+	}
+	e.atime.Store(now)
+	e.size = entrySize(key, e)
+	s.srv.accountMemory(sh, e.size-old.size)
+	sh.data[key] = e
+	if !ok {
+		sh.keys.add(key)
+	}
+	if e.exp > 0 {
+		sh.expires[key] = struct{}{}
+	} else {
+		delete(sh.expires, key)
+	}
+	s.touchKey(key)
+	sh.changes.Add(1)
+	s.srv.dirty.Add(1)
+}
+
+// remove deletes key.
+func (s *Store) remove(key string) {
+	sh := s.shardOf(key)
+	s.srv.accountMemory(sh, -sh.data[key].size)
+	delete(sh.data, key)
+	delete(sh.expires, key)
+	sh.keys.remove(key)
+	s.touchKey(key)
+	sh.changes.Add(1)
+	s.srv.dirty.Add(1)
+}
+
+// getString returns the string value at key. Like get, it deletes the key
+// if it finds it expired.
+func (s *Store) getString(key string) ([]byte, bool, error) {
+	unlock := s.rlock(key)
+	e, ok, err := s.lookupRead(key, KindString)
+	expired := !ok && s.expiredAt(key, time.Now().UnixMilli())
+	unlock()
+	if expired {
+		s.expireLazily(key)
+	}
+	return e.val, ok, err
+}
+
+// lookupAt is lookup with expiry evaluated against now (unix ms). Nothing
+// expires while fed commands are applied.
+func (s *Store) lookupAt(key string, now int64) (Entry, bool) {
+	e, ok := s.shardOf(key).data[key]
+	if !ok {
+		return Entry{}, false
+	}
+	if e.exp > 0 && now > e.exp && !s.srv.loading.Load() {
+		return Entry{}, false
+	}
+
+	return e, true
+}
+
+// expiredAt reports whether key holds an entry that has expired by now,
+// which lookupAt would hide.
+func (s *Store) expiredAt(key string, now int64) bool {
+	e, ok := s.shardOf(key).data[key]
+	return ok && e.exp > 0 && now > e.exp
+}
+
+// removeExpired deletes key, which has expired, counting it.
+func (s *Store) removeExpired(key string) {
+	s.remove(key)
+	s.srv.stats.expiredKeys.Add(1)
+	// applying the feed doesn't expire keys, so it says it went
+	s.srv.feed.logCommand(s.index, "DEL", key)
+}
+
+// expireLazily deletes key if it has expired, as Redis does when a command
+// finds a key expired, rather than leave its memory held until the janitor
+// sweeps. It locks key's shard for writing, so a reader calls it after
+// releasing its read lock, and checks again under the write lock, as the key
+// may have been deleted or set anew in between. Like the janitor, a replica
+// leaves expiring to its master, and keys don't expire while fed commands
+// are applied. The caller must hold srv.txmu, for reading at least.
+func (s *Store) expireLazily(key string) {
+	if s.srv.replicating() || s.srv.loading.Load() {
+		return
+	}
+	unlockLog := s.srv.lockLog(s.srv.shardsOf([]string{key}))
+	unlock := s.lock(key)
+	expired := s.expiredAt(key, time.Now().UnixMilli())
+	if expired {
+		s.removeExpired(key)
+	}
+	unlock()
+	unlockLog()
+	if expired {
+		s.notify(notifyExpired, "expired", key)
+	}
+}
+
+// setOptions are the modifiers accepted by SET.
+type setOptions struct {
+	nx, xx  bool  // only set if the key is absent / present
+	get     bool  // the previous value is wanted, so it must be a string
+	exp     int64 // absolute expiry in unix ms, 0 means none
+	keepTTL bool  // retain the existing expiry
+}
+
+// setWith stores val at key subject to opts. It returns the previous value
+// (nil if there was none) and whether it wrote.
+func (s *Store) setWith(key string, val []byte, opts setOptions) ([]byte, bool, error) {
+	defer s.lock(key)()
+
+	old, exists := s.lookup(key)
+	if opts.get && exists && old.kind != KindString {
+		return nil, false, errWrongType
+	}
+	if (opts.nx && exists) || (opts.xx && !exists) {
+		return old.val, false, nil
+	}
+	exp := opts.exp
+	if opts.keepTTL {
+		exp = old.exp
+	}
+	s.put(key, Entry{val: val, exp: exp})
+	return old.val, true, nil
+}
+
+func (s *Store) del(keys ...string) int {
+	unlock := s.lock(keys...)
+	var gone []string
+	for _, k := range keys {
+		if _, ok := s.shardOf(k).data[k]; ok {
+			s.remove(k)
+			gone = append(gone, k)
+		}
+	}
+	unlock()
+
+	for _, k := range gone {
+		s.notify(notifyGeneric, "del", k)
+	}
+	return len(gone)
+}
+
+// unlink removes keys like del, but only the map deletes happen under the
+// lock: the removed entries are handed to the reclaimer to be released.
+func (s *Store) unlink(keys ...string) int {
+	unlock := s.lock(keys...)
+	freed := make([]Entry, 0, len(keys))
+	var gone []string
+	for _, k := range keys {
+		if e, ok := s.shardOf(k).data[k]; ok {
+			s.remove(k)
+			freed = append(freed, e)
+			gone = append(gone, k)
+		}
+	}
+	unlock()
+
+	for _, k := range gone {
+		s.notify(notifyGeneric, "del", k)
+	}
+
+	select {
+	case s.srv.freeq <- freed:
+	default: // reclaimer busy or stopped, leave them to the GC from here
+	}
+	return len(freed)
+}
+
+// incrBy adds delta to the integer stored at key, treating a missing key as 0.
+// The TTL of an existing key is kept.
+func (s *Store) incrBy(key string, delta int64) (int64, error) {
+	defer s.lock(key)()
+
+	var n int64
+	e, ok, err := s.lookupKind(key, KindString)
+	if err != nil {
+		return 0, err
+	}
+	if ok {
+		if n, err = strconv.ParseInt(string(e.val), 10, 64); err != nil {
+			return 0, errNotInteger
+		}
+	} else {
+		e = Entry{}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, errNotInteger
+	}
+	n += delta
+	e.val = strconv.AppendInt(nil, n, 10)
+	s.put(key, e)
+	return n, nil
+}
+
+// incrByFloat adds incr to the float stored at key and returns the stored
+// representation of the result.
+func (s *Store) incrByFloat(key string, incr float64) ([]byte, error) {
+	defer s.lock(key)()
+
+	var f float64
+	e, ok, err := s.lookupKind(key, KindString)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		if f, err = parseFloat(e.val); err != nil {
+			return nil, errNotFloat
+		}
+	} else {
+		e = Entry{}
+	}
+	f += incr
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, errors.New("ERR increment would produce NaN or Infinity")
+	}
+	e.val = []byte(formatFloat(f))
+	s.put(key, e)
+	return e.val, nil
+}
+
+// appendVal appends v to the value at key, creating it if absent, and returns
+// the new length. The TTL of an existing key is kept.
+func (s *Store) appendVal(key string, v []byte) (int, error) {
+	defer s.lock(key)()
+
+	e, ok, err := s.lookupKind(key, KindString)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		e = Entry{val: []byte{}}
+	}
+	if len(e.val)+len(v) > s.srv.config.maxStringSize() {
+		return 0, errTooBig
+	}
+	e.val = append(e.val, v...)
+	s.put(key, e)
+	return len(e.val), nil
+}
+
+// setIfAbsent stores val at key only if the key does not exist and reports
+// whether it wrote.
+func (s *Store) setIfAbsent(key string, val []byte) bool {
+	defer s.lock(key)()
+
+	if _, ok := s.lookup(key); ok {
+		return false
+	}
+	s.put(key, Entry{val: val})
+	return true
+}
+
+// mset stores each key/value pair in kv, clearing any TTL, all at once.
+func (s *Store) mset(kv []resp.Value) {
+	defer s.lock(pairKeys(kv)...)()
+
+	for i := 0; i+1 < len(kv); i += 2 {
+		s.put(string(kv[i].B), Entry{val: kv[i+1].B})
+	}
+}
+
+// msetnx stores every pair in kv only if none of the keys exist, and
+// reports whether it wrote.
+func (s *Store) msetnx(kv []resp.Value) bool {
+	defer s.lock(pairKeys(kv)...)()
+
+	now := time.Now().UnixMilli()
+	for i := 0; i+1 < len(kv); i += 2 {
+		if _, ok := s.lookupAt(string(kv[i].B), now); ok {
+			return false
+		}
+	}
+	for i := 0; i+1 < len(kv); i += 2 {
+		s.put(string(kv[i].B), Entry{val: kv[i+1].B})
+	}
+	return true
+}
+
+// mget returns the value of each key, nil for missing ones.
+func (s *Store) mget(keys []resp.Value) [][]byte {
+	defer s.rlock(argStrings(keys)...)()
+
+	now := time.Now().UnixMilli()
+	vals := make([][]byte, len(keys))
+	for i, k := range keys {
+		e, ok := s.lookupAt(string(k.B), now)
+		s.srv.stats.lookedUp(ok)
+		if ok && e.kind == KindString {
+			e.atime.Store(now)
+			vals[i] = e.val
+		}
+	}
+	return vals
+}
+
+// getSet stores val at key without a TTL and returns the previous value.
+func (s *Store) getSet(key string, val []byte) ([]byte, bool, error) {
+	defer s.lock(key)()
+
+	old, ok, err := s.lookupKind(key, KindString)
+	if err != nil {
+		return nil, false, err
+	}
+	s.put(key, Entry{val: val})
+	return old.val, ok, nil
+}
+
+// setRange overwrites the value at key with v starting at offset, padding
+// with zero bytes as needed, and returns the new length.
+func (s *Store) setRange(key string, offset int, v []byte) (int, error) {
+	defer s.lock(key)()
+
+	e, ok, err := s.lookupKind(key, KindString)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		e = Entry{}
+	}
+	if len(v) == 0 {
+		return len(e.val), nil // nothing to write, and a missing key stays missing
+	}
+	end := offset + len(v)
+	if end > s.srv.config.maxStringSize() {
+		return 0, errTooBig
+	}
+	e.val = writable(e.val, offset, end)
+	copy(e.val[offset:], v)
+	s.put(key, e)
+	return len(e.val), nil
+}
+
+// writable returns val grown to at least end bytes, for the caller to
+// overwrite bytes from off on. If any of those are within val, which must
+// not change, they are in a copy of it; otherwise val is extended in place.
+func writable(val []byte, off, end int) []byte {
+	if off < len(val) {
+		buf := make([]byte, max(end, len(val)))
+		copy(buf, val)
+		return buf
+	}
+	return append(val, make([]byte, end-len(val))...)
+}
+
+// getEx returns the value at key and updates its expiry: exp (unix ms) sets
+// a new one, persist removes it, and neither leaves it untouched.
+func (s *Store) getEx(key string, exp int64, persist bool) ([]byte, bool, error) {
+	defer s.lock(key)()
+
+	now := time.Now().UnixMilli()
+	e, ok := s.lookupAt(key, now)
+	if !ok {
+		return nil, false, nil
+	}
+	if e.kind != KindString {
+		return nil, false, errWrongType
+	}
+	switch {
+	case persist:
+		e.exp = 0
+		s.put(key, e)
+	case exp > 0 && exp <= now && !s.srv.loading.Load():
+		s.remove(key)
+	case exp > 0:
+		e.exp = exp
+		s.put(key, e)
+	}
+	return e.val, true, nil
+}
+
+// getDel removes key and returns the value it held.
+func (s *Store) getDel(key string) ([]byte, bool, error) {
+	defer s.lock(key)()
+
+	e, ok, err := s.lookupKind(key, KindString)
+	if !ok {
+		return nil, false, err
+	}
+	s.remove(key)
+	return e.val, true, nil
+}
+
+// rename moves the value and TTL at src to dst. With nx set it only does so
+// if dst does not exist; the result reports whether the move happened.
+func (s *Store) rename(src, dst string, nx bool) (bool, error) {
+	defer s.lock(src, dst)()
+
+	now := time.Now().UnixMilli()
+	e, ok := s.lookupAt(src, now)
+	if !ok {
+		return false, errNoSuchKey
+	}
+	if nx {
+		if _, exists := s.lookupAt(dst, now); exists {
+			return false, nil
+		}
+	}
+	if src == dst {
+		return true, nil
+	}
+	s.remove(src)
+	s.put(dst, e)
+	return true, nil
+}
+
+// setExpiry sets the absolute expiry of key to exp (unix ms) and reports
+// whether the key exists. An expiry that is not in the future deletes the key
+// right away, as Redis does.
+func (s *Store) setExpiry(key string, exp int64) bool {
+	defer s.lock(key)()
+
+	now := time.Now().UnixMilli()
+	e, ok := s.lookupAt(key, now)
+	if !ok {
+		return false
+	}
+	if exp <= now && !s.srv.loading.Load() {
+		s.remove(key)
+		return true
+	}
+	e.exp = exp
+	s.put(key, e)
+	return true
+}
+
+// pttl returns the remaining time to live of key in milliseconds, -1 if it
+// has no expiry and -2 if it does not exist.
+func (s *Store) pttl(key string) int64 {
+	defer s.rlock(key)()
+
+	now := time.Now().UnixMilli()
+	e, ok := s.lookupAt(key, now)
+	if !ok {
+		return -2
+	}
+	if e.exp == 0 {
+		return -1
+	}
+	return e.exp - now
+}
+
+// copyKey copies the value and TTL at src to dst, overwriting dst only if
+// replace is set, and reports whether it copied.
+func (s *Store) copyKey(src, dst string, replace bool) bool {
+	defer s.lock(src, dst)()
+
+	now := time.Now().UnixMilli()
+	e, ok := s.lookupAt(src, now)
+	if !ok {
+		return false
+	}
+	if _, exists := s.lookupAt(dst, now); exists && !replace {
+		return false
+	}
+	s.put(dst, e.clone())
+	return true
+}
+
+// randomKey returns a random live key. Expired keys are left out of the
+// candidates up front, so the pick never has to retry.
+func (s *Store) randomKey() (string, bool) {
+	keys := s.liveKeys()
+	if len(keys) == 0 {
+		return "", false
+	}
+	return keys[rand.IntN(len(keys))], true
+}
+
+// size returns the number of live keys. Entries that have expired but have
+// not been reaped by the janitor yet are not counted. Like liveKeys, it
+// counts one shard at a time.
+func (s *Store) size() int {
+	now := time.Now().UnixMilli()
+	n := 0
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for _, e := range sh.data {
+			if e.exp == 0 || now <= e.exp {
+				n++
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return n
+}
+
+// touch returns how many of keys exist, bumping their access time. That
+// isn't a write WATCH should see, so it needs only the read locks.
+func (s *Store) touch(keys []resp.Value) int {
+	names := argStrings(keys)
+	defer s.rlock(names...)()
+
+	now := time.Now().UnixMilli()
+	n := 0
+	for _, k := range names {
+		if e, ok := s.lookupAt(k, now); ok {
+			e.atime.Store(now)
+			n++
+		}
+	}
+	return n
+}
+
+// flush drops every key by swapping in fresh maps.
+func (s *Store) flush() {
+	defer s.lockAll()()
+
+	s.srv.dirty.Add(1)
+	for _, sh := range s.shards {
+		sh.data = make(map[string]Entry)
+		sh.expires = make(map[string]struct{})
+		sh.keys = scanIndex{}
+		sh.changes.Add(1)
+		s.srv.accountMemory(sh, -sh.used)
+		for _, wk := range sh.watched {
+			wk.version++
+		}
+	}
+}
+
+// argStrings returns the arguments in args as strings, for keys.
+func argStrings(args []resp.Value) []string {
+	out := make([]string, len(args))
+	for i, a := range args {
+		out[i] = string(a.B)
+	}
+	return out
+}
+
+// pairKeys returns the keys of the key/value pairs in kv.
+func pairKeys(kv []resp.Value) []string {
+	keys := make([]string, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		keys = append(keys, string(kv[i].B))
+	}
+	return keys
+}
+
+func main() {
+	notifyEvents := flag.String("notify-keyspace-events", "", "keyspace notification classes to publish, as in Redis (e.g. KEA); empty disables them")
+	requirepass := flag.String("requirepass", "", "password clients must AUTH with; empty means none")
+	databases := flag.Int("databases", 16, "number of logical databases")
+	shards := flag.Int("shards", 16, "lock stripes per database, a power of two; more lets more commands run in parallel")
+	maxmemory := flag.String("maxmemory", "0", "memory limit, e.g. 100mb; 0 means none")
+	maxmemoryPolicy := flag.String("maxmemory-policy", "noeviction", "what to do when maxmemory is reached")
+	protoMaxBulkLen := flag.String("proto-max-bulk-len", "512mb", "longest bulk string a client may send, and string value commands such as APPEND may make")
+	dir := flag.String("dir", ".", "directory to keep the snapshot in")
+	dbfilename := flag.String("dbfilename", "dump.rdb", "snapshot file name, loaded at startup and written by SAVE and BGSAVE")
+	appendonly := flag.Bool("appendonly", false, "log every write to the append-only file and rebuild the keyspace from it at startup")
+	appendfilename := flag.String("appendfilename", "appendonly.aof", "append-only file name, in dir")
+	appendfsync := flag.String("appendfsync", "everysec", "when to sync the append-only file: always, everysec or no")
+	replicaof := flag.String("replicaof", "", `master to replicate, as "host port"; empty means none`)
+	masterauth := flag.String("masterauth", "", "password to AUTH with to the master")
+	bind := flag.String("bind", "", "addresses to listen on, separated by spaces; empty means every interface")
+	port := flag.Int("port", 6379, "port to accept connections on; 0 means none")
+	unixsocket := flag.String("unixsocket", "", "path of a Unix socket to accept connections on too; empty means none")
+	tlsPort := flag.Int("tls-port", 0, "port to accept TLS connections on, besides the plaintext ones; 0 means none")
+	tlsCertFile := flag.String("tls-cert-file", "", "certificate the TLS port serves, in PEM")
+	tlsKeyFile := flag.String("tls-key-file", "", "private key of the TLS certificate, in PEM")
+	tlsCAFile := flag.String("tls-ca-file", "", "certificate authorities in PEM; if set, TLS clients must present a certificate one of them signed")
+	timeout := flag.Int("timeout", 0, "seconds a client may idle before it is hung up on; 0 means for ever")
+	maxclients := flag.Int("maxclients", 10000, "most clients connected at once; more are turned away")
+	shutdownSigterm := flag.String("shutdown-on-sigterm", "save", "whether shutting down on SIGTERM saves a snapshot: save or nosave")
+	shutdownSigint := flag.String("shutdown-on-sigint", "save", "whether shutting down on SIGINT saves a snapshot: save or nosave")
+	flag.Parse()
+
+	if *databases < 1 {
+		log.Fatal("databases: must be at least 1")
+	}
+	if *shards < 1 || *shards&(*shards-1) != 0 {
+		log.Fatal("shards: must be a power of two")
+	}
+	if *port < 0 || *port > 65535 {
+		log.Fatal("port: must be between 0 and 65535")
+	}
+	if *port == 0 && *tlsPort == 0 && *unixsocket == "" {
+		log.Fatal("port: can only be 0 if there is a tls-port or unixsocket to listen on")
+	}
+	if *tlsPort < 0 || *tlsPort > 65535 {
+		log.Fatal("tls-port: must be between 0 and 65535")
+	}
+	if *tlsPort != 0 && (*tlsCertFile == "" || *tlsKeyFile == "") {
+		log.Fatal("tls-port: needs tls-cert-file and tls-key-file")
+	}
+	if *appendfilename == "" || filepath.Base(*appendfilename) != *appendfilename {
+		log.Fatal("appendfilename: can't be a path, just a filename")
+	}
+	cfg := newConfig()
+	cfg.databases, cfg.shards = *databases, *shards
+	cfg.appendonly, cfg.appendfilename = *appendonly, *appendfilename
+	for _, kv := range [][2]string{
+		{"notify-keyspace-events", *notifyEvents},
+		{"requirepass", *requirepass},
+		{"maxmemory", *maxmemory},
+		{"maxmemory-policy", *maxmemoryPolicy},
+		{"proto-max-bulk-len", *protoMaxBulkLen},
+		{"dir", *dir},
+		{"dbfilename", *dbfilename},
+		{"appendfsync", *appendfsync},
+		{"masterauth", *masterauth},
+		{"timeout", strconv.Itoa(*timeout)},
+		{"maxclients", strconv.Itoa(*maxclients)},
+		{"shutdown-on-sigterm", *shutdownSigterm},
+		{"shutdown-on-sigint", *shutdownSigint},
+	} {
+		if err := cfg.set(kv[0], kv[1]); err != nil {
+			log.Fatal(kv[0], ": ", strings.TrimPrefix(err.Error(), "ERR "))
+		}
+	}
+	srv := newServer(cfg)
+	if cfg.appendonly {
+		err := srv.replayAOF(cfg.aofPath())
+		if errors.Is(err, fs.ErrNotExist) {
+			// the log is new, so it starts from the snapshot
+			if err = srv.loadDump(cfg.dumpPath()); err != nil {
+				log.Fatal("loading the snapshot: ", err)
+			}
+		} else if err != nil {
+			log.Fatal("loading the append-only file: ", err)
+		}
+		a, fresh, err := openAOF(srv, cfg.aofPath())
+		if err != nil {
+			log.Fatal("opening the append-only file: ", err)
+		}
+		srv.feed.setAOF(a)
+		if fresh {
+			srv.feed.logKeyspace(srv.dbs)
+		}
+	} else if err := srv.loadDump(cfg.dumpPath()); err != nil {
+		log.Fatal("loading the snapshot: ", err)
+	}
+
+	if *replicaof != "" {
+		host, port, ok := strings.Cut(*replicaof, " ")
+		if !ok {
+			log.Fatal(`replicaof: must be "host port"`)
+		}
+		srv.replicaOf(host, port)
+	}
+
+	// run the janitor ten times a second, as Redis does by default
+	stopJanitor := startJanitor(srv, 100*time.Millisecond)
+	stopReclaimer := startReclaimer(srv)
+
+	var listeners []net.Listener
+	if *port != 0 {
+		lns, err := listenTCP(*bind, *port, nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners = append(listeners, lns...)
+	}
+	if *tlsPort != 0 {
+		tlsConfig, err := loadTLSConfig(*tlsCertFile, *tlsKeyFile, *tlsCAFile)
+		if err != nil {
+			log.Fatal("tls: ", err)
+		}
+		lns, err := listenTCP(*bind, *tlsPort, tlsConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners = append(listeners, lns...)
+	}
+	if *unixsocket != "" {
+		ln, err := listenUnix(*unixsocket)
+		if err != nil {
+			log.Fatal(err)
+		}
+		listeners = append(listeners, ln)
+	}
+
+	// SIGINT or SIGTERM closes the listeners, which ends the accept loops
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	stopped := make(chan os.Signal, 1)
+	go func() {
+		sig := <-sigs
+		signal.Stop(sigs) // a second signal kills the server outright
+		log.Printf("received %v, shutting down", sig)
+		stopped <- sig
+		for _, ln := range listeners {
+			_ = ln.Close()
+		}
+	}()
+
+	var conns, accepting sync.WaitGroup
+	for _, ln := range listeners {
+		accepting.Go(func() { serve(srv, ln, &conns) })
+	}
+	accepting.Wait()
+
+	sig := <-stopped
+	srv.stopReplication()
+	srv.closeConns(&conns)
+	stopJanitor()
+	stopReclaimer()
+	srv.persist(sig)
+	log.Print("redis-lite is ready to exit")
+}
+
+// maxPipelined is how many replies handleConn lets pile up in the writer
+// while the client pipelines commands.
+const maxPipelined = 64
+
+// listenTCP listens on port at each of the space-separated addresses in
+// bind, or on every interface if there are none, with TLS if tlsConfig is
+// set.
+func listenTCP(bind string, port int, tlsConfig *tls.Config) ([]net.Listener, error) {
+	hosts := strings.Fields(bind)
+	if len(hosts) == 0 {
+		hosts = []string{""}
+	}
+	var lns []net.Listener
+	for _, host := range hosts {
+		addr := net.JoinHostPort(host, strconv.Itoa(port))
+		ln, err := net.Listen("tcp", addr)
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, err
+		}
+		kind := ""
+		if tlsConfig != nil {
+			ln = tls.NewListener(ln, tlsConfig)
+			kind = "TLS "
+		}
+		log.Printf("redis-lite listening for %sconnections on %s", kind, addr)
+		lns = append(lns, ln)
+	}
+	return lns, nil
+}
+
+// listenUnix listens on a Unix socket at path, replacing the socket a server
+// that didn't shut down cleanly left there. Closing the listener removes it.
+func listenUnix(path string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&fs.ModeSocket != 0 {
+		_ = os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("redis-lite listening for connections on %s", path)
+	return ln, nil
+}
+
+// serve accepts connections on ln until it is closed, handling each in a
+// goroutine conns counts. The connections of a TLS listener are handled the
+// same, as a tls.Conn is a net.Conn like any other.
+func serve(srv *server, ln net.Listener, conns *sync.WaitGroup) {
+	for {
+		conn, err := ln.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Println("accept:", err)
+			continue
+		}
+		// the client is made here so ids follow the order of accepting
+		c := newClient(conn, srv)
+		conns.Go(func() { handleConn(c) })
+	}
+}
+
+func handleConn(c *client) {
+	defer func() { _ = c.conn.Close() }()
+
+	srv := c.srv
+	if srv.connected.Add(1) > int64(srv.config.maxClients()) {
+		srv.connected.Add(-1)
+		srv.stats.rejected.Add(1)
+		_ = c.conn.SetWriteDeadline(time.Now().Add(time.Second))
+		_ = resp.WriteError(c.w, "ERR max number of clients reached")
+		_ = c.w.Flush()
+		return
+	}
+	defer srv.connected.Add(-1)
+	srv.addClient(c)
+	defer srv.removeClient(c)
+	srv.stats.totalConnections.Add(1)
+	defer c.unwatch()
+	defer c.unsubscribeAll()
+	defer c.unmonitor()
+	defer c.stopPushes()
+	w := c.w
+	pending := 0 // replies written but not flushed yet
+
+	for {
+		// As in Redis, a client subscribed or monitoring waits on the
+		// server, so it isn't idle. The deadline is set before checking for
+		// shutdown, so it can't undo the one closeConns sets.
+		var deadline time.Time
+		if t := srv.config.idleTimeout(); t > 0 && !c.monitoring && len(c.channels)+len(c.patterns) == 0 {
+			deadline = time.Now().Add(t)
+		}
+		_ = c.conn.SetReadDeadline(deadline)
+		if srv.shuttingDown() {
+			// the replies so far are sent, and the commands after dropped
+			c.wmu.Lock()
+			_ = w.Flush()
+			c.wmu.Unlock()
+			return
+		}
+		val, err := resp.Read(c.r, srv.config.readLimits())
+		var perr *resp.ProtocolError
+		if errors.As(err, &perr) {
+			// the rest of the stream can't be made sense of, so say why
+			// and hang up
+			c.wmu.Lock()
+			_ = resp.WriteError(w, "ERR "+perr.Error())
+			_ = w.Flush()
+			c.wmu.Unlock()
+			return
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return // idle for timeout, or the server is shutting down
+		}
+		if err != nil {
+			return
+		} // client closed
+
+		if val.T == resp.Null {
+			continue
+		} // a null array isn't a command, but isn't an error either
+		if val.T != resp.Array || len(val.A) == 0 {
+			c.wmu.Lock()
+			_ = resp.WriteError(w, "ERR protocol error")
+			_ = w.Flush()
+			c.wmu.Unlock()
+			continue
+		}
+
+		// commands are bulk strings
+		cmd := strings.ToUpper(string(val.A[0].B))
+		spec, known := commands[cmd]
+		srv.stats.commands.Add(1)
+
+		// the monitors are sent the command before it runs
+		if known && (c.authed || cmd == "AUTH") && !c.monitoring {
+			srv.feedMonitors(c, val.A)
+		}
+
+		// c's pusher writes to w as well, so hold the lock until the reply
+		// is flushed
+		c.wmu.Lock()
+		start := time.Now()
+		switch {
+		case !c.authed && cmd != "AUTH" && cmd != "HELLO" && cmd != "PING" && cmd != "RESET":
+			_ = resp.WriteError(w, "NOAUTH Authentication required.")
+		case known && !spec.checkArity(val.A):
+			_ = resp.WriteError(w, "ERR wrong number of arguments for '"+strings.ToLower(cmd)+"'")
+			c.dirty = c.dirty || c.multi
+		case cmd == "AUTH":
+			c.auth(val.A)
+		case cmd == "HELLO":
+			c.hello(val.A)
+		case cmd == "RESET":
+			c.reset()
+		case c.monitoring:
+			_ = resp.WriteError(w, "ERR Can't execute '"+strings.ToLower(cmd)+"': the connection is in MONITOR mode")
+		case c.subscribed() && !allowedSubscribed[cmd]:
+			_ = resp.WriteError(w, "ERR Can't execute '"+strings.ToLower(cmd)+"': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / PING are allowed in this context")
+		case cmd == "PING" && c.subscribed():
+			handleSubscribedPing(w, val.A)
+		case cmd == "SUBSCRIBE" || cmd == "PSUBSCRIBE":
+			c.subscribe(val.A, cmd == "PSUBSCRIBE")
+		case cmd == "UNSUBSCRIBE" || cmd == "PUNSUBSCRIBE":
+			c.unsubscribe(val.A, cmd == "PUNSUBSCRIBE")
+		case cmd == "MONITOR":
+			c.monitor()
+		case (cmd == "SYNC" || cmd == "PSYNC") && c.multi:
+			_ = resp.WriteError(w, "ERR Command not allowed inside a transaction")
+		case cmd == "SYNC" || cmd == "PSYNC":
+			// the connection becomes the replica's link until it drops
+			c.wmu.Unlock()
+			srv.serveReplica(c, cmd == "PSYNC")
+			return
+		case cmd == "MULTI":
+			c.startMulti()
+		case cmd == "EXEC":
+			c.exec()
+		case cmd == "DISCARD":
+			c.discard()
+		case cmd == "WATCH":
+			c.watch(val.A)
+		case cmd == "UNWATCH" && !c.multi:
+			c.unwatch()
+			_ = resp.WriteSimpleString(w, "OK")
+		case !known:
+			_ = resp.WriteError(w, "ERR unknown command '"+cmd+"'")
+			c.dirty = c.dirty || c.multi
+		case spec.flags&cmdWrite != 0 && srv.replicating() && srv.config.readOnlyReplica():
+			_ = resp.WriteError(w, "READONLY You can't write against a read only replica.")
+			c.dirty = c.dirty || c.multi
+		case spec.flags&cmdDenyOOM != 0 && srv.freeMemory() != nil:
+			// over maxmemory with nothing to evict, so refuse to grow;
+			// a transaction is checked as its commands are queued
+			_ = resp.WriteError(w, errOOM.Error())
+			c.dirty = c.dirty || c.multi
+		case c.multi:
+			c.queue(val.A)
+		case cmd == "BLPOP" || cmd == "BRPOP":
+			// blocking pops run without srv.txmu, which they take only
+			// while not blocked
+			handleBPop(w, c.db, val.A, cmd == "BLPOP", c.conn, c.r)
+		case cmd == "WAIT":
+			handleWait(c, val.A, true) // blocks, so runs without srv.txmu
+		case cmd == "DEBUG":
+			spec.handler(c, val.A) // may sleep, so runs without srv.txmu
+		case srv.feed.on() && spec.flags&cmdWrite != 0:
+			c.runLogged(cmd, spec, val.A)
+		default:
+			srv.txmu.RLock()
+			spec.handler(c, val.A)
+			srv.txmu.RUnlock()
+		}
+		// time spent blocked in BLPOP or BRPOP doesn't count
+		if known && spec.flags&cmdBlocking == 0 {
+			srv.slowlog.record(c, val.A, time.Since(start))
+		}
+		// Replies to pipelined commands are flushed together, once the
+		// input read so far is used up or maxPipelined of them are waiting;
+		// a client waiting on its reply still gets it right away.
+		pending++
+		if c.r.Buffered() == 0 || pending >= maxPipelined || c.closing {
+			_ = w.Flush()
+			pending = 0
+		}
+		c.wmu.Unlock()
+		if c.closing {
+			return
+		}
+	}
+}
+
+func handlePing(w *bufio.Writer, st *Store, args []resp.Value) {
+	// PING [message]
+	if len(args) > 1 {
+		_ = resp.WriteBulk(w, args[1].B)
+	} else {
+		_ = resp.WriteSimpleString(w, "PONG")
+	}
+}
+
+func handleEcho(w *bufio.Writer, st *Store, args []resp.Value) {
+	// ECHO message
+	if args[1].T != resp.BulkString {
+		_ = resp.WriteError(w, "ERR wrong number of arguments for 'echo'")
+		return
+	}
+	_ = resp.WriteBulk(w, args[1].B)
+}
+
+func handleSet(w *bufio.Writer, st *Store, args []resp.Value) {
+	// SET key value [NX|XX] [GET] [EX s|PX ms|EXAT unix-s|PXAT unix-ms|KEEPTTL]
+	key := string(args[1].B)
+	val := args[2].B
+	var opts setOptions
+	expiry := "" // the expiry option seen so far, they are mutually exclusive
+	for i := 3; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i].B))
+		switch {
+		case opt == "NX" && !opts.xx:
+			opts.nx = true
+		case opt == "XX" && !opts.nx:
+			opts.xx = true
+		case opt == "GET":
+			opts.get = true
+		case opt == "KEEPTTL" && expiry == "":
+			expiry = opt
+			opts.keepTTL = true
+		case (opt == "EX" || opt == "PX" || opt == "EXAT" || opt == "PXAT") && expiry == "" && i+1 < len(args):
+			expiry = opt
+			i++
+			var err error
+			if opts.exp, err = parseExpiry(opt, args[i].B); err != nil {
+				writeExpiryError(w, "set", err)
+				return
+			}
+		default:
+			_ = resp.WriteError(w, "ERR syntax error")
+			return
+		}
+	}
+	old, written, err := st.setWith(key, val, opts)
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	if written {
+		st.notify(notifyString, "set", key)
+		if opts.exp > 0 {
+			st.notify(notifyGeneric, "expire", key)
+		}
+	}
+	if opts.get {
+		_ = resp.WriteBulk(w, old) // previous value, even if the set was skipped
+		return
+	}
+	if !written {
+		_ = resp.WriteBulk(w, nil)
+		return
+	} // condition not met
+	_ = resp.WriteSimpleString(w, "OK")
+}
+
+func handleCopy(w *bufio.Writer, st *Store, args []resp.Value) {
+	// COPY src dst [REPLACE]
+	replace := false
+	for _, a := range args[3:] {
+		if strings.ToUpper(string(a.B)) != "REPLACE" {
+			_ = resp.WriteError(w, "ERR syntax error")
+			return
+		}
+		replace = true
+	}
+	src, dst := string(args[1].B), string(args[2].B)
+	if src == dst {
+		_ = resp.WriteError(w, "ERR source and destination objects are the same")
+		return
+	}
+	if st.copyKey(src, dst, replace) {
+		_ = resp.WriteInteger(w, 1)
+		return
+	}
+	_ = resp.WriteInteger(w, 0)
+}
+
+func handleRandomKey(w *bufio.Writer, st *Store, args []resp.Value) {
+	// RANDOMKEY
+	k, ok := st.randomKey()
+	if !ok {
+		_ = resp.WriteBulk(w, nil)
+		return
+	} // empty keyspace
+	_ = resp.WriteBulk(w, []byte(k))
 }
 
-type Store struct {
-	mu   sync.RWMutex
-	data map[string]Entry
+func handleTouch(w *bufio.Writer, st *Store, args []resp.Value) {
+	// TOUCH key [key ...]
+	_ = resp.WriteInteger(w, int64(st.touch(args[1:])))
 }
 
-func (s *Store) get(key string) (Entry, bool) {
-	s.mu.RLock()
-	defer s.mu.RUnlock()
+func handleDBSize(w *bufio.Writer, st *Store, args []resp.Value) {
+	// DBSIZE
+	_ = resp.WriteInteger(w, int64(st.size()))
+}
 
-	e, ok := s.data[key]
-	if !ok {
-		return Entry{}, false
+func handleFlush(c *client, args []resp.Value) {
+	// FLUSHDB [ASYNC|SYNC] / FLUSHALL [ASYNC|SYNC]
+	if len(args) > 2 {
+		_ = resp.WriteError(c.w, "ERR syntax error")
+		return
 	}
-	if e.exp > 0 && time.Now().UnixMilli() > e.exp {
-		return Entry{}, false
+	if len(args) == 2 {
+		// ASYNC is accepted but the flush is always synchronous
+		if mode := strings.ToUpper(string(args[1].B)); mode != "ASYNC" && mode != "SYNC" {
+			_ = resp.WriteError(c.w, "ERR syntax error")
+			return
+		}
+	}
+	if strings.EqualFold(string(args[0].B), "FLUSHALL") {
+		for _, db := range c.srv.dbs {
+			db.flush()
+		}
+	} else {
+		c.db.flush()
 	}
+	_ = resp.WriteSimpleString(c.w, "OK")
+}
 
-	return e, true
+// errBadExpire is returned by parseExpiry for an expiry that is an integer
+// but not a usable one; callers name their command in the reply.
+var errBadExpire = errors.New("invalid expire time")
+
+// parseExpiry converts the argument of an EX, PX, EXAT or PXAT option to an
+// absolute expiry in unix ms. It returns errNotInteger for an argument that
+// isn't an integer, and errBadExpire for one that isn't positive or
+// overflows.
+func parseExpiry(opt string, arg []byte) (int64, error) {
+	mul := int64(1)
+	if opt == "EX" || opt == "EXAT" {
+		mul = 1000
+	}
+	n, err := strconv.ParseInt(string(arg), 10, 64)
+	if err != nil {
+		return 0, errNotInteger
+	}
+	if n <= 0 || n > math.MaxInt64/mul {
+		return 0, errBadExpire
+	}
+	n *= mul
+	if opt == "EX" || opt == "PX" {
+		now := time.Now().UnixMilli()
+		if n > math.MaxInt64-now {
+			return 0, errBadExpire
+		}
+		n += now
+	}
+	return n, nil
 }
 
-func (s *Store) set(key string, val []byte, ttlMs int64) {
-	exp := int64(0)
-	if ttlMs > 0 {
-		exp = time.Now().UnixMilli() + ttlMs
+// writeExpiryError replies to a parseExpiry error for the command cmd.
+func writeExpiryError(w *bufio.Writer, cmd string, err error) {
+	if err == errBadExpire {
+		_ = resp.WriteError(w, "ERR invalid expire time in '"+cmd+"' command")
+		return
 	}
-	s.mu.Lock()
-	s.data[key] = Entry{val: val, exp: exp}
-	s.mu.Unlock()
+	_ = resp.WriteError(w, err.Error())
 }
 
-func (s *Store) del(keys ...string) int {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+func handleGet(w *bufio.Writer, st *Store, args []resp.Value) {
+	key := string(args[1].B)
+	v, ok, err := st.getString(key)
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	if !ok {
+		_ = resp.WriteBulk(w, nil)
+		return
+	} // null bulk
+	_ = resp.WriteBulk(w, v)
+}
 
-	n := 0
-	for _, k := range keys {
-		if _, ok := s.data[k]; ok {
-			delete(s.data, k)
-			n++
-		}
+func handleDel(w *bufio.Writer, st *Store, args []resp.Value) {
+	keys := make([]string, 0, len(args)-1)
+	for _, a := range args[1:] {
+		keys = append(keys, string(a.B))
 	}
-	return n
+	n := st.del(keys...)
+	_ = resp.WriteInteger(w, int64(n))
 }
 
-func main() {
-	st := &Store{data: make(map[string]Entry)}
+func handleUnlink(w *bufio.Writer, st *Store, args []resp.Value) {
+	// UNLINK key [key ...]
+	keys := make([]string, 0, len(args)-1)
+	for _, a := range args[1:] {
+		keys = append(keys, string(a.B))
+	}
+	n := st.unlink(keys...)
+	_ = resp.WriteInteger(w, int64(n))
+}
 
-	// run janitor every 1 second
-	startJanitor(st, time.Second)
+func handleExpire(w *bufio.Writer, st *Store, args []resp.Value, mul int64) {
+	// EXPIRE key seconds / PEXPIRE key milliseconds
+	ttl, err := parseIntMs(args[2].B, mul)
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	now := time.Now().UnixMilli()
+	if ttl > math.MaxInt64-now {
+		_ = resp.WriteError(w, "ERR invalid expire time in '"+strings.ToLower(string(args[0].B))+"' command")
+		return
+	}
+	exp := now + ttl
+	if st.setExpiry(string(args[1].B), exp) {
+		notifyExpiry(st, string(args[1].B), exp)
+		_ = resp.WriteInteger(w, 1)
+		return
+	}
+	_ = resp.WriteInteger(w, 0)
+}
 
-	ln, err := net.Listen("tcp", ":6379")
+func handleExpireAt(w *bufio.Writer, st *Store, args []resp.Value, mul int64) {
+	// EXPIREAT key unix-seconds / PEXPIREAT key unix-ms
+	exp, err := parseIntMs(args[2].B, mul)
 	if err != nil {
-		log.Fatal(err)
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	if st.setExpiry(string(args[1].B), exp) {
+		notifyExpiry(st, string(args[1].B), exp)
+		_ = resp.WriteInteger(w, 1)
+		return
 	}
-	log.Println("redis-lite listening on :6379")
+	_ = resp.WriteInteger(w, 0)
+}
 
-	for {
-		conn, err := ln.Accept()
-		if err != nil {
-			log.Println("accept:", err)
-			continue
-		}
-		go handleConn(conn, st)
+// notifyExpiry raises the event for a successful setExpiry: an expiry in
+// the past deletes the key, as in Redis.
+func notifyExpiry(st *Store, key string, exp int64) {
+	if exp <= time.Now().UnixMilli() {
+		st.notify(notifyGeneric, "del", key)
+	} else {
+		st.notify(notifyGeneric, "expire", key)
 	}
 }
 
-func handleConn(conn net.Conn, st *Store) {
-	defer func() { _ = conn.Close() }()
+func handleTTL(w *bufio.Writer, st *Store, args []resp.Value) {
+	ms := st.pttl(string(args[1].B))
+	if ms < 0 {
+		_ = resp.WriteInteger(w, ms)
+		return
+	} // -2 key not found, -1 no expire
+	_ = resp.WriteInteger(w, ms/1000) // seconds like TTL
+}
 
-	r := bufio.NewReader(conn)
-	w := bufio.NewWriter(conn)
+func handlePTTL(w *bufio.Writer, st *Store, args []resp.Value) {
+	// PTTL key
+	_ = resp.WriteInteger(w, st.pttl(string(args[1].B)))
+}
 
-	for {
-		val, err := resp.Read(r)
-		if err != nil {
+func handlePersist(w *bufio.Writer, st *Store, args []resp.Value) {
+	// PERSIST key
+	key := string(args[1].B)
+
+	unlock := st.lock(key)
+	e, ok := st.lookup(key)
+	if ok && e.exp > 0 {
+		e.exp = 0
+		st.put(key, e)
+		_ = resp.WriteInteger(w, 1)
+	} else {
+		_ = resp.WriteInteger(w, 0)
+	}
+	unlock()
+}
+
+func handleIncr(w *bufio.Writer, st *Store, args []resp.Value, delta int64) {
+	// INCR key / DECR key
+	n, err := st.incrBy(string(args[1].B), delta)
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	_ = resp.WriteInteger(w, n)
+}
+
+func handleIncrBy(w *bufio.Writer, st *Store, args []resp.Value, sign int64) {
+	// INCRBY key delta / DECRBY key delta
+	delta, err := strconv.ParseInt(string(args[2].B), 10, 64)
+	if err != nil {
+		_ = resp.WriteError(w, errNotInteger.Error())
+		return
+	}
+	if sign < 0 {
+		if delta == math.MinInt64 {
+			_ = resp.WriteError(w, "ERR decrement would overflow")
 			return
-		} // client closed or parse error
-		if val.T != resp.Array || len(val.A) == 0 {
-			_ = resp.WriteError(w, "ERR protocol error")
-			_ = w.Flush()
-			continue
 		}
+		delta = -delta
+	}
+	n, err := st.incrBy(string(args[1].B), delta)
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	_ = resp.WriteInteger(w, n)
+}
 
-		// commands are bulk strings
-		cmd := strings.ToUpper(string(val.A[0].B))
+func handleIncrByFloat(w *bufio.Writer, st *Store, args []resp.Value) {
+	// INCRBYFLOAT key increment
+	incr, err := parseFloat(args[2].B)
+	if err != nil {
+		_ = resp.WriteError(w, errNotFloat.Error())
+		return
+	}
+	b, err := st.incrByFloat(string(args[1].B), incr)
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	_ = resp.WriteBulk(w, b)
+}
 
-		switch cmd {
-		case "PING":
-			if len(val.A) > 1 {
-				_ = resp.WriteBulk(w, val.A[1].B)
-			} else {
-				_ = resp.WriteSimpleString(w, "PONG")
-			}
-		case "ECHO":
-			if len(val.A) != 2 || val.A[1].T != resp.BulkString {
-				_ = resp.WriteError(w, "ERR wrong number of arguments for 'echo'")
-				break
-			}
-			_ = resp.WriteBulk(w, val.A[1].B)
-		case "SET":
-			handleSet(w, st, val.A)
-		case "GET":
-			handleGet(w, st, val.A)
-		case "DEL":
-			handleDel(w, st, val.A)
-		case "EXPIRE":
-			handleExpire(w, st, val.A)
-		case "TTL":
-			handleTTL(w, st, val.A)
-		default:
-			_ = resp.WriteError(w, "ERR unknown command '"+cmd+"'")
-		}
-		_ = w.Flush()
+func handleAppend(w *bufio.Writer, st *Store, args []resp.Value) {
+	// APPEND key value
+	n, err := st.appendVal(string(args[1].B), args[2].B)
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
 	}
+	_ = resp.WriteInteger(w, int64(n))
 }
 
-func handleSet(w *bufio.Writer, st *Store, args []resp.Value) {
-	// SET key value [EX seconds|PX milliseconds]
-	if len(args) < 3 {
-		_ = resp.WriteError(w, "ERR wrong number of arguments for 'set'")
+func handleStrlen(w *bufio.Writer, st *Store, args []resp.Value) {
+	// STRLEN key
+	v, _, err := st.getString(string(args[1].B))
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
 		return
 	}
-	key := string(args[1].B)
-	val := args[2].B
-	var ttlMs int64
-	if len(args) >= 5 {
-		opt := strings.ToUpper(string(args[3].B))
-		if opt == "EX" {
-			ttlMs = parseIntMs(args[4].B, 1000)
-		}
-		if opt == "PX" {
-			ttlMs = parseIntMs(args[4].B, 1)
-		}
+	_ = resp.WriteInteger(w, int64(len(v)))
+}
+
+func handleGetSet(w *bufio.Writer, st *Store, args []resp.Value) {
+	// GETSET key value
+	old, ok, err := st.getSet(string(args[1].B), args[2].B)
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
 	}
-	st.set(key, val, ttlMs)
-	_ = resp.WriteSimpleString(w, "OK")
+	if !ok {
+		_ = resp.WriteBulk(w, nil)
+		return
+	} // null bulk
+	_ = resp.WriteBulk(w, old)
 }
 
-func handleGet(w *bufio.Writer, st *Store, args []resp.Value) {
-	if len(args) != 2 {
-		_ = resp.WriteError(w, "ERR wrong number of arguments for 'get'")
+func handleGetEx(w *bufio.Writer, st *Store, args []resp.Value) {
+	// GETEX key [EX s|PX ms|EXAT unix-s|PXAT unix-ms|PERSIST]
+	var exp int64
+	persist := false
+	for i := 2; i < len(args); i++ {
+		opt := strings.ToUpper(string(args[i].B))
+		switch {
+		case opt == "PERSIST" && len(args) == 3:
+			persist = true
+		case (opt == "EX" || opt == "PX" || opt == "EXAT" || opt == "PXAT") && len(args) == 4:
+			i++
+			var err error
+			if exp, err = parseExpiry(opt, args[i].B); err != nil {
+				writeExpiryError(w, "getex", err)
+				return
+			}
+		default:
+			_ = resp.WriteError(w, "ERR syntax error")
+			return
+		}
+	}
+	v, ok, err := st.getEx(string(args[1].B), exp, persist)
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
 		return
 	}
-	key := string(args[1].B)
-	e, ok := st.get(key)
 	if !ok {
 		_ = resp.WriteBulk(w, nil)
 		return
 	} // null bulk
-	_ = resp.WriteBulk(w, e.val)
+	_ = resp.WriteBulk(w, v)
 }
 
-func handleDel(w *bufio.Writer, st *Store, args []resp.Value) {
-	if len(args) < 2 {
-		_ = resp.WriteError(w, "ERR wrong number of arguments for 'del'")
+func handleSetRange(w *bufio.Writer, st *Store, args []resp.Value) {
+	// SETRANGE key offset value
+	offset, err := strconv.Atoi(string(args[2].B))
+	if err != nil {
+		_ = resp.WriteError(w, errNotInteger.Error())
 		return
 	}
-	keys := make([]string, 0, len(args)-1)
-	for _, a := range args[1:] {
-		keys = append(keys, string(a.B))
+	if offset < 0 || offset > st.srv.config.maxStringSize() {
+		_ = resp.WriteError(w, "ERR offset is out of range")
+		return
+	}
+	n, err := st.setRange(string(args[1].B), offset, args[3].B)
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
 	}
-	n := st.del(keys...)
 	_ = resp.WriteInteger(w, int64(n))
 }
 
-func handleExpire(w *bufio.Writer, st *Store, args []resp.Value) {
-	if len(args) != 3 {
-		_ = resp.WriteError(w, "ERR wrong number of arguments for 'expire'")
+func handleGetRange(w *bufio.Writer, st *Store, args []resp.Value) {
+	// GETRANGE key start end
+	start, err1 := strconv.ParseInt(string(args[2].B), 10, 64)
+	end, err2 := strconv.ParseInt(string(args[3].B), 10, 64)
+	if err1 != nil || err2 != nil {
+		_ = resp.WriteError(w, errNotInteger.Error())
 		return
 	}
-	key := string(args[1].B)
-	secs := parseIntMs(args[2].B, 1000)
+	v, _, err := st.getString(string(args[1].B))
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	lo, hi := normalizeRange(start, end, len(v))
+	if lo == hi {
+		_ = resp.WriteBulk(w, []byte{}) // an empty string, not a null
+		return
+	}
+	_ = resp.WriteBulk(w, v[lo:hi])
+}
+
+func handleGetDel(w *bufio.Writer, st *Store, args []resp.Value) {
+	// GETDEL key
+	v, ok, err := st.getDel(string(args[1].B))
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	if !ok {
+		_ = resp.WriteBulk(w, nil)
+		return
+	} // null bulk
+	_ = resp.WriteBulk(w, v)
+}
 
-	st.mu.Lock()
-	if e, ok := st.data[key]; ok {
-		e.exp = time.Now().UnixMilli() + secs
-		st.data[key] = e
+func handleSetNX(w *bufio.Writer, st *Store, args []resp.Value) {
+	// SETNX key value
+	if st.setIfAbsent(string(args[1].B), args[2].B) {
 		_ = resp.WriteInteger(w, 1)
-	} else {
-		_ = resp.WriteInteger(w, 0)
+		return
 	}
-	st.mu.Unlock()
+	_ = resp.WriteInteger(w, 0)
 }
 
-func handleTTL(w *bufio.Writer, st *Store, args []resp.Value) {
-	if len(args) != 2 {
-		_ = resp.WriteError(w, "ERR wrong number of arguments for 'ttl'")
+func handleMSet(w *bufio.Writer, st *Store, args []resp.Value) {
+	// MSET key value [key value ...]
+	if len(args)%2 != 1 {
+		_ = resp.WriteError(w, "ERR wrong number of arguments for 'mset'")
+		return
+	}
+	st.mset(args[1:])
+	_ = resp.WriteSimpleString(w, "OK")
+}
+
+func handleMSetNX(w *bufio.Writer, st *Store, args []resp.Value) {
+	// MSETNX key value [key value ...]
+	if len(args)%2 != 1 {
+		_ = resp.WriteError(w, "ERR wrong number of arguments for 'msetnx'")
 		return
 	}
+	if st.msetnx(args[1:]) {
+		_ = resp.WriteInteger(w, 1)
+		return
+	}
+	_ = resp.WriteInteger(w, 0)
+}
+
+func handleMGet(w *bufio.Writer, st *Store, args []resp.Value) {
+	// MGET key [key ...]
+	vals := st.mget(args[1:])
+	arr := make([]resp.Value, len(vals))
+	for i, v := range vals {
+		arr[i] = resp.Value{T: resp.BulkString, B: v}
+	}
+	_ = resp.WriteArray(w, arr)
+}
 
-	st.mu.RLock()
-	e, ok := st.data[string(args[1].B)]
-	st.mu.RUnlock()
+func handleExists(w *bufio.Writer, st *Store, args []resp.Value) {
+	// EXISTS key [key ...]; repeated keys are counted each time
 
-	if !ok {
-		_ = resp.WriteInteger(w, -2)
+	keys := argStrings(args[1:])
+	unlock := st.rlock(keys...)
+	now := time.Now().UnixMilli()
+	n := 0
+	for _, k := range keys {
+		if _, ok := st.lookupAt(k, now); ok {
+			n++
+		}
+	}
+	unlock()
+
+	_ = resp.WriteInteger(w, int64(n))
+}
+
+func handleKeys(w *bufio.Writer, st *Store, args []resp.Value) {
+	// KEYS pattern
+	pattern := string(args[1].B)
+
+	var keys []resp.Value
+	for _, k := range st.liveKeys() {
+		if matchPattern(pattern, k) {
+			keys = append(keys, resp.Value{T: resp.BulkString, B: []byte(k)})
+		}
+	}
+
+	_ = resp.WriteArray(w, keys)
+}
+
+func handleScan(w *bufio.Writer, st *Store, args []resp.Value) {
+	// SCAN cursor [MATCH pattern] [COUNT count]
+	cursor, err := strconv.ParseUint(string(args[1].B), 10, 64)
+	if err != nil {
+		_ = resp.WriteError(w, "ERR invalid cursor")
 		return
-	} // key not found
-	if e.exp == 0 {
-		_ = resp.WriteInteger(w, -1)
+	}
+	pattern, count, err := parseScanOptions(args[2:])
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
 		return
-	} // no expire
-	ms := e.exp - time.Now().UnixMilli()
-	if ms < 0 {
-		_ = resp.WriteInteger(w, -2)
+	}
+
+	// COUNT bounds how many keys are examined; MATCH then filters that batch,
+	// so a call may return no keys with a non-zero cursor.
+	batch, next := st.scan(cursor, count)
+	keys := make([]resp.Value, 0, len(batch))
+	for _, k := range batch {
+		if pattern == "" || matchPattern(pattern, k) {
+			keys = append(keys, resp.Value{T: resp.BulkString, B: []byte(k)})
+		}
+	}
+	_ = resp.WriteArrayHeader(w, 2)
+	_ = resp.WriteBulk(w, []byte(strconv.FormatUint(next, 10)))
+	_ = resp.WriteArray(w, keys)
+}
+
+func handleType(w *bufio.Writer, st *Store, args []resp.Value) {
+	// TYPE key
+	e, ok := st.get(string(args[1].B))
+	if !ok {
+		_ = resp.WriteSimpleString(w, "none")
 		return
 	}
-	_ = resp.WriteInteger(w, ms/1000) // seconds like TTL
+	_ = resp.WriteSimpleString(w, e.kind.String())
 }
 
-func parseIntMs(b []byte, mul int64) int64 {
-	// naive parse; ignore errors for brevity
-	var n int64
-	for _, c := range b {
-		n = n*10 + int64(c-'0')
+func handleRename(w *bufio.Writer, st *Store, args []resp.Value, nx bool) {
+	// RENAME src dst / RENAMENX src dst
+	moved, err := st.rename(string(args[1].B), string(args[2].B), nx)
+	switch {
+	case err != nil:
+		_ = resp.WriteError(w, err.Error())
+	case !nx:
+		_ = resp.WriteSimpleString(w, "OK")
+	case moved:
+		_ = resp.WriteInteger(w, 1)
+	default:
+		_ = resp.WriteInteger(w, 0)
+	}
+}
+
+// normalizeRange turns the inclusive start and end indices of a sequence of
+// length n, where negative values count back from the end, into the half-open
+// range [lo, hi). Out-of-range indices are clamped; an empty or reversed range
+// yields lo == hi.
+func normalizeRange(start, end int64, n int) (lo, hi int) {
+	size := int64(n)
+	if start < 0 {
+		start += size
+	}
+	if end < 0 {
+		end += size
+	}
+	start = max(start, 0)
+	end = min(end, size-1)
+	if start > end {
+		return 0, 0
 	}
-	return n * mul
+	return int(start), int(end) + 1
 }
 
-func startJanitor(st *Store, every time.Duration) {
+// parseFloat parses a finite float; nan and inf are rejected.
+func parseFloat(b []byte) (float64, error) {
+	f, err := strconv.ParseFloat(string(b), 64)
+	if err != nil {
+		return 0, err
+	}
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0, errNotFloat
+	}
+	return f, nil
+}
+
+// formatFloat renders f the way Redis does: shortest form, no exponent.
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// parseIntMs parses an integer count of units of mul milliseconds and
+// returns it in milliseconds.
+func parseIntMs(b []byte, mul int64) (int64, error) {
+	n, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil || n > math.MaxInt64/mul || n < math.MinInt64/mul {
+		return 0, errNotInteger
+	}
+	return n * mul, nil
+}
+
+// The janitor expires keys the way Redis's active expiry does: every run it
+// looks at a random sample of the keys with an expiry, deleting those that
+// have expired, and samples again while more than a quarter of them had,
+// as many more likely have, up to a time budget. A run resumes with the
+// database the last one ran out of time in.
+const (
+	janitorSample    = 20                    // keys with an expiry sampled per shard per pass
+	janitorThreshold = 0.25                  // fraction of a sample expired above which the janitor samples again
+	janitorBudget    = 25 * time.Millisecond // most time one run may take
+)
+
+func startJanitor(srv *server, every time.Duration) (stop func()) {
+	quit := make(chan struct{})
+	done := make(chan struct{})
 	go func() {
+		defer close(done)
 		t := time.NewTicker(every)
 		defer t.Stop()
-		for range t.C {
-			now := time.Now().UnixMilli()
-			st.mu.Lock()
-			for k, e := range st.data {
-				if e.exp > 0 && now > e.exp {
-					delete(st.data, k)
+		next := 0 // the database the next run starts with
+		for {
+			select {
+			case <-t.C:
+			case <-quit:
+				return
+			}
+			if srv.replicating() {
+				continue // the master feeds a DEL for each key that expires
+			}
+			deadline := time.Now().Add(janitorBudget)
+			for i := 0; i < len(srv.dbs) && time.Now().Before(deadline); i++ {
+				expireSample(srv.dbs[next], deadline)
+				next = (next + 1) % len(srv.dbs)
+			}
+		}
+	}()
+	return func() {
+		close(quit)
+		<-done
+	}
+}
+
+// expireSample deletes expired keys of st among samples of those with an
+// expiry, sampling again while enough of them were expired, until deadline.
+// Each shard is locked just for its sample, so the janitor only ever holds
+// up the commands on it briefly.
+func expireSample(st *Store, deadline time.Time) {
+	notifying := st.srv.config.notifyFlags()&notifyExpired != 0
+	for {
+		st.srv.txmu.RLock() // keys don't expire in the middle of a transaction
+		now := time.Now().UnixMilli()
+		sampled, expired := 0, 0
+		var notify []string
+		for i, sh := range st.shards {
+			st.srv.logmu[i].Lock() // the DELs fed are in order with the writes
+			sh.mu.Lock()
+			n := 0
+			// a map is ranged over from a random point, so the first keys
+			// make a random sample
+			for k := range sh.expires {
+				if n == janitorSample {
+					break
+				}
+				n++
+				if now > sh.data[k].exp {
+					st.removeExpired(k)
+					expired++
+					if notifying {
+						notify = append(notify, k)
+					}
 				}
 			}
-			st.mu.Unlock()
+			sh.mu.Unlock()
+			st.srv.logmu[i].Unlock()
+			sampled += n
+		}
+		st.srv.txmu.RUnlock()
+		for _, k := range notify {
+			st.notify(notifyExpired, "expired", k)
+		}
+		if float64(expired) <= janitorThreshold*float64(sampled) || !time.Now().Before(deadline) {
+			return
+		}
+	}
+}
+
+// startReclaimer runs the goroutine that releases entries removed by UNLINK.
+// The returned function stops it and waits for it to exit.
+func startReclaimer(srv *server) (stop func()) {
+	srv.freeq = make(chan []Entry, 64)
+	quit := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case freed := <-srv.freeq:
+				// drop the references so large values become garbage here,
+				// outside any command's critical section
+				clear(freed)
+			case <-quit:
+				return
+			}
 		}
 	}()
+	return func() {
+		close(quit)
+		<-done
+	}
 }
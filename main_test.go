@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+
+	"reditlite/resp"
+)
+
+// newTestServer returns a server with the default configuration, keeping
+// its files in a directory of the test's own.
+func newTestServer(t testing.TB) *server {
+	cfg := newConfig()
+	cfg.dir = t.TempDir()
+	return newServer(cfg)
+}
+
+// cmdArgs returns args as the arguments of a command.
+func cmdArgs(args ...string) []resp.Value {
+	v := make([]resp.Value, len(args))
+	for i, a := range args {
+		v[i] = resp.Value{T: resp.BulkString, B: []byte(a)}
+	}
+	return v
+}
+
+// run calls handler as the command args on st and returns its reply.
+func run(st *Store, handler func(*bufio.Writer, *Store, []resp.Value), args ...string) string {
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	handler(w, st, cmdArgs(args...))
+	_ = w.Flush()
+	return b.String()
+}
+
+func TestGetRange(t *testing.T) {
+	st := newTestServer(t).dbs[0]
+	st.put("k", Entry{val: []byte("hello")})
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"GETRANGE", "k", "1", "3"}, "$3\r\nell\r\n"},
+		{[]string{"GETRANGE", "k", "-3", "-1"}, "$3\r\nllo\r\n"},
+		{[]string{"GETRANGE", "k", "3", "1"}, "$0\r\n\r\n"},
+		{[]string{"GETRANGE", "missing", "0", "-1"}, "$0\r\n\r\n"},
+	} {
+		if got := run(st, handleGetRange, tt.args...); got != tt.want {
+			t.Errorf("%q = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestParseExpiry(t *testing.T) {
+	for _, tt := range []struct {
+		opt, arg string
+		wantErr  error
+	}{
+		{"EX", "-5", errBadExpire},
+		{"EX", "0", errBadExpire},
+		{"PX", "0", errBadExpire},
+		{"EXAT", "0", errBadExpire},
+		{"PXAT", "-1", errBadExpire},
+		{"EX", "9999999999999999999", errNotInteger}, // past int64
+		{"EX", "-9999999999999999999", errNotInteger},
+		{"EX", "9223372036854776", errBadExpire},    // overflows once in ms
+		{"PX", "9223372036854775807", errBadExpire}, // overflows once added to now
+		{"EX", "abc", errNotInteger},
+		{"EX", "1.5", errNotInteger},
+		{"EX", "", errNotInteger},
+		{"EX", " 1", errNotInteger},
+	} {
+		if _, err := parseExpiry(tt.opt, []byte(tt.arg)); err != tt.wantErr {
+			t.Errorf("parseExpiry(%s, %q) error = %v, want %v", tt.opt, tt.arg, err, tt.wantErr)
+		}
+	}
+
+	before := time.Now().UnixMilli()
+	exp, err := parseExpiry("EX", []byte("10"))
+	if after := time.Now().UnixMilli(); err != nil || exp < before+10000 || exp > after+10000 {
+		t.Errorf("parseExpiry(EX, 10) = %d, %v, want 10s from now", exp, err)
+	}
+	if exp, err := parseExpiry("PXAT", []byte("9223372036854775807")); err != nil || exp != math.MaxInt64 {
+		t.Errorf("parseExpiry(PXAT, max) = %d, %v", exp, err)
+	}
+	if exp, err := parseExpiry("EXAT", []byte("1700000000")); err != nil || exp != 1700000000000 {
+		t.Errorf("parseExpiry(EXAT, 1700000000) = %d, %v", exp, err)
+	}
+}
+
+func TestParseIntMs(t *testing.T) {
+	for _, tt := range []struct {
+		arg  string
+		mul  int64
+		want int64
+		ok   bool
+	}{
+		{"5", 1000, 5000, true},
+		{"-5", 1000, -5000, true}, // in the past, which deletes the key
+		{"0", 1, 0, true},
+		{"9223372036854775807", 1, math.MaxInt64, true},
+		{"9223372036854775807", 1000, 0, false},
+		{"-9223372036854775808", 1000, 0, false},
+		{"9999999999999999999", 1, 0, false},
+		{"x", 1, 0, false},
+	} {
+		got, err := parseIntMs([]byte(tt.arg), tt.mul)
+		if tt.ok && (err != nil || got != tt.want) || !tt.ok && err != errNotInteger {
+			t.Errorf("parseIntMs(%q, %d) = %d, %v", tt.arg, tt.mul, got, err)
+		}
+	}
+}
+
+func TestSetAndExpireErrors(t *testing.T) {
+	st := newTestServer(t).dbs[0]
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"SET", "k", "v", "EX", "-5"}, "-ERR invalid expire time in 'set' command\r\n"},
+		{[]string{"SET", "k", "v", "PX", "0"}, "-ERR invalid expire time in 'set' command\r\n"},
+		{[]string{"SET", "k", "v", "EX", "9999999999999999999"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"SET", "k", "v", "EX", "10"}, "+OK\r\n"},
+	} {
+		if got := run(st, handleSet, tt.args...); got != tt.want {
+			t.Errorf("%q = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+	expire := func(w *bufio.Writer, st *Store, args []resp.Value) { handleExpire(w, st, args, 1000) }
+	if got := run(st, expire, "EXPIRE", "k", "9999999999999999999"); got != "-ERR value is not an integer or out of range\r\n" {
+		t.Errorf("EXPIRE with an overflowing TTL = %q", got)
+	}
+	if got := run(st, expire, "EXPIRE", "k", "-5"); got != ":1\r\n" {
+		t.Errorf("EXPIRE with a negative TTL = %q, want :1", got)
+	}
+	if _, ok := st.get("k"); ok {
+		t.Error("EXPIRE with a negative TTL left the key")
+	}
+}
+
+// TestMaxStringSize checks that proto-max-bulk-len bounds the strings that
+// SETRANGE, APPEND and SETBIT make.
+func TestMaxStringSize(t *testing.T) {
+	srv := newTestServer(t)
+	if err := srv.config.set("proto-max-bulk-len", "1mb"); err != nil {
+		t.Fatal(err)
+	}
+	st := srv.dbs[0]
+	const max = 1 << 20
+	st.put("k", Entry{val: bytes.Repeat([]byte("x"), max-1)})
+	for _, tt := range []struct {
+		handler func(*bufio.Writer, *Store, []resp.Value)
+		args    []string
+		want    string
+	}{
+		{handleSetRange, []string{"SETRANGE", "new", strconv.Itoa(max + 1), "x"}, "-ERR offset is out of range\r\n"},
+		{handleSetRange, []string{"SETRANGE", "new", strconv.Itoa(max), "x"}, "-ERR string exceeds maximum allowed size\r\n"},
+		{handleSetRange, []string{"SETRANGE", "new", strconv.Itoa(max - 1), "x"}, ":1048576\r\n"},
+		{handleAppend, []string{"APPEND", "k", "xy"}, "-ERR string exceeds maximum allowed size\r\n"},
+		{handleAppend, []string{"APPEND", "k", "x"}, ":1048576\r\n"},
+		{handleSetBit, []string{"SETBIT", "bits", strconv.Itoa(8 * max), "1"}, "-ERR bit offset is not an integer or out of range\r\n"},
+		{handleSetBit, []string{"SETBIT", "bits", strconv.Itoa(8*max - 1), "1"}, ":0\r\n"},
+		{handleGetBit, []string{"GETBIT", "bits", strconv.Itoa(8 * max)}, "-ERR bit offset is not an integer or out of range\r\n"},
+	} {
+		if got := run(st, tt.handler, tt.args...); got != tt.want {
+			t.Errorf("%q = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+	if v, _, _ := st.getString("k"); len(v) != max {
+		t.Errorf("k holds %d bytes, want %d", len(v), max)
+	}
+}
+
+// BenchmarkJanitor times GETs on a large keyspace while the janitor expires
+// keys in it, reporting the 99th percentile and the slowest, as it is the
+// GETs held up behind a shard the janitor has locked that it would slow.
+// Half the keys have expired to begin with and the rest expire over the
+// next ten seconds, so the janitor has keys to delete throughout.
+func BenchmarkJanitor(b *testing.B) {
+	for _, nkeys := range []int{10_000, 1_000_000} {
+		b.Run("keys="+strconv.Itoa(nkeys), func(b *testing.B) {
+			srv := newTestServer(b)
+			st := srv.dbs[0]
+			keys := make([]string, nkeys)
+			now := time.Now().UnixMilli()
+			for i := range keys {
+				keys[i] = "key:" + strconv.Itoa(i)
+				exp := now - 1
+				if i%2 == 1 {
+					exp = now + 1 + rand.Int64N(10_000)
+				}
+				st.put(keys[i], Entry{val: []byte("value"), exp: exp})
+			}
+			stop := startJanitor(srv, 100*time.Millisecond)
+			defer stop()
+
+			lat := make([]time.Duration, b.N)
+			b.ResetTimer()
+			for i := range lat {
+				start := time.Now()
+				_, _ = st.get(keys[rand.IntN(nkeys)])
+				lat[i] = time.Since(start)
+			}
+			b.StopTimer()
+			slices.Sort(lat)
+			b.ReportMetric(float64(lat[len(lat)*99/100]), "p99-ns")
+			b.ReportMetric(float64(lat[len(lat)-1]), "max-ns")
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"reditlite/resp"
+)
+
+// monitor puts c in MONITOR mode, where it is sent every command the server
+// runs until it disconnects.
+func (c *client) monitor() {
+	// MONITOR
+	if c.multi {
+		_ = resp.WriteError(c.w, "ERR Command not allowed inside a transaction")
+		c.dirty = true
+		return
+	}
+	if !c.monitoring {
+		c.monitoring = true
+		c.srv.monitorsMu.Lock()
+		c.srv.monitors[c] = struct{}{}
+		c.srv.monitorCount.Add(1)
+		c.srv.monitorsMu.Unlock()
+	}
+	_ = resp.WriteSimpleString(c.w, "OK")
+}
+
+// unmonitor takes c out of MONITOR mode, when it disconnects.
+func (c *client) unmonitor() {
+	if !c.monitoring {
+		return
+	}
+	c.monitoring = false
+	c.srv.monitorsMu.Lock()
+	delete(c.srv.monitors, c)
+	c.srv.monitorCount.Add(-1)
+	c.srv.monitorsMu.Unlock()
+}
+
+// feedMonitors sends the command args, run by c, to the clients in MONITOR
+// mode. It only queues the line for each monitor's pusher to send, so a
+// monitor that stops reading doesn't hold up the command.
+func (srv *server) feedMonitors(c *client, args []resp.Value) {
+	if srv.monitorCount.Load() == 0 {
+		return
+	}
+	srv.monitorsMu.Lock()
+	monitors := slices.Collect(maps.Keys(srv.monitors))
+	srv.monitorsMu.Unlock()
+
+	now := time.Now()
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d.%06d [%d %s]", now.Unix(), now.Nanosecond()/1000, c.db.index, c.addr())
+	for i, a := range args {
+		b.WriteString(" \"")
+		if redactArg(args, i) {
+			b.WriteString("(redacted)")
+		} else {
+			writeQuoted(&b, a.B)
+		}
+		b.WriteByte('"')
+	}
+	line := encoded(func(w *bufio.Writer) error { return resp.WriteSimpleString(w, b.String()) })
+	for _, m := range monitors {
+		m.push(line)
+	}
+}
+
+// redactArg reports whether argument i of the command args is a secret that
+// MONITOR and SLOWLOG must not show: the credentials given to AUTH, or to
+// HELLO after its AUTH option.
+func redactArg(args []resp.Value, i int) bool {
+	switch cmd := string(args[0].B); {
+	case strings.EqualFold(cmd, "AUTH"):
+		return i > 0
+	case strings.EqualFold(cmd, "HELLO"):
+		for j := 2; j < i; j++ {
+			if strings.EqualFold(string(args[j].B), "AUTH") {
+				return i <= j+2
+			}
+		}
+	}
+	return false
+}
+
+// writeQuoted writes s escaped the way Redis shows arguments in MONITOR:
+// quotes, backslashes and control characters get C-style escapes, and other
+// unprintable bytes \xHH.
+func writeQuoted(b *strings.Builder, s []byte) {
+	for _, c := range s {
+		switch c {
+		case '\\', '"':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		case '\t':
+			b.WriteString(`\t`)
+		case '\a':
+			b.WriteString(`\a`)
+		case '\b':
+			b.WriteString(`\b`)
+		default:
+			if c < ' ' || c > '~' {
+				fmt.Fprintf(b, `\x%02x`, c)
+			} else {
+				b.WriteByte(c)
+			}
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Keyspace notification classes, the letters of notify-keyspace-events.
+const (
+	notifyKeyspace uint32 = 1 << iota // K: publish to __keyspace@<db>__:<key>
+	notifyKeyevent                    // E: publish to __keyevent@<db>__:<event>
+	notifyGeneric                     // g: del, expire
+	notifyString                      // $: set
+	notifyExpired                     // x: expired
+
+	notifyAll = notifyGeneric | notifyString | notifyExpired // A
+)
+
+// parseNotifyFlags parses a notify-keyspace-events value such as "KEA".
+// Letters for classes of events redis-lite doesn't raise (l, h, s, z, e, t,
+// m, n, d) are accepted and ignored, so configurations written for Redis
+// still load.
+func parseNotifyFlags(s string) (uint32, error) {
+	var flags uint32
+	for _, c := range s {
+		switch c {
+		case 'K':
+			flags |= notifyKeyspace
+		case 'E':
+			flags |= notifyKeyevent
+		case 'g':
+			flags |= notifyGeneric
+		case '$':
+			flags |= notifyString
+		case 'x':
+			flags |= notifyExpired
+		case 'A':
+			flags |= notifyAll
+		case 'l', 'h', 's', 'z', 'e', 't', 'm', 'n', 'd':
+		default:
+			return 0, errors.New("ERR Invalid event class character. Use 'Ag$lshzxeKEtmdn'.")
+		}
+	}
+	if flags&(notifyKeyspace|notifyKeyevent) == 0 {
+		return 0, nil // neither channel kind selected, so nothing is sent
+	}
+	return flags, nil
+}
+
+// formatNotifyFlags is the inverse of parseNotifyFlags, for CONFIG GET.
+func formatNotifyFlags(flags uint32) string {
+	var b strings.Builder
+	if flags&notifyAll == notifyAll {
+		b.WriteByte('A')
+	} else {
+		for _, c := range []struct {
+			class  uint32
+			letter byte
+		}{{notifyGeneric, 'g'}, {notifyString, '$'}, {notifyExpired, 'x'}} {
+			if flags&c.class != 0 {
+				b.WriteByte(c.letter)
+			}
+		}
+	}
+	if flags&notifyKeyspace != 0 {
+		b.WriteByte('K')
+	}
+	if flags&notifyKeyevent != 0 {
+		b.WriteByte('E')
+	}
+	return b.String()
+}
+
+// notify publishes a keyspace notification for event on key, if events of
+// its class are enabled. It must not be called holding a shard lock, since the
+// subscribers are written to directly.
+func (s *Store) notify(class uint32, event, key string) {
+	flags := s.srv.config.notifyFlags()
+	if flags&class == 0 {
+		return
+	}
+	db := strconv.Itoa(s.index)
+	if flags&notifyKeyspace != 0 {
+		s.srv.pubsub.publish("__keyspace@"+db+"__:"+key, []byte(event))
+	}
+	if flags&notifyKeyevent != 0 {
+		s.srv.pubsub.publish("__keyevent@"+db+"__:"+event, []byte(key))
+	}
+}
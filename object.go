@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"strconv"
+	"strings"
+	"time"
+
+	"reditlite/resp"
+)
+
+// Limits under which Redis keeps a small value in a compact encoding, in
+// elements and bytes per element. redis-lite has one representation per
+// kind, so these only decide what OBJECT ENCODING reports.
+const (
+	listpackEntries = 128
+	listpackValue   = 64
+	intsetEntries   = 512
+	embstrSize      = 44
+)
+
+// encoding names the encoding Redis would use for e.
+func (e Entry) encoding() string {
+	// small reports whether n elements of which the longest is max bytes
+	// would fit a listpack
+	small := func(n, max int) bool { return n <= listpackEntries && max <= listpackValue }
+	switch e.kind {
+	case KindString:
+		if _, err := strconv.ParseInt(string(e.val), 10, 64); err == nil && len(e.val) <= 20 {
+			return "int"
+		}
+		if len(e.val) <= embstrSize {
+			return "embstr"
+		}
+		return "raw"
+	case KindList:
+		longest := 0
+		for _, v := range e.list {
+			longest = max(longest, len(v))
+		}
+		if small(len(e.list), longest) {
+			return "listpack"
+		}
+		return "quicklist"
+	case KindHash:
+		longest := 0
+		for f, v := range e.hash {
+			longest = max(longest, len(f), len(v))
+		}
+		if small(len(e.hash), longest) {
+			return "listpack"
+		}
+		return "hashtable"
+	case KindSet:
+		longest, ints := 0, true
+		for m := range e.set {
+			longest = max(longest, len(m))
+			if _, err := strconv.ParseInt(m, 10, 64); err != nil {
+				ints = false
+			}
+		}
+		if ints && len(e.set) <= intsetEntries {
+			return "intset"
+		}
+		if small(len(e.set), longest) {
+			return "listpack"
+		}
+		return "hashtable"
+	default: // KindZSet
+		longest := 0
+		for _, it := range e.zset.items {
+			longest = max(longest, len(it.member))
+		}
+		if small(len(e.zset.items), longest) {
+			return "listpack"
+		}
+		return "skiplist"
+	}
+}
+
+// objectEncoding returns the encoding OBJECT ENCODING reports for key. It
+// works under the lock, as the value may be changed in place.
+func (s *Store) objectEncoding(key string) (string, bool) {
+	defer s.rlock(key)()
+
+	e, ok := s.lookup(key)
+	if !ok {
+		return "", false
+	}
+	return e.encoding(), true
+}
+
+func handleObject(w *bufio.Writer, st *Store, args []resp.Value) {
+	// OBJECT ENCODING key / OBJECT REFCOUNT key / OBJECT IDLETIME key
+	sub := strings.ToUpper(string(args[1].B))
+	switch sub {
+	case "ENCODING", "REFCOUNT", "IDLETIME":
+	default:
+		_ = resp.WriteError(w, "ERR unknown subcommand '"+string(args[1].B)+"'. Try OBJECT HELP.")
+		return
+	}
+	if len(args) != 3 {
+		_ = resp.WriteError(w, "ERR wrong number of arguments for 'object|"+strings.ToLower(sub)+"'")
+		return
+	}
+	key := string(args[2].B)
+	if sub == "ENCODING" {
+		enc, ok := st.objectEncoding(key)
+		if !ok {
+			_ = resp.WriteError(w, errNoSuchKey.Error())
+			return
+		}
+		_ = resp.WriteBulk(w, []byte(enc))
+		return
+	}
+	e, ok := st.get(key)
+	if !ok {
+		_ = resp.WriteError(w, errNoSuchKey.Error())
+		return
+	}
+	if sub == "REFCOUNT" {
+		_ = resp.WriteInteger(w, 1) // values are never shared between keys
+		return
+	}
+	_ = resp.WriteInteger(w, (time.Now().UnixMilli()-e.atime.Load())/1000)
+}
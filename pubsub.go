@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"strings"
+	"sync"
+
+	"reditlite/resp"
+)
+
+// pubsub is the registry of Pub/Sub subscriptions. It has a lock of its own,
+// so publishing never waits on the keyspace.
+type pubsub struct {
+	mu       sync.Mutex
+	channels map[string]map[*client]struct{} // subscribers by channel
+	patterns map[string]map[*client]struct{} // subscribers by glob pattern
+}
+
+func newPubSub() *pubsub {
+	return &pubsub{
+		channels: make(map[string]map[*client]struct{}),
+		patterns: make(map[string]map[*client]struct{}),
+	}
+}
+
+// registry returns the map of channel or, for pattern, of pattern
+// subscriptions.
+func (ps *pubsub) registry(pattern bool) map[string]map[*client]struct{} {
+	if pattern {
+		return ps.patterns
+	}
+	return ps.channels
+}
+
+func (ps *pubsub) subscribe(c *client, name string, pattern bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	reg := ps.registry(pattern)
+	subs := reg[name]
+	if subs == nil {
+		subs = make(map[*client]struct{})
+		reg[name] = subs
+	}
+	subs[c] = struct{}{}
+}
+
+func (ps *pubsub) unsubscribe(c *client, name string, pattern bool) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	reg := ps.registry(pattern)
+	delete(reg[name], c)
+	if len(reg[name]) == 0 {
+		delete(reg, name)
+	}
+}
+
+// publish delivers msg to the subscribers of channel, and to those of every
+// pattern matching it, and returns how many deliveries it made. A client
+// subscribed both ways gets the message once for each.
+func (ps *pubsub) publish(channel string, msg []byte) int {
+	type delivery struct {
+		c       *client
+		pattern string // "" for a channel subscription
+	}
+	// Deliver from a snapshot, outside ps.mu, so subscribing doesn't wait
+	// on the pushes.
+	ps.mu.Lock()
+	var ds []delivery
+	for c := range ps.channels[channel] {
+		ds = append(ds, delivery{c, ""})
+	}
+	for pat, subs := range ps.patterns {
+		if matchPattern(pat, channel) {
+			for c := range subs {
+				ds = append(ds, delivery{c, pat})
+			}
+		}
+	}
+	ps.mu.Unlock()
+
+	var message []byte // the same for every channel subscriber, so encoded once
+	for _, d := range ds {
+		if d.pattern == "" {
+			if message == nil {
+				message = encodeMessage([][]byte{[]byte("message"), []byte(channel), msg})
+			}
+			d.c.push(message)
+		} else {
+			d.c.push(encodeMessage([][]byte{[]byte("pmessage"), []byte(d.pattern), []byte(channel), msg}))
+		}
+	}
+	return len(ds)
+}
+
+// encodeMessage returns the push of the message made of parts.
+func encodeMessage(parts [][]byte) []byte {
+	return encoded(func(w *bufio.Writer) error { return resp.WriteArray(w, bulks(parts)) })
+}
+
+// subscribed reports whether c is in subscribe mode, where only the
+// commands in allowedSubscribed may be run.
+func (c *client) subscribed() bool {
+	return c.subscriptions() > 0
+}
+
+func (c *client) subscriptions() int {
+	return len(c.channels) + len(c.patterns)
+}
+
+var allowedSubscribed = map[string]bool{
+	"SUBSCRIBE": true, "UNSUBSCRIBE": true,
+	"PSUBSCRIBE": true, "PUNSUBSCRIBE": true,
+	"PING": true,
+}
+
+// subscriptionsOf returns c's set of channel or, for pattern, of pattern
+// subscriptions.
+func (c *client) subscriptionsOf(pattern bool) map[string]struct{} {
+	if pattern {
+		return c.patterns
+	}
+	return c.channels
+}
+
+// subscribe serves SUBSCRIBE and, with pattern, PSUBSCRIBE.
+func (c *client) subscribe(args []resp.Value, pattern bool) {
+	// SUBSCRIBE channel [channel ...] / PSUBSCRIBE pattern [pattern ...]
+	name := strings.ToLower(string(args[0].B))
+	if c.multi {
+		_ = resp.WriteError(c.w, "ERR Command not allowed inside a transaction")
+		c.dirty = true
+		return
+	}
+	mine := c.subscriptionsOf(pattern)
+	for _, a := range args[1:] {
+		if _, ok := mine[string(a.B)]; !ok {
+			mine[string(a.B)] = struct{}{}
+			c.srv.pubsub.subscribe(c, string(a.B), pattern)
+		}
+		writeSubscription(c.w, name, a.B, c.subscriptions())
+	}
+}
+
+// unsubscribe serves UNSUBSCRIBE and, with pattern, PUNSUBSCRIBE.
+func (c *client) unsubscribe(args []resp.Value, pattern bool) {
+	// UNSUBSCRIBE [channel ...] / PUNSUBSCRIBE [pattern ...]
+	name := strings.ToLower(string(args[0].B))
+	if c.multi {
+		_ = resp.WriteError(c.w, "ERR Command not allowed inside a transaction")
+		c.dirty = true
+		return
+	}
+	mine := c.subscriptionsOf(pattern)
+	names := args[1:]
+	if len(names) == 0 {
+		// from all of them, or a single reply if there are none
+		if len(mine) == 0 {
+			writeSubscription(c.w, name, nil, c.subscriptions())
+			return
+		}
+		for n := range mine {
+			names = append(names, resp.Value{T: resp.BulkString, B: []byte(n)})
+		}
+	}
+	for _, a := range names {
+		if _, ok := mine[string(a.B)]; ok {
+			delete(mine, string(a.B))
+			c.srv.pubsub.unsubscribe(c, string(a.B), pattern)
+		}
+		writeSubscription(c.w, name, a.B, c.subscriptions())
+	}
+}
+
+// unsubscribeAll drops all of c's subscriptions without replying, for when
+// the connection goes away.
+func (c *client) unsubscribeAll() {
+	for ch := range c.channels {
+		c.srv.pubsub.unsubscribe(c, ch, false)
+	}
+	for pat := range c.patterns {
+		c.srv.pubsub.unsubscribe(c, pat, true)
+	}
+	clear(c.channels)
+	clear(c.patterns)
+}
+
+// writeSubscription writes the confirmation of a (un)subscription: its kind,
+// the channel, and the number of subscriptions c is left with.
+func writeSubscription(w *bufio.Writer, kind string, channel []byte, n int) {
+	_ = resp.WriteArray(w, []resp.Value{
+		{T: resp.BulkString, B: []byte(kind)},
+		{T: resp.BulkString, B: channel},
+		{T: resp.Integer, I: int64(n)},
+	})
+}
+
+func handleSubscribedPing(w *bufio.Writer, args []resp.Value) {
+	// PING [message], in subscribe mode
+	msg := []byte{} // an empty string, not a null, without a message
+	if len(args) > 1 {
+		msg = args[1].B
+	}
+	_ = resp.WriteArray(w, bulks([][]byte{[]byte("pong"), msg}))
+}
+
+func handlePublish(w *bufio.Writer, st *Store, args []resp.Value) {
+	// PUBLISH channel message
+	n := st.srv.pubsub.publish(string(args[1].B), args[2].B)
+	_ = resp.WriteInteger(w, int64(n))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"log"
+	"sync"
+)
+
+// pushLimit is how much of what other clients push to a client, the
+// messages it subscribed to or the commands it monitors, may wait to be
+// sent before the client is dropped, as Redis's client-output-buffer-limit
+// for pubsub does.
+const pushLimit = 32 << 20
+
+// pushes holds what other clients push to a client until its own pusher
+// goroutine sends it, so a client that stops reading holds up only itself,
+// not the PUBLISH or the command that pushed to it.
+type pushes struct {
+	mu      sync.Mutex
+	pending []byte        // pushed but not yet sent
+	ready   chan struct{} // signalled when pending grows or the client goes
+	closed  bool
+	started sync.Once // the pusher goroutine starts with the first push
+}
+
+// push queues p, one or more whole replies, to be sent to c. A client that
+// lets more than pushLimit of them wait is disconnected.
+func (c *client) push(p []byte) {
+	ps := &c.pushes
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.closed {
+		return
+	}
+	if len(ps.pending)+len(p) > pushLimit {
+		log.Printf("dropping client %s, which fell behind reading what was pushed to it", c.addr())
+		ps.closeLocked()
+		_ = c.conn.Close()
+		return
+	}
+	ps.started.Do(func() { go c.sendPushes() })
+	ps.pending = append(ps.pending, p...)
+	ps.signal()
+}
+
+// stopPushes discards what is queued for c and stops its pusher, for when
+// the connection goes away.
+func (c *client) stopPushes() {
+	c.pushes.mu.Lock()
+	defer c.pushes.mu.Unlock()
+	c.pushes.closeLocked()
+}
+
+func (ps *pushes) closeLocked() {
+	if !ps.closed {
+		ps.closed = true
+		ps.pending = nil
+		ps.signal()
+	}
+}
+
+func (ps *pushes) signal() {
+	select {
+	case ps.ready <- struct{}{}:
+	default: // already signalled
+	}
+}
+
+// sendPushes is c's pusher: it writes what is queued for c until c goes
+// away or its connection fails. It takes c.wmu to write, so pushes don't
+// land in the middle of a reply.
+func (c *client) sendPushes() {
+	ps := &c.pushes
+	for range ps.ready {
+		ps.mu.Lock()
+		p, closed := ps.pending, ps.closed
+		ps.pending = nil
+		ps.mu.Unlock()
+		if closed {
+			return
+		}
+		c.wmu.Lock()
+		_, _ = c.w.Write(p)
+		err := c.w.Flush()
+		c.wmu.Unlock()
+		if err != nil {
+			c.stopPushes()
+			return
+		}
+	}
+}
+
+// encoded returns what write writes, for pushing.
+func encoded(write func(w *bufio.Writer) error) []byte {
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	_ = write(w)
+	_ = w.Flush() // a bytes.Buffer doesn't fail
+	return b.Bytes()
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// stalledClient returns a client of srv whose peer never reads, so that
+// writing to it blocks.
+func stalledClient(t *testing.T, srv *server) *client {
+	conn, peer := net.Pipe()
+	t.Cleanup(func() { _ = conn.Close(); _ = peer.Close() })
+	return newClient(conn, srv)
+}
+
+// within fails t unless f returns within a second.
+func within(t *testing.T, what string, f func()) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		f()
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("%s blocked on a client that doesn't read", what)
+	}
+}
+
+func TestPublishToStalledSubscriber(t *testing.T) {
+	srv := newTestServer(t)
+	c := stalledClient(t, srv)
+	srv.pubsub.subscribe(c, "ch", false)
+	srv.pubsub.subscribe(c, "c*", true)
+
+	msg := bytes.Repeat([]byte("x"), 1<<20)
+	within(t, "PUBLISH", func() {
+		for range pushLimit >> 20 {
+			srv.pubsub.publish("ch", msg)
+		}
+	})
+	c.pushes.mu.Lock()
+	closed := c.pushes.closed
+	c.pushes.mu.Unlock()
+	if !closed {
+		t.Error("a subscriber more than pushLimit behind wasn't dropped")
+	}
+	if _, err := c.conn.Write([]byte("x")); err == nil {
+		t.Error("the connection of a dropped subscriber is still open")
+	}
+}
+
+func TestFeedStalledMonitor(t *testing.T) {
+	srv := newTestServer(t)
+	m := stalledClient(t, srv)
+	m.monitor()
+	c := stalledClient(t, srv)
+	within(t, "a command", func() {
+		for range 1000 {
+			srv.feedMonitors(c, cmdArgs("SET", "k", "v"))
+		}
+	})
+}
+
+func TestPushesInOrder(t *testing.T) {
+	srv := newTestServer(t)
+	conn, peer := net.Pipe()
+	defer peer.Close()
+	c := newClient(conn, srv)
+	defer c.stopPushes()
+	srv.pubsub.subscribe(c, "ch", false)
+	for _, m := range []string{"one", "two", "three"} {
+		srv.pubsub.publish("ch", []byte(m))
+	}
+	want := "*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$3\r\none\r\n" +
+		"*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$3\r\ntwo\r\n" +
+		"*3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$5\r\nthree\r\n"
+	got := make([]byte, len(want))
+	_ = peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := io.ReadFull(bufio.NewReader(peer), got); err != nil || string(got) != want {
+		t.Errorf("the subscriber got %q, %v, want %q", got, err, want)
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"reditlite/resp"
+)
+
+// The snapshot file SAVE and BGSAVE write holds every live key with its
+// value and expiry:
+//
+//	"REDITLITE" version
+//	for each database with keys: dumpOpDB index
+//		for each key: kind exp key value
+//	dumpOpEOF crc
+//
+// Numbers are uvarints, except exp, a varint of the expiry in unix ms (0 for
+// none), zset scores, the 8 bytes of the float64 little-endian, and crc, the
+// CRC-32 of everything before it, 4 bytes little-endian. Strings are a
+// length then the bytes. A value is a string for KindString; for the other
+// kinds it is a count, then that many strings for a list or set, field and
+// value strings for a hash, and member strings each followed by its score
+// for a sorted set, in ascending order.
+const (
+	dumpMagic   = "REDITLITE"
+	dumpVersion = 1
+
+	dumpOpDB  = 0xFE
+	dumpOpEOF = 0xFF
+)
+
+var errBadDump = errors.New("malformed snapshot file")
+
+// dbDump is the keyspace of one database to write, shard by shard.
+type dbDump struct {
+	index  int
+	shards []map[string]Entry
+}
+
+// save writes a snapshot of every database, holding them all read-locked
+// for the length of it, so it is a single point in time.
+func (srv *server) save() error {
+	dumps := make([]dbDump, len(srv.dbs))
+	for i, db := range srv.dbs {
+		defer db.rlockAll()()
+		dumps[i] = dbDump{index: db.index, shards: make([]map[string]Entry, len(db.shards))}
+		for j, sh := range db.shards {
+			dumps[i].shards[j] = sh.data
+		}
+	}
+	return writeDump(srv.config.dumpPath(), dumps)
+}
+
+// bgsave copies every database, then writes the copy from a goroutine, so
+// clients only wait for the copy. It reports false if a save is already
+// running.
+func (srv *server) bgsave() bool {
+	if !srv.saving.CompareAndSwap(false, true) {
+		return false
+	}
+	dumps := srv.cloneDumps()
+	path := srv.config.dumpPath()
+	go func() {
+		defer srv.saving.Store(false)
+		if err := writeDump(path, dumps); err != nil {
+			log.Print("background save: ", err)
+			srv.lastSaveFailed.Store(true)
+			return
+		}
+		srv.saved()
+	}()
+	return true
+}
+
+// cloneDumps copies the live keys of every database, holding them all
+// read-locked for the length of it as save does, so the copy is of a single
+// point in time too.
+func (srv *server) cloneDumps() []dbDump {
+	now := time.Now().UnixMilli()
+	dumps := make([]dbDump, len(srv.dbs))
+	for i, db := range srv.dbs {
+		defer db.rlockAll()()
+		dumps[i] = dbDump{index: db.index, shards: make([]map[string]Entry, len(db.shards))}
+		for j, sh := range db.shards {
+			m := make(map[string]Entry, len(sh.data))
+			for k, e := range sh.data {
+				// values are changed in place, so copy them deep
+				if e.exp == 0 || now <= e.exp {
+					m[k] = e.clone()
+				}
+			}
+			dumps[i].shards[j] = m
+		}
+	}
+	return dumps
+}
+
+// saved records a successful save.
+func (srv *server) saved() {
+	srv.lastSave.Store(time.Now().Unix())
+	srv.lastSaveFailed.Store(false)
+}
+
+// writeDump writes dumps to path. It writes a temporary file next to it and
+// renames that over path, so a crash partway leaves the old snapshot whole.
+func writeDump(path string, dumps []dbDump) error {
+	f, err := os.CreateTemp(filepath.Dir(path), "temp-*.rdb")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name()) // fails harmlessly once renamed
+
+	if err := encodeDump(f, dumps); err != nil {
+		f.Close()
+		return err
+	}
+	// CreateTemp makes the file private, but the snapshot it replaces
+	// likely wasn't
+	if err := f.Chmod(0o644); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// encodeDump writes dumps to w in the snapshot format.
+func encodeDump(w io.Writer, dumps []dbDump) error {
+	crc := crc32.NewIEEE()
+	enc := &dumpEncoder{w: bufio.NewWriter(io.MultiWriter(w, crc))}
+	enc.w.WriteString(dumpMagic)
+	enc.uvarint(dumpVersion)
+	now := time.Now().UnixMilli()
+	for _, d := range dumps {
+		wrote := false
+		for _, m := range d.shards {
+			for k, e := range m {
+				if e.exp > 0 && now > e.exp {
+					continue
+				}
+				if !wrote {
+					enc.w.WriteByte(dumpOpDB)
+					enc.uvarint(uint64(d.index))
+					wrote = true
+				}
+				enc.entry(k, e)
+			}
+		}
+	}
+	enc.w.WriteByte(dumpOpEOF)
+	if err := enc.w.Flush(); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, crc.Sum32())
+}
+
+// dumpEncoder writes the parts of a snapshot. A bufio.Writer keeps its
+// first error, so the caller checks once, when flushing.
+type dumpEncoder struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (enc *dumpEncoder) uvarint(n uint64) {
+	enc.w.Write(binary.AppendUvarint(enc.buf[:0], n))
+}
+
+func (enc *dumpEncoder) bytes(b []byte) {
+	enc.uvarint(uint64(len(b)))
+	enc.w.Write(b)
+}
+
+func (enc *dumpEncoder) string(s string) {
+	enc.uvarint(uint64(len(s)))
+	enc.w.WriteString(s)
+}
+
+func (enc *dumpEncoder) entry(key string, e Entry) {
+	enc.w.WriteByte(byte(e.kind))
+	enc.w.Write(binary.AppendVarint(enc.buf[:0], e.exp))
+	enc.string(key)
+	switch e.kind {
+	case KindString:
+		enc.bytes(e.val)
+	case KindList:
+		enc.uvarint(uint64(len(e.list)))
+		for _, el := range e.list {
+			enc.bytes(el)
+		}
+	case KindHash:
+		enc.uvarint(uint64(len(e.hash)))
+		for f, v := range e.hash {
+			enc.string(f)
+			enc.bytes(v)
+		}
+	case KindSet:
+		enc.uvarint(uint64(len(e.set)))
+		for m := range e.set {
+			enc.string(m)
+		}
+	case KindZSet:
+		enc.uvarint(uint64(len(e.zset.items)))
+		for _, it := range e.zset.items {
+			enc.string(it.member)
+			enc.w.Write(binary.LittleEndian.AppendUint64(enc.buf[:0], math.Float64bits(it.score)))
+		}
+	}
+}
+
+// loadDump loads the snapshot at path into the databases, if there is one.
+func (srv *server) loadDump(path string) error {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return srv.loadSnapshot(data)
+}
+
+// loadSnapshot loads data, a snapshot, into the databases. Keys that have
+// expired since it was written are left out.
+func (srv *server) loadSnapshot(data []byte) error {
+	if len(data) < len(dumpMagic)+4 || string(data[:len(dumpMagic)]) != dumpMagic {
+		return errBadDump
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return errors.New("snapshot file checksum mismatch")
+	}
+	dec := &dumpDecoder{b: body[len(dumpMagic):]}
+	if v := dec.uvarint(); v != dumpVersion {
+		return fmt.Errorf("unsupported snapshot version %d", v)
+	}
+
+	now := time.Now().UnixMilli()
+	var db *Store
+	for dec.err == nil {
+		switch op := dec.byte(); {
+		case dec.err != nil:
+		case op == dumpOpEOF:
+			return nil
+		case op == dumpOpDB:
+			i := dec.uvarint()
+			if i >= uint64(len(srv.dbs)) {
+				return fmt.Errorf("snapshot has database %d, but there are only %d", i, len(srv.dbs))
+			}
+			db = srv.dbs[i]
+		case db == nil:
+			return errBadDump
+		default:
+			key, e := dec.entry(Kind(op))
+			if dec.err == nil && (e.exp == 0 || now <= e.exp) {
+				unlock := db.lock(key)
+				db.put(key, e)
+				unlock()
+			}
+		}
+	}
+	return dec.err
+}
+
+// dumpDecoder reads the parts of a snapshot from b. The first error is kept
+// in err, after which everything reads as zero.
+type dumpDecoder struct {
+	b   []byte
+	err error
+}
+
+func (dec *dumpDecoder) fail() {
+	if dec.err == nil {
+		dec.err = errBadDump
+	}
+	dec.b = nil
+}
+
+func (dec *dumpDecoder) byte() byte {
+	if len(dec.b) == 0 {
+		dec.fail()
+		return 0
+	}
+	c := dec.b[0]
+	dec.b = dec.b[1:]
+	return c
+}
+
+func (dec *dumpDecoder) uvarint() uint64 {
+	n, size := binary.Uvarint(dec.b)
+	if size <= 0 {
+		dec.fail()
+		return 0
+	}
+	dec.b = dec.b[size:]
+	return n
+}
+
+func (dec *dumpDecoder) varint() int64 {
+	n, size := binary.Varint(dec.b)
+	if size <= 0 {
+		dec.fail()
+		return 0
+	}
+	dec.b = dec.b[size:]
+	return n
+}
+
+func (dec *dumpDecoder) bytes() []byte {
+	n := dec.uvarint()
+	if n > uint64(len(dec.b)) {
+		dec.fail()
+		return nil
+	}
+	b := append([]byte{}, dec.b[:n]...) // don't pin the whole file
+	dec.b = dec.b[n:]
+	return b
+}
+
+// count reads the number of elements of a value. Each takes at least a
+// byte, which bounds what a corrupt count can make the caller allocate.
+func (dec *dumpDecoder) count() int {
+	n := dec.uvarint()
+	if n > uint64(len(dec.b)) {
+		dec.fail()
+		return 0
+	}
+	return int(n)
+}
+
+func (dec *dumpDecoder) entry(kind Kind) (string, Entry) {
+	e := Entry{kind: kind, exp: dec.varint()}
+	key := string(dec.bytes())
+	switch kind {
+	case KindString:
+		e.val = dec.bytes()
+	case KindList:
+		e.list = make([][]byte, dec.count())
+		for i := range e.list {
+			e.list[i] = dec.bytes()
+		}
+		e.elemSize = bytesSize(e.list)
+	case KindHash:
+		n := dec.count()
+		e.hash = make(map[string][]byte, n)
+		e.members = new(scanIndex)
+		for range n {
+			f := string(dec.bytes())
+			if old, dup := e.hash[f]; dup {
+				e.elemSize -= int64(len(old))
+			} else {
+				e.members.add(f)
+				e.elemSize += int64(len(f))
+			}
+			v := dec.bytes()
+			e.hash[f] = v
+			e.elemSize += int64(len(v))
+		}
+	case KindSet:
+		n := dec.count()
+		e.set = make(map[string]struct{}, n)
+		e.members = new(scanIndex)
+		for range n {
+			m := string(dec.bytes())
+			if _, dup := e.set[m]; !dup {
+				e.members.add(m)
+				e.elemSize += int64(len(m))
+			}
+			e.set[m] = struct{}{}
+		}
+	case KindZSet:
+		n := dec.count()
+		e.zset = newZSet()
+		for range n {
+			m := string(dec.bytes())
+			if len(dec.b) < 8 {
+				dec.fail()
+				break
+			}
+			if _, dup := e.zset.scores[m]; !dup {
+				e.elemSize += zitemSize(m)
+			}
+			e.zset.set(m, math.Float64frombits(binary.LittleEndian.Uint64(dec.b)))
+			dec.b = dec.b[8:]
+		}
+	default:
+		dec.fail()
+	}
+	return key, e
+}
+
+func handleSave(c *client, args []resp.Value) {
+	// SAVE
+	if c.srv.saving.Load() {
+		_ = resp.WriteError(c.w, "ERR Background save already in progress")
+		return
+	}
+	if err := c.srv.save(); err != nil {
+		log.Print("save: ", err)
+		_ = resp.WriteError(c.w, "ERR "+err.Error())
+		return
+	}
+	c.srv.saved()
+	_ = resp.WriteSimpleString(c.w, "OK")
+}
+
+func handleBGSave(c *client, args []resp.Value) {
+	// BGSAVE [SCHEDULE]
+	if len(args) == 2 && !strings.EqualFold(string(args[1].B), "SCHEDULE") {
+		_ = resp.WriteError(c.w, "ERR syntax error")
+		return
+	}
+	if !c.srv.bgsave() {
+		_ = resp.WriteError(c.w, "ERR Background save already in progress")
+		return
+	}
+	_ = resp.WriteSimpleString(c.w, "Background saving started")
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"maps"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fillForDump stores a key of every kind in srv, some with a TTL, and one
+// that has expired.
+func fillForDump(srv *server) {
+	st, other := srv.dbs[0], srv.dbs[3]
+	future := time.Now().Add(time.Hour).UnixMilli()
+	st.put("str", Entry{val: []byte("hello")})
+	st.put("bin", Entry{val: []byte("a\x00\r\n\xff"), exp: future})
+	st.put("empty", Entry{val: []byte{}})
+	_, _ = st.push("list", cmdArgs("a", "bb", "", "ccc"), false)
+	_, _ = st.hset("hash", cmdArgs("f1", "v1", "f2", ""))
+	_, _ = st.sadd("set", cmdArgs("x", "y", "z"))
+	_, _, _, _ = st.zadd("zset", cmdArgs("1.5", "a", "-inf", "b", "+inf", "c", "0", "d"), zaddOptions{})
+	_ = st.setExpiry("hash", future+1)
+	st.put("gone", Entry{val: []byte("expired"), exp: time.Now().Add(-time.Second).UnixMilli()})
+	other.put("elsewhere", Entry{val: []byte("db3")})
+}
+
+// sameEntry reports whether a and b hold the same value and expiry.
+func sameEntry(a, b Entry) bool {
+	if a.kind != b.kind || a.exp != b.exp {
+		return false
+	}
+	switch a.kind {
+	case KindString:
+		return bytes.Equal(a.val, b.val)
+	case KindList:
+		return slices.EqualFunc(a.list, b.list, bytes.Equal)
+	case KindHash:
+		return maps.EqualFunc(a.hash, b.hash, bytes.Equal)
+	case KindSet:
+		return maps.Equal(a.set, b.set)
+	case KindZSet:
+		return slices.Equal(a.zset.items, b.zset.items) && maps.Equal(a.zset.scores, b.zset.scores)
+	}
+	return false
+}
+
+// checkSameKeyspace fails t unless the live keys of want and got are the
+// same, with the same values, kinds and expiries.
+func checkSameKeyspace(t *testing.T, want, got *server) {
+	t.Helper()
+	now := time.Now().UnixMilli()
+	for i := range want.dbs {
+		for j, sh := range want.dbs[i].shards {
+			gsh := got.dbs[i].shards[j]
+			for k, e := range sh.data {
+				if e.exp > 0 && now > e.exp {
+					if _, ok := gsh.data[k]; ok {
+						t.Errorf("db %d: %s was expired but was loaded", i, k)
+					}
+					continue
+				}
+				g, ok := gsh.data[k]
+				switch {
+				case !ok:
+					t.Errorf("db %d: %s is missing", i, k)
+				case !sameEntry(e, g):
+					t.Errorf("db %d: %s = %+v, want %+v", i, k, g, e)
+				case g.size != countSize(k, g):
+					t.Errorf("db %d: %s is counted as %d bytes, but takes %d", i, k, g.size, countSize(k, g))
+				}
+			}
+		}
+		if n, m := want.dbs[i].size(), got.dbs[i].size(); n != m {
+			t.Errorf("db %d has %d keys, want %d", i, m, n)
+		}
+	}
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	srv := newTestServer(t)
+	fillForDump(srv)
+	if err := srv.save(); err != nil {
+		t.Fatal("SAVE: ", err)
+	}
+	loaded := newServer(srv.config)
+	if err := loaded.loadDump(srv.config.dumpPath()); err != nil {
+		t.Fatal("loading the snapshot: ", err)
+	}
+	checkSameKeyspace(t, srv, loaded)
+
+	// HSCAN and the others walk the loaded members
+	items, next, err := loaded.dbs[0].scanKey("hash", KindHash, 0, 10, "")
+	if err != nil || next != 0 || len(items) != 4 {
+		t.Errorf("HSCAN of the loaded hash = %q, %d, %v", items, next, err)
+	}
+}
+
+func TestBackgroundSnapshotRoundTrip(t *testing.T) {
+	srv := newTestServer(t)
+	fillForDump(srv)
+	if !srv.bgsave() {
+		t.Fatal("BGSAVE didn't start")
+	}
+	// change the keyspace while it saves; the snapshot is of before
+	want := newServer(srv.config)
+	if err := want.loadSnapshot(dumpOf(t, srv)); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = srv.dbs[0].push("list", cmdArgs("after"), false)
+	for deadline := time.Now().Add(5 * time.Second); srv.saving.Load(); {
+		if time.Now().After(deadline) {
+			t.Fatal("BGSAVE didn't finish")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if srv.lastSaveFailed.Load() {
+		t.Fatal("BGSAVE failed")
+	}
+	loaded := newServer(srv.config)
+	if err := loaded.loadDump(srv.config.dumpPath()); err != nil {
+		t.Fatal("loading the snapshot: ", err)
+	}
+	checkSameKeyspace(t, want, loaded)
+}
+
+// dumpOf returns srv's keyspace in the snapshot format.
+func dumpOf(t *testing.T, srv *server) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	if err := encodeDump(&b, srv.cloneDumps()); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestSnapshotChecksum(t *testing.T) {
+	srv := newTestServer(t)
+	fillForDump(srv)
+	data := dumpOf(t, srv)
+	for _, i := range []int{len(dumpMagic), len(data) / 2, len(data) - 5, len(data) - 1} {
+		bad := bytes.Clone(data)
+		bad[i] ^= 0x20
+		err := newTestServer(t).loadSnapshot(bad)
+		if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+			t.Errorf("loading with byte %d flipped: error = %v, want a checksum mismatch", i, err)
+		}
+	}
+}
+
+func TestSnapshotTruncated(t *testing.T) {
+	srv := newTestServer(t)
+	fillForDump(srv)
+	data := dumpOf(t, srv)
+	body := data[:len(data)-4]
+	for n := range len(body) {
+		// with a checksum made to match, so the decoder sees the truncation
+		cut := binary.LittleEndian.AppendUint32(bytes.Clone(body[:n]), crc32.ChecksumIEEE(body[:n]))
+		if err := newTestServer(t).loadSnapshot(cut); err == nil {
+			t.Errorf("loading the snapshot cut to %d of %d bytes succeeded", n, len(body))
+		}
+	}
+	for n := range len(data) {
+		if err := newTestServer(t).loadSnapshot(data[:n]); err == nil {
+			t.Errorf("loading the file cut to %d of %d bytes succeeded", n, len(data))
+		}
+	}
+}
+
+func TestLoadDumpMissing(t *testing.T) {
+	srv := newTestServer(t)
+	if err := srv.loadDump(srv.config.dumpPath()); err != nil {
+		t.Errorf("loading a snapshot that doesn't exist: %v", err)
+	}
+	if err := os.WriteFile(srv.config.dumpPath(), []byte("not a snapshot"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := srv.loadDump(srv.config.dumpPath()); err != errBadDump {
+		t.Errorf("loading a file that isn't a snapshot: error = %v, want %v", err, errBadDump)
+	}
+}
+
+// TestCloneDumpsPointInTime checks that the copy BGSAVE writes is of a
+// single point in time, with no SWAPDB landing partway through it.
+func TestCloneDumpsPointInTime(t *testing.T) {
+	srv := newTestServer(t)
+	srv.dbs[0].put("a", Entry{val: []byte("a")})
+	srv.dbs[1].put("b", Entry{val: []byte("b")})
+	for i := range 2000 { // so that a copy takes long enough to be cut into
+		srv.dbs[0].put("fill:"+strconv.Itoa(i), Entry{val: []byte("x")})
+	}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				swapDB(srv.dbs[0], srv.dbs[1])
+			}
+		}
+	}()
+	defer func() {
+		close(stop)
+		<-done
+	}()
+
+	has := func(d dbDump, key string) bool {
+		for _, m := range d.shards {
+			if _, ok := m[key]; ok {
+				return true
+			}
+		}
+		return false
+	}
+	for range 200 {
+		dumps := srv.cloneDumps()
+		a0, b0, a1, b1 := has(dumps[0], "a"), has(dumps[0], "b"), has(dumps[1], "a"), has(dumps[1], "b")
+		if a0 == a1 || b0 == b1 || a0 == b0 {
+			t.Fatalf("the copy has a in db 0: %v, db 1: %v, and b in db 0: %v, db 1: %v", a0, a1, b0, b1)
+		}
+	}
+}
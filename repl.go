@@ -0,0 +1,516 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand/v2"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"reditlite/resp"
+)
+
+// Replication follows Redis's: a replica connects to its master and sends
+// PSYNC, and the master replies with a snapshot of the keyspace, then sends
+// on the feed from that point, the stream the append-only file logs. A
+// dropped link is redialled and the snapshot sent afresh. The snapshot is in
+// redis-lite's own format, so master and replica must both be redis-lite.
+const (
+	replicaBufferLimit = 256 << 20        // how far a replica may fall behind before it is dropped
+	replPingPeriod     = 10 * time.Second // how often the master pings a replica it has nothing to send
+	replTimeout        = 60 * time.Second // how long a replica waits on a silent master
+)
+
+// replPing is what the master sends an idle replica to show the link is up,
+// and replGetAck what asks each replica to acknowledge what it has had.
+var (
+	replPing   = []byte("*1\r\n$4\r\nPING\r\n")
+	replGetAck = []byte("*3\r\n$8\r\nREPLCONF\r\n$6\r\nGETACK\r\n$1\r\n*\r\n")
+)
+
+// replica is a replica connected to this server, from the master's side.
+//
+// Offsets count the bytes of the feed sent a replica since its snapshot. A
+// replica acknowledges with REPLCONF ACK offset once a second, and when
+// sent REPLCONF GETACK, which is how WAIT learns what replicas have.
+type replica struct {
+	conn  net.Conn
+	acked atomic.Int64 // the offset the replica last acknowledged
+
+	mu      sync.Mutex
+	pending []byte        // fed but not yet sent
+	queued  int64         // the offset at the end of pending
+	ready   chan struct{} // signalled when pending grows or the link closes
+	closed  bool
+}
+
+// send queues p to be sent. A replica that falls too far behind is dropped,
+// to reconnect and start over from a snapshot.
+func (r *replica) send(p []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	if len(r.pending)+len(p) > replicaBufferLimit {
+		log.Printf("replication: dropping replica %s, which fell behind", r.conn.RemoteAddr())
+		r.closeLocked()
+		return
+	}
+	r.pending = append(r.pending, p...)
+	r.queued += int64(len(p))
+	r.signal()
+}
+
+// offset returns the offset of everything fed to r so far.
+func (r *replica) offset() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.queued
+}
+
+func (r *replica) close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closeLocked()
+}
+
+func (r *replica) closeLocked() {
+	if !r.closed {
+		r.closed = true
+		_ = r.conn.Close()
+		r.signal()
+	}
+}
+
+func (r *replica) signal() {
+	select {
+	case r.ready <- struct{}{}:
+	default: // already signalled
+	}
+}
+
+// serveReplica turns c's connection, on which a replica sent SYNC or PSYNC,
+// into its link: it sends the snapshot, then the feed, until the link drops.
+func (srv *server) serveReplica(c *client, psync bool) {
+	r := &replica{conn: c.conn, ready: make(chan struct{}, 1)}
+	// nothing changes between the copy being made and r being fed
+	srv.txmu.Lock()
+	dumps := srv.cloneDumps()
+	srv.feed.addReplica(r)
+	srv.txmu.Unlock()
+	defer srv.feed.removeReplica(r)
+	defer r.close()
+
+	var snap bytes.Buffer
+	_ = encodeDump(&snap, dumps) // a bytes.Buffer doesn't fail
+	if psync {
+		fmt.Fprintf(c.w, "+FULLRESYNC %s 0\r\n", srv.replid)
+	}
+	// a bulk string, without the CRLF after, as in Redis
+	fmt.Fprintf(c.w, "$%d\r\n", snap.Len())
+	_, _ = c.w.Write(snap.Bytes())
+	if err := c.w.Flush(); err != nil {
+		return
+	}
+	log.Printf("replication: replica %s synced", c.addr())
+
+	// a replica sends nothing that needs an answer, just its
+	// acknowledgements, and reading finds out when it hangs up; it is never
+	// idle for timeout
+	_ = c.conn.SetReadDeadline(time.Time{})
+	go func() {
+		defer r.close()
+		for {
+			v, err := resp.Read(c.r, resp.DefaultLimits)
+			if err != nil {
+				return
+			}
+			if len(v.A) == 3 && strings.EqualFold(string(v.A[0].B), "REPLCONF") && strings.EqualFold(string(v.A[1].B), "ACK") {
+				if n, err := strconv.ParseInt(string(v.A[2].B), 10, 64); err == nil {
+					r.acked.Store(n)
+					srv.feed.acked()
+				}
+			}
+		}
+	}()
+	idle := time.NewTimer(replPingPeriod)
+	defer idle.Stop()
+	for {
+		quitting := false
+		select {
+		case <-r.ready:
+		case <-idle.C:
+			r.send(replPing)
+		case <-srv.quit:
+			quitting = true // send what is pending, then hang up
+		}
+		r.mu.Lock()
+		p, closed := r.pending, r.closed
+		r.pending = nil
+		r.mu.Unlock()
+		if closed {
+			return
+		}
+		if _, err := c.conn.Write(p); err != nil || quitting {
+			return
+		}
+		idle.Reset(replPingPeriod)
+	}
+}
+
+// masterLink is a replica's link to its master.
+type masterLink struct {
+	host, port string
+	stop       chan struct{} // closed once the server stops following this master
+
+	mu   sync.Mutex
+	conn net.Conn    // the connection being made or used, nil between them
+	up   atomic.Bool // synced, and following the feed
+}
+
+func (l *masterLink) addr() string {
+	return net.JoinHostPort(l.host, l.port)
+}
+
+func (l *masterLink) stopped() bool {
+	select {
+	case <-l.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops l, hanging up on the master.
+func (l *masterLink) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	close(l.stop)
+	if l.conn != nil {
+		_ = l.conn.Close()
+	}
+}
+
+var errLinkStopped = errors.New("replication stopped")
+
+// replicaOf makes the server a replica of the master at host:port, or leaves
+// it following the one it does and reports true if that's the same.
+func (srv *server) replicaOf(host, port string) bool {
+	srv.masterMu.Lock()
+	defer srv.masterMu.Unlock()
+	if old := srv.master.Load(); old != nil {
+		if old.host == host && old.port == port {
+			return true
+		}
+		old.close()
+	}
+	l := &masterLink{host: host, port: port, stop: make(chan struct{})}
+	srv.master.Store(l)
+	go srv.replicate(l)
+	return false
+}
+
+// stopReplication makes the server a master again, keeping the keyspace as
+// it is. It reports whether it was a replica.
+func (srv *server) stopReplication() bool {
+	srv.masterMu.Lock()
+	defer srv.masterMu.Unlock()
+	l := srv.master.Swap(nil)
+	if l != nil {
+		l.close()
+	}
+	return l != nil
+}
+
+// replicating reports whether the server is a replica.
+func (srv *server) replicating() bool {
+	return srv.master.Load() != nil
+}
+
+// replicate follows the master of l until l is stopped, reconnecting a
+// second after the link drops.
+func (srv *server) replicate(l *masterLink) {
+	for {
+		err := srv.followMaster(l)
+		l.up.Store(false)
+		if l.stopped() {
+			return
+		}
+		log.Printf("replication: link to master %s down: %v", l.addr(), err)
+		select {
+		case <-l.stop:
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// followMaster connects to l's master, loads its snapshot and applies its
+// feed until the link fails or l is stopped.
+func (srv *server) followMaster(l *masterLink) error {
+	conn, err := net.DialTimeout("tcp", l.addr(), 5*time.Second)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	if l.stopped() {
+		l.mu.Unlock()
+		_ = conn.Close()
+		return errLinkStopped
+	}
+	l.conn = conn
+	l.mu.Unlock()
+	defer func() {
+		l.mu.Lock()
+		l.conn = nil
+		l.mu.Unlock()
+		_ = conn.Close()
+	}()
+
+	cr := &countingReader{r: conn}
+	r, w := bufio.NewReader(cr), bufio.NewWriter(conn)
+	ask := func(args ...string) (resp.Value, error) {
+		_ = conn.SetDeadline(time.Now().Add(replTimeout))
+		_ = resp.WriteArray(w, bulkStrings(args))
+		if err := w.Flush(); err != nil {
+			return resp.Value{}, err
+		}
+		v, err := resp.Read(r, resp.DefaultLimits)
+		if err == nil && v.T == resp.Error {
+			err = errors.New(v.S)
+		}
+		return v, err
+	}
+	if pass := srv.config.masterAuth(); pass != "" {
+		if _, err := ask("AUTH", pass); err != nil {
+			return err
+		}
+	}
+	if _, err := ask("PING"); err != nil {
+		return err
+	}
+	v, err := ask("PSYNC", "?", "-1")
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(v.S, "FULLRESYNC ") {
+		return fmt.Errorf("unexpected reply to PSYNC: %q", v.S)
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(line, "$"), "\r\n"))
+	if !strings.HasPrefix(line, "$") || err != nil || n < 0 {
+		return fmt.Errorf("bad snapshot length %q", line)
+	}
+	data := make([]byte, n)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return err
+	}
+	if err := srv.resync(l, data); err != nil {
+		return err
+	}
+	l.up.Store(true)
+	log.Printf("replication: synced with master %s", l.addr())
+
+	// the offset counts what has been read of the feed, from here on
+	start := cr.n - int64(r.Buffered())
+	var offset atomic.Int64
+	var wmu sync.Mutex // the acknowledgements come from two goroutines
+	ack := func() error {
+		wmu.Lock()
+		defer wmu.Unlock()
+		_ = resp.WriteArray(w, bulkStrings([]string{"REPLCONF", "ACK", strconv.FormatInt(offset.Load(), 10)}))
+		return w.Flush()
+	}
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		t := time.NewTicker(time.Second)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if ack() != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	a := newApplier(srv)
+	a.stop = l.stop
+	lim := resp.Limits{MaxBulkLen: math.MaxInt32, MaxArrayLen: math.MaxInt32}
+	for {
+		_ = conn.SetDeadline(time.Now().Add(replTimeout))
+		val, err := resp.Read(r, lim)
+		if err != nil {
+			return err
+		}
+		offset.Store(cr.n - int64(r.Buffered()) - start)
+		if isGetAck(val) {
+			// answered, not applied
+			if err := ack(); err != nil {
+				return err
+			}
+			continue
+		}
+		if err := a.apply(val); err != nil {
+			return fmt.Errorf("the master's feed %w", err)
+		}
+	}
+}
+
+// isGetAck reports whether val is REPLCONF GETACK.
+func isGetAck(val resp.Value) bool {
+	return len(val.A) >= 2 && strings.EqualFold(string(val.A[0].B), "REPLCONF") && strings.EqualFold(string(val.A[1].B), "GETACK")
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	cr.n += int64(n)
+	return n, err
+}
+
+// waitReplicas waits for want replicas to acknowledge everything fed to
+// them so far, or until timeout, 0 meaning for ever, and returns how many
+// have. Without block, or with no replicas, it returns at once.
+func (srv *server) waitReplicas(want int, timeout time.Duration, block bool) int {
+	targets := srv.feed.replicaOffsets()
+	count := func() int {
+		n := 0
+		for r, off := range targets {
+			if r.acked.Load() >= off {
+				n++
+			}
+		}
+		return n
+	}
+	n := count()
+	if !block || len(targets) == 0 || n >= want {
+		return n
+	}
+	srv.feed.getAck()
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+	for {
+		acked := srv.feed.nextAck() // taken before counting, so no ack is missed
+		if n = count(); n >= want {
+			return n
+		}
+		select {
+		case <-acked:
+		case <-expired:
+			return count()
+		case <-srv.quit:
+			return count()
+		}
+	}
+}
+
+func handleWait(c *client, args []resp.Value, block bool) {
+	// WAIT numreplicas timeout
+	want, err := strconv.Atoi(string(args[1].B))
+	if err != nil {
+		_ = resp.WriteError(c.w, errNotInteger.Error())
+		return
+	}
+	ms, err := strconv.ParseInt(string(args[2].B), 10, 64)
+	if err != nil {
+		_ = resp.WriteError(c.w, "ERR timeout is not an integer or out of range")
+		return
+	}
+	if ms < 0 {
+		_ = resp.WriteError(c.w, "ERR timeout is negative")
+		return
+	}
+	if c.srv.replicating() {
+		_ = resp.WriteError(c.w, "ERR WAIT cannot be used with replica instances")
+		return
+	}
+	if block {
+		// replies to commands pipelined ahead of this one must not wait
+		_ = c.w.Flush()
+	}
+	n := c.srv.waitReplicas(want, time.Duration(ms)*time.Millisecond, block)
+	_ = resp.WriteInteger(c.w, int64(n))
+}
+
+// resync replaces the keyspace with data, the master's snapshot.
+func (srv *server) resync(l *masterLink, data []byte) error {
+	srv.txmu.Lock()
+	defer srv.txmu.Unlock()
+	if l.stopped() {
+		return errLinkStopped
+	}
+	for _, db := range srv.dbs {
+		db.flush()
+	}
+	err := srv.loadSnapshot(data)
+	// the feed can only say the keyspace was swapped out as every key over
+	srv.feed.logCommand(0, "FLUSHALL")
+	srv.feed.logKeyspace(srv.dbs)
+	return err
+}
+
+// newReplID returns a random replication ID, 40 hex digits as in Redis.
+func newReplID() string {
+	var b [20]byte
+	for i := range b {
+		b[i] = byte(rand.Uint32())
+	}
+	return fmt.Sprintf("%x", b)
+}
+
+func handleReplicaOf(c *client, args []resp.Value) {
+	// REPLICAOF host port / REPLICAOF NO ONE
+	host, port := string(args[1].B), string(args[2].B)
+	if strings.EqualFold(host, "NO") && strings.EqualFold(port, "ONE") {
+		if c.srv.stopReplication() {
+			log.Print("replication: now a master")
+		}
+		_ = resp.WriteSimpleString(c.w, "OK")
+		return
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		_ = resp.WriteError(c.w, "ERR Invalid master port")
+		return
+	}
+	if c.srv.replicaOf(host, port) {
+		_ = resp.WriteSimpleString(c.w, "OK Already connected to specified master")
+		return
+	}
+	log.Printf("replication: following master %s", net.JoinHostPort(host, port))
+	_ = resp.WriteSimpleString(c.w, "OK")
+}
+
+func handleReplconf(c *client, args []resp.Value) {
+	// REPLCONF option value [option value ...]
+	if len(args) >= 2 && strings.EqualFold(string(args[1].B), "ACK") {
+		return // acknowledgements go unanswered
+	}
+	_ = resp.WriteSimpleString(c.w, "OK")
+}
@@ -6,9 +6,60 @@ import (
 	"errors"
 	"io"
 	"strconv"
+	"strings"
 )
 
-func Read(r *bufio.Reader) (Value, error) {
+// Limits bound the sizes Read accepts, so a peer can't make it allocate
+// without bound.
+type Limits struct {
+	MaxBulkLen  int // bytes in a bulk string
+	MaxArrayLen int // elements in an array
+}
+
+// DefaultLimits are Redis's defaults.
+var DefaultLimits = Limits{MaxBulkLen: 512 << 20, MaxArrayLen: 1 << 20}
+
+const (
+	// maxHeaderLen bounds the line of an integer, or of the length of a
+	// bulk string or array. No valid one comes near it.
+	maxHeaderLen = 32
+
+	// maxDepth bounds how deeply arrays nest, so that input can't make
+	// readValue recurse without end.
+	maxDepth = 32
+)
+
+// ProtocolError reports input that breaks the protocol. The stream can't be
+// resynchronised after one, so the connection should be closed.
+type ProtocolError struct {
+	Msg string
+}
+
+func (e *ProtocolError) Error() string { return "Protocol error: " + e.Msg }
+
+// Read reads one command or value within lim. A line that doesn't start
+// with a RESP prefix is read as an inline command, the way telnet and netcat
+// send them, and returned as an Array of BulkStrings.
+func Read(r *bufio.Reader, lim Limits) (Value, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return Value{}, err
+		}
+		switch b[0] {
+		case '+', '-', ':', '$', '*':
+			return readValue(r, lim, 0)
+		}
+		v, err := readInline(r)
+		if err != nil || len(v.A) > 0 {
+			return v, err
+		}
+		// an empty line is skipped, as Redis does
+	}
+}
+
+// readValue reads a value nested in depth arrays.
+func readValue(r *bufio.Reader, lim Limits, depth int) (Value, error) {
 	prefix, err := r.ReadByte()
 	if err != nil {
 		return Value{}, err
@@ -16,48 +67,255 @@ func Read(r *bufio.Reader) (Value, error) {
 
 	switch prefix {
 	case '+': // Simple String
-		line, _ := readLine(r)
+		line, err := readLine(r, maxInlineLen, errLineTooBig)
+		if err != nil {
+			return Value{}, err
+		}
 		return Value{T: SimpleString, S: line}, nil
 	case '-': // Error
-		line, _ := readLine(r)
+		line, err := readLine(r, maxInlineLen, errLineTooBig)
+		if err != nil {
+			return Value{}, err
+		}
 		return Value{T: Error, S: line}, nil
 	case ':': // Integer
-		line, _ := readLine(r)
-		n, _ := strconv.ParseInt(line, 10, 64)
+		line, err := readLine(r, maxHeaderLen, errBadInteger)
+		if err != nil {
+			return Value{}, err
+		}
+		n, err := strconv.ParseInt(line, 10, 64)
+		if err != nil {
+			return Value{}, errBadInteger
+		}
 		return Value{T: Integer, I: n}, nil
 	case '$': // Bulk String
-		nstr, _ := readLine(r)
-		n, _ := strconv.Atoi(nstr)
-		if n == -1 {
+		nstr, err := readLine(r, maxHeaderLen, errBadBulkLen)
+		if err != nil {
+			return Value{}, err
+		}
+		n, err := strconv.Atoi(nstr)
+		if err == nil && n == -1 {
 			return Value{T: BulkString, B: nil}, nil
 		} // Null bulk
+		if err != nil || n < 0 || n > lim.MaxBulkLen {
+			return Value{}, errBadBulkLen
+		}
 		buf := make([]byte, n+2)
 		if _, err := io.ReadFull(r, buf); err != nil {
-			return Value{}, err
+			return Value{}, noEOF(err)
+		}
+		if buf[n] != '\r' || buf[n+1] != '\n' {
+			return Value{}, errNoCRLF
 		}
 		return Value{T: BulkString, B: buf[:n]}, nil
 	case '*': // Array
-		nstr, _ := readLine(r)
-		n, _ := strconv.Atoi(nstr)
-		arr := make([]Value, n)
+		nstr, err := readLine(r, maxHeaderLen, errBadArrayLen)
+		if err != nil {
+			return Value{}, err
+		}
+		n, err := strconv.Atoi(nstr)
+		if err == nil && n == -1 {
+			return Value{T: Null}, nil
+		} // Null array
+		if err != nil || n < 0 || n > lim.MaxArrayLen {
+			return Value{}, errBadArrayLen
+		}
+		if depth == maxDepth {
+			return Value{}, errTooDeep
+		}
+		// grow as elements arrive rather than trusting n up front
+		arr := make([]Value, 0, min(n, 1024))
 		for i := 0; i < n; i++ {
-			v, err := Read(r)
+			v, err := readValue(r, lim, depth+1)
 			if err != nil {
-				return Value{}, err
+				return Value{}, noEOF(err)
 			}
-			arr[i] = v
+			arr = append(arr, v)
 		}
 		return Value{T: Array, A: arr}, nil
 	default:
-		return Value{}, errors.New("unknown RESP prefix")
+		return Value{}, &ProtocolError{"expected '$', got '" + string(prefix) + "'"}
+	}
+}
+
+// readLine reads a line of a RESP value, which must end in CRLF, failing
+// with tooLong if it runs past max bytes. The value's prefix has been read
+// already, so the stream ending here is unexpected.
+func readLine(r *bufio.Reader, max int, tooLong error) (string, error) {
+	b, err := readLineMax(r, max)
+	if err == errLineTooLong {
+		return "", tooLong
+	}
+	if err != nil {
+		return "", noEOF(err)
 	}
+	if !bytes.HasSuffix(b, []byte("\r\n")) {
+		return "", errNoCRLF
+	}
+	return string(b[:len(b)-2]), nil
+}
+
+var (
+	errNoCRLF      = &ProtocolError{"expected CRLF"}
+	errLineTooBig  = &ProtocolError{"too big line"}
+	errBadInteger  = &ProtocolError{"invalid integer"}
+	errBadBulkLen  = &ProtocolError{"invalid bulk length"}
+	errBadArrayLen = &ProtocolError{"invalid multibulk length"}
+	errTooDeep     = &ProtocolError{"arrays nested too deeply"}
+)
+
+// noEOF turns io.EOF into io.ErrUnexpectedEOF, for an input that ended
+// partway through a value.
+func noEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
 }
 
-func readLine(r *bufio.Reader) (string, error) {
-	b, err := r.ReadBytes('\n')
+// maxInlineLen bounds the length of an inline command, as in Redis.
+const maxInlineLen = 64 << 10
+
+var errLineTooLong = errors.New("line too long")
+
+// readLineMax reads up to and including the next '\n', but fails with
+// errLineTooLong once more than max bytes have gone by without one rather
+// than keep buffering them. The line returned may be r's own buffer, only
+// valid until the next read from r.
+func readLineMax(r *bufio.Reader, max int) ([]byte, error) {
+	var line []byte
+	for {
+		b, err := r.ReadSlice('\n')
+		if len(line)+len(b) > max {
+			return nil, errLineTooLong
+		}
+		if err != bufio.ErrBufferFull {
+			if line == nil {
+				return b, err
+			}
+			return append(line, b...), err
+		}
+		line = append(line, b...)
+	}
+}
+
+// readInline reads an inline command: a line of arguments separated by
+// whitespace, which may be quoted. Unlike RESP, the line may end in a bare
+// LF, as typed into netcat.
+func readInline(r *bufio.Reader) (Value, error) {
+	b, err := readLineMax(r, maxInlineLen)
+	if err == errLineTooLong {
+		return Value{}, errInlineTooBig
+	}
 	if err != nil {
-		return "", err
+		return Value{}, err
+	}
+	line := strings.TrimSuffix(strings.TrimSuffix(string(b), "\n"), "\r")
+	args, err := splitArgs(line)
+	if err != nil {
+		return Value{}, err
 	}
-	b = bytes.TrimSuffix(b, []byte("\r\n"))
-	return string(b), nil
+	v := Value{T: Array, A: make([]Value, len(args))}
+	for i, a := range args {
+		v.A[i] = Value{T: BulkString, B: a}
+	}
+	return v, nil
+}
+
+// splitArgs splits line into arguments the way Redis's sdssplitargs does.
+// Arguments are separated by whitespace. In double quotes, \n, \r, \t, \b,
+// \a and \xHH escapes are understood, and a backslash makes any other byte
+// literal; in single quotes only \' is an escape. A quote may open partway
+// through an argument, but a closing quote must be followed by whitespace or
+// the end of the line.
+func splitArgs(line string) ([][]byte, error) {
+	var args [][]byte
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+		var arg []byte
+		var quote byte
+		for {
+			if i == len(line) {
+				if quote != 0 {
+					return nil, errUnbalancedQuotes
+				}
+				break
+			}
+			c := line[i]
+			if quote == 0 {
+				if isSpace(c) {
+					break
+				}
+				if c == '"' || c == '\'' {
+					quote = c
+				} else {
+					arg = append(arg, c)
+				}
+				i++
+				continue
+			}
+			if c == quote {
+				i++
+				if i < len(line) && !isSpace(line[i]) {
+					return nil, errUnbalancedQuotes
+				}
+				break
+			}
+			if c == '\\' && i+1 < len(line) {
+				next := line[i+1]
+				switch {
+				case quote == '\'':
+					if next == '\'' {
+						c = '\''
+						i++
+					}
+				case next == 'x' && i+3 < len(line) && isHex(line[i+2]) && isHex(line[i+3]):
+					n, _ := strconv.ParseUint(line[i+2:i+4], 16, 8)
+					c = byte(n)
+					i += 3
+				default:
+					switch next {
+					case 'n':
+						c = '\n'
+					case 'r':
+						c = '\r'
+					case 't':
+						c = '\t'
+					case 'b':
+						c = '\b'
+					case 'a':
+						c = '\a'
+					default:
+						c = next
+					}
+					i++
+				}
+			}
+			arg = append(arg, c)
+			i++
+		}
+		if arg == nil {
+			arg = []byte{} // "" is an empty argument, not a missing one
+		}
+		args = append(args, arg)
+	}
+}
+
+var (
+	errInlineTooBig     = &ProtocolError{"too big inline request"}
+	errUnbalancedQuotes = &ProtocolError{"unbalanced quotes in request"}
+)
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
 }
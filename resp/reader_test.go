@@ -0,0 +1,265 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// read reads one value from in with the default limits.
+func read(in string) (Value, error) {
+	return Read(bufio.NewReader(strings.NewReader(in)), DefaultLimits)
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"PING", []string{"PING"}},
+		{"  set  a\tb  ", []string{"set", "a", "b"}},
+		{`SET k "hello world"`, []string{"SET", "k", "hello world"}},
+		{`SET k 'hello world'`, []string{"SET", "k", "hello world"}},
+		{`"a b" 'c d'`, []string{"a b", "c d"}},
+		{`foo"bar baz"`, []string{"foobar baz"}},
+		{`"a\"b"`, []string{`a"b`}},
+		{`"a\\b"`, []string{`a\b`}},
+		{`"\n\r\t\b\a"`, []string{"\n\r\t\b\a"}},
+		{`"\q"`, []string{"q"}},
+		{`"\x41\x7a\x00"`, []string{"Az\x00"}},
+		{`"\xZZ"`, []string{"xZZ"}},
+		{`"\x4"`, []string{"x4"}},
+		{`'it\'s'`, []string{"it's"}},
+		{`'a\nb'`, []string{`a\nb`}},
+		{`'a"b'`, []string{`a"b`}},
+		{`a\nb`, []string{`a\nb`}}, // no escapes outside quotes
+		{`""`, []string{""}},
+		{`a "" b`, []string{"a", "", "b"}},
+		{`''`, []string{""}},
+	}
+	for _, tt := range tests {
+		got, err := splitArgs(tt.line)
+		if err != nil {
+			t.Errorf("splitArgs(%q) error: %v", tt.line, err)
+			continue
+		}
+		if !slices.EqualFunc(got, tt.want, func(a []byte, b string) bool { return string(a) == b }) {
+			t.Errorf("splitArgs(%q) = %q, want %q", tt.line, got, tt.want)
+		}
+	}
+
+	for _, line := range []string{
+		`"abc`,
+		`'abc`,
+		`"abc"def`,
+		`'a'b`,
+		`"a\"`,
+		`a "b`,
+	} {
+		if _, err := splitArgs(line); err != errUnbalancedQuotes {
+			t.Errorf("splitArgs(%q) error = %v, want %v", line, err, errUnbalancedQuotes)
+		}
+	}
+}
+
+func TestReadInline(t *testing.T) {
+	for _, in := range []string{"SET k \"a b\"\r\n", "SET k \"a b\"\n", "\r\n\nSET k \"a b\"\n"} {
+		v, err := read(in)
+		if err != nil {
+			t.Errorf("Read(%q) error: %v", in, err)
+			continue
+		}
+		want := []string{"SET", "k", "a b"}
+		if v.T != Array || !slices.EqualFunc(v.A, want, func(a Value, b string) bool {
+			return a.T == BulkString && string(a.B) == b
+		}) {
+			t.Errorf("Read(%q) = %+v, want %q", in, v, want)
+		}
+	}
+
+	if _, err := read(strings.Repeat("a", maxInlineLen) + "\r\n"); err != errInlineTooBig {
+		t.Errorf("Read of a long inline request: error = %v, want %v", err, errInlineTooBig)
+	}
+	// one that never ends is turned away without reading it all
+	r := bufio.NewReader(endless{})
+	if _, err := Read(r, DefaultLimits); err != errInlineTooBig {
+		t.Errorf("Read of an endless inline request: error = %v, want %v", err, errInlineTooBig)
+	}
+	if _, err := read(strings.Repeat("a", maxInlineLen-2) + "\r\n"); err != nil {
+		t.Errorf("Read of an inline request just within the limit: %v", err)
+	}
+
+	var perr *ProtocolError
+	if _, err := read("GET \"k\r\n"); !errors.As(err, &perr) {
+		t.Errorf("Read of unbalanced quotes: error = %v, want a ProtocolError", err)
+	}
+}
+
+// endless is a reader of 'a's without end, such as a client that never
+// sends a newline.
+type endless struct{}
+
+func (endless) Read(p []byte) (int, error) {
+	for i := range p {
+		p[i] = 'a'
+	}
+	return len(p), nil
+}
+
+func TestReadLimits(t *testing.T) {
+	lim := Limits{MaxBulkLen: 4, MaxArrayLen: 2}
+	tests := []struct {
+		in      string
+		wantErr error
+	}{
+		{"$4\r\nabcd\r\n", nil},
+		{"$5\r\nabcde\r\n", errBadBulkLen},
+		{"$1000000000000\r\n", errBadBulkLen},
+		{"$99999999999999999999999\r\n", errBadBulkLen},
+		{"$" + strings.Repeat("1", 1000) + "\r\n", errBadBulkLen},
+		{"*2\r\n$1\r\na\r\n$1\r\nb\r\n", nil},
+		{"*3\r\n", errBadArrayLen},
+		{"*1000000000000\r\n", errBadArrayLen},
+		{"*" + strings.Repeat("1", 1000) + "\r\n", errBadArrayLen},
+		{":" + strings.Repeat("1", 1000) + "\r\n", errBadInteger},
+		{"+" + strings.Repeat("a", maxInlineLen) + "\r\n", errLineTooBig},
+		{"-" + strings.Repeat("a", maxInlineLen) + "\r\n", errLineTooBig},
+	}
+	for _, tt := range tests {
+		_, err := Read(bufio.NewReader(strings.NewReader(tt.in)), lim)
+		if err != tt.wantErr {
+			t.Errorf("Read(%.30q) error = %v, want %v", tt.in, err, tt.wantErr)
+		}
+	}
+}
+
+// TestReadEndlessHeader checks that a header that never ends is turned away
+// rather than read ever on.
+func TestReadEndlessHeader(t *testing.T) {
+	for _, tt := range []struct {
+		prefix  string
+		wantErr error
+	}{
+		{"$", errBadBulkLen},
+		{"*", errBadArrayLen},
+		{":", errBadInteger},
+		{"+", errLineTooBig},
+		{"*1\r\n$", errBadBulkLen},
+	} {
+		r := bufio.NewReader(io.MultiReader(strings.NewReader(tt.prefix), endless{}))
+		if _, err := Read(r, DefaultLimits); err != tt.wantErr {
+			t.Errorf("Read of %q and no end: error = %v, want %v", tt.prefix, err, tt.wantErr)
+		}
+	}
+}
+
+func TestReadNesting(t *testing.T) {
+	v, err := read(strings.Repeat("*1\r\n", maxDepth) + ":1\r\n")
+	if err != nil {
+		t.Fatalf("Read of %d nested arrays: %v", maxDepth, err)
+	}
+	for range maxDepth {
+		if v.T != Array || len(v.A) != 1 {
+			t.Fatalf("Read of nested arrays gave %+v", v)
+		}
+		v = v.A[0]
+	}
+	if v.T != Integer || v.I != 1 {
+		t.Errorf("innermost value = %+v, want :1", v)
+	}
+
+	if _, err := read(strings.Repeat("*1\r\n", maxDepth+1) + ":1\r\n"); err != errTooDeep {
+		t.Errorf("Read of %d nested arrays: error = %v, want %v", maxDepth+1, err, errTooDeep)
+	}
+	if _, err := read(strings.Repeat("*1\r\n", 1_000_000)); err != errTooDeep {
+		t.Errorf("Read of a million nested arrays: error = %v, want %v", err, errTooDeep)
+	}
+}
+
+func TestReadMalformed(t *testing.T) {
+	tests := []struct {
+		in      string
+		wantErr string
+	}{
+		{"$abc\r\n", "invalid bulk length"},
+		{"$-2\r\n", "invalid bulk length"},
+		{"$\r\n", "invalid bulk length"},
+		{"$1.5\r\n", "invalid bulk length"},
+		{"*-2\r\n", "invalid multibulk length"},
+		{"*abc\r\n", "invalid multibulk length"},
+		{"*\r\n", "invalid multibulk length"},
+		{":x\r\n", "invalid integer"},
+		{":\r\n", "invalid integer"},
+		{":12x\r\n", "invalid integer"},
+		{"*1\r\n@foo\r\n", "expected '$', got '@'"},
+		{"*2\r\n$1\r\na\r\nfoo\r\n", "expected '$', got 'f'"},
+	}
+	for _, tt := range tests {
+		_, err := read(tt.in)
+		var perr *ProtocolError
+		if !errors.As(err, &perr) || perr.Msg != tt.wantErr {
+			t.Errorf("Read(%q) error = %v, want Protocol error: %s", tt.in, err, tt.wantErr)
+		}
+	}
+}
+
+func TestReadNulls(t *testing.T) {
+	v, err := read("*-1\r\n")
+	if err != nil || v.T != Null {
+		t.Errorf("Read(*-1) = %+v, %v, want a Null", v, err)
+	}
+	v, err = read("$-1\r\n")
+	if err != nil || v.T != BulkString || v.B != nil {
+		t.Errorf("Read($-1) = %+v, %v, want a null BulkString", v, err)
+	}
+	v, err = read("$0\r\n\r\n")
+	if err != nil || v.T != BulkString || v.B == nil || len(v.B) != 0 {
+		t.Errorf("Read($0) = %+v, %v, want an empty BulkString", v, err)
+	}
+	v, err = read("*0\r\n")
+	if err != nil || v.T != Array || len(v.A) != 0 {
+		t.Errorf("Read(*0) = %+v, %v, want an empty Array", v, err)
+	}
+}
+
+func TestReadLineEnds(t *testing.T) {
+	tests := []struct {
+		in      string
+		wantErr error
+	}{
+		{"+OK\n", errNoCRLF},
+		{"-ERR x\n", errNoCRLF},
+		{":1\n", errNoCRLF},
+		{"$3\nabc\r\n", errNoCRLF},
+		{"*1\n$1\r\na\r\n", errNoCRLF},
+		{"$3\r\nabc\n\n", errNoCRLF},
+		{"$3\r\nabcX\r\n", errNoCRLF},
+
+		{"+OK", io.ErrUnexpectedEOF},
+		{"+OK\r", io.ErrUnexpectedEOF},
+		{"$3", io.ErrUnexpectedEOF},
+		{"$3\r\nab", io.ErrUnexpectedEOF},
+		{"$3\r\nabc", io.ErrUnexpectedEOF},
+		{"*1\r\n", io.ErrUnexpectedEOF},
+		{"*2\r\n$1\r\na\r\n", io.ErrUnexpectedEOF},
+		{"*2\r\n$1\r\na\r\n$1\r\n", io.ErrUnexpectedEOF},
+
+		{"", io.EOF}, // a stream ending between values ends cleanly
+	}
+	for _, tt := range tests {
+		v, err := read(tt.in)
+		if err != tt.wantErr {
+			t.Errorf("Read(%q) = %+v, %v, want error %v", tt.in, v, err, tt.wantErr)
+		}
+	}
+
+	v, err := read("+OK\r\n")
+	if err != nil || v.T != SimpleString || v.S != "OK" {
+		t.Errorf("Read(+OK) = %+v, %v", v, err)
+	}
+}
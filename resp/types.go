@@ -8,12 +8,21 @@ const (
 	Integer
 	BulkString
 	Array
+
+	// RESP3 types
+	Map       // A holds the keys and values, alternating
+	Set       // A holds the members
+	Double    // F
+	Boolean   // I, 1 for true and 0 for false
+	Null      // no payload
+	BigNumber // S holds the digits
 )
 
 type Value struct {
 	T Type
 	S string
 	I int64
+	F float64
 	B []byte
 	A []Value
 }
@@ -3,6 +3,8 @@ package resp
 import (
 	"bufio"
 	"fmt"
+	"math"
+	"strconv"
 )
 
 func WriteSimpleString(w *bufio.Writer, s string) error {
@@ -29,35 +31,140 @@ func WriteBulk(w *bufio.Writer, b []byte) error {
 	if err != nil {
 		return err
 	}
-	_, err = w.Write(append(b, '\r', '\n'))
+	// write b as it is: appending the CRLF to it could scribble over
+	// whatever shares its backing array
+	if _, err := w.Write(b); err != nil {
+		return err
+	}
+	_, err = w.WriteString("\r\n")
+	return err
+}
+
+// WriteNullArray writes the RESP2 null array, "*-1".
+func WriteNullArray(w *bufio.Writer) error {
+	_, err := fmt.Fprint(w, "*-1\r\n")
+	return err
+}
+
+// WriteArrayHeader writes only the length prefix of an array; the caller
+// writes the n elements after it.
+func WriteArrayHeader(w *bufio.Writer, n int) error {
+	_, err := fmt.Fprintf(w, "*%d\r\n", n)
+	return err
+}
+
+// WriteMapHeader writes only the length prefix of a RESP3 map; the caller
+// writes the n key/value pairs after it.
+func WriteMapHeader(w *bufio.Writer, n int) error {
+	_, err := fmt.Fprintf(w, "%%%d\r\n", n)
 	return err
 }
 
 func WriteArray(w *bufio.Writer, arr []Value) error {
-	_, err := fmt.Fprintf(w, "*%d\r\n", len(arr))
-	if err != nil {
+	if err := WriteArrayHeader(w, len(arr)); err != nil {
+		return err
+	}
+	return writeValues(w, arr)
+}
+
+// WriteMap writes a RESP3 map of the keys and values in kv, which alternate.
+func WriteMap(w *bufio.Writer, kv []Value) error {
+	if len(kv)%2 != 0 {
+		return fmt.Errorf("map with a key and no value")
+	}
+	if err := WriteMapHeader(w, len(kv)/2); err != nil {
+		return err
+	}
+	return writeValues(w, kv)
+}
+
+// WriteSet writes a RESP3 set of members.
+func WriteSet(w *bufio.Writer, members []Value) error {
+	if _, err := fmt.Fprintf(w, "~%d\r\n", len(members)); err != nil {
 		return err
 	}
-	for _, v := range arr {
-		switch v.T {
-		case SimpleString:
-			if err = WriteSimpleString(w, v.S); err != nil {
-				return err
-			}
-		case Error:
-			if err = WriteError(w, v.S); err != nil {
-				return err
-			}
-		case Integer:
-			if err = WriteInteger(w, v.I); err != nil {
-				return err
-			}
-		case BulkString:
-			if err = WriteBulk(w, v.B); err != nil {
-				return err
-			}
-		default:
-			return fmt.Errorf("unsupported nested type")
+	return writeValues(w, members)
+}
+
+// WriteDouble writes a RESP3 double, spelling infinities "inf" and "-inf".
+func WriteDouble(w *bufio.Writer, f float64) error {
+	var s string
+	switch {
+	case math.IsInf(f, 1):
+		s = "inf"
+	case math.IsInf(f, -1):
+		s = "-inf"
+	case math.IsNaN(f):
+		s = "nan"
+	default:
+		s = strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	_, err := fmt.Fprintf(w, ",%s\r\n", s)
+	return err
+}
+
+// WriteBoolean writes a RESP3 boolean, "#t" or "#f".
+func WriteBoolean(w *bufio.Writer, b bool) error {
+	c := 'f'
+	if b {
+		c = 't'
+	}
+	_, err := fmt.Fprintf(w, "#%c\r\n", c)
+	return err
+}
+
+// WriteNull writes the RESP3 null, "_", which stands for both the null bulk
+// string and the null array of RESP2.
+func WriteNull(w *bufio.Writer) error {
+	_, err := fmt.Fprint(w, "_\r\n")
+	return err
+}
+
+// WriteBigNumber writes a RESP3 big number from its decimal digits, with an
+// optional leading minus sign.
+func WriteBigNumber(w *bufio.Writer, digits string) error {
+	_, err := fmt.Fprintf(w, "(%s\r\n", digits)
+	return err
+}
+
+// WriteValue writes v, recursing into aggregates. An Array whose A is nil
+// is written as the null array, "*-1", and one whose A is empty as "*0".
+func WriteValue(w *bufio.Writer, v Value) error {
+	switch v.T {
+	case SimpleString:
+		return WriteSimpleString(w, v.S)
+	case Error:
+		return WriteError(w, v.S)
+	case Integer:
+		return WriteInteger(w, v.I)
+	case BulkString:
+		return WriteBulk(w, v.B)
+	case Array:
+		if v.A == nil {
+			return WriteNullArray(w)
+		}
+		return WriteArray(w, v.A)
+	case Map:
+		return WriteMap(w, v.A)
+	case Set:
+		return WriteSet(w, v.A)
+	case Double:
+		return WriteDouble(w, v.F)
+	case Boolean:
+		return WriteBoolean(w, v.I != 0)
+	case Null:
+		return WriteNull(w)
+	case BigNumber:
+		return WriteBigNumber(w, v.S)
+	default:
+		return fmt.Errorf("unsupported type %d", v.T)
+	}
+}
+
+func writeValues(w *bufio.Writer, vs []Value) error {
+	for _, v := range vs {
+		if err := WriteValue(w, v); err != nil {
+			return err
 		}
 	}
 	return nil
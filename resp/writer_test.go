@@ -0,0 +1,136 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+)
+
+// written returns what write writes.
+func written(t *testing.T, write func(w *bufio.Writer) error) string {
+	t.Helper()
+	var b bytes.Buffer
+	w := bufio.NewWriter(&b)
+	if err := write(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func bulk(s string) Value { return Value{T: BulkString, B: []byte(s)} }
+
+func TestWriteRESP3(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(w *bufio.Writer) error
+		want  string
+	}{
+		{"map", func(w *bufio.Writer) error {
+			return WriteMap(w, []Value{bulk("a"), {T: Integer, I: 1}, bulk("b"), bulk("x")})
+		}, "%2\r\n$1\r\na\r\n:1\r\n$1\r\nb\r\n$1\r\nx\r\n"},
+		{"empty map", func(w *bufio.Writer) error { return WriteMap(w, nil) }, "%0\r\n"},
+		{"map header", func(w *bufio.Writer) error { return WriteMapHeader(w, 3) }, "%3\r\n"},
+		{"set", func(w *bufio.Writer) error {
+			return WriteSet(w, []Value{bulk("a"), bulk("bc")})
+		}, "~2\r\n$1\r\na\r\n$2\r\nbc\r\n"},
+		{"empty set", func(w *bufio.Writer) error { return WriteSet(w, []Value{}) }, "~0\r\n"},
+		{"double", func(w *bufio.Writer) error { return WriteDouble(w, 1.5) }, ",1.5\r\n"},
+		{"integral double", func(w *bufio.Writer) error { return WriteDouble(w, 3) }, ",3\r\n"},
+		{"negative double", func(w *bufio.Writer) error { return WriteDouble(w, -0.25) }, ",-0.25\r\n"},
+		{"large double", func(w *bufio.Writer) error { return WriteDouble(w, 1e300) }, ",1e+300\r\n"},
+		{"inf", func(w *bufio.Writer) error { return WriteDouble(w, math.Inf(1)) }, ",inf\r\n"},
+		{"-inf", func(w *bufio.Writer) error { return WriteDouble(w, math.Inf(-1)) }, ",-inf\r\n"},
+		{"nan", func(w *bufio.Writer) error { return WriteDouble(w, math.NaN()) }, ",nan\r\n"},
+		{"true", func(w *bufio.Writer) error { return WriteBoolean(w, true) }, "#t\r\n"},
+		{"false", func(w *bufio.Writer) error { return WriteBoolean(w, false) }, "#f\r\n"},
+		{"null", WriteNull, "_\r\n"},
+		{"big number", func(w *bufio.Writer) error {
+			return WriteBigNumber(w, "3492890328409238509324850943850943825024385")
+		}, "(3492890328409238509324850943850943825024385\r\n"},
+		{"negative big number", func(w *bufio.Writer) error { return WriteBigNumber(w, "-12345678901234567890") }, "(-12345678901234567890\r\n"},
+		{"values", func(w *bufio.Writer) error {
+			return WriteValue(w, Value{T: Map, A: []Value{
+				bulk("d"), {T: Double, F: 2.5},
+				bulk("b"), {T: Boolean, I: 1},
+				bulk("n"), {T: Null},
+				bulk("s"), {T: Set, A: []Value{{T: BigNumber, S: "7"}}},
+			}})
+		}, "%4\r\n$1\r\nd\r\n,2.5\r\n$1\r\nb\r\n#t\r\n$1\r\nn\r\n_\r\n$1\r\ns\r\n~1\r\n(7\r\n"},
+	}
+	for _, tt := range tests {
+		if got := written(t, tt.write); got != tt.want {
+			t.Errorf("%s: wrote %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWriteMapOddLength(t *testing.T) {
+	var b bytes.Buffer
+	if err := WriteMap(bufio.NewWriter(&b), []Value{bulk("key")}); err == nil {
+		t.Error("WriteMap wrote a key without a value")
+	}
+}
+
+// TestWriteBulkKeepsSlice checks that WriteBulk leaves what is past the end
+// of the slice it writes alone, as other values may share the array.
+func TestWriteBulkKeepsSlice(t *testing.T) {
+	backing := []byte("helloXYZ")
+	b := backing[:5] // spare capacity over "XYZ"
+	got := written(t, func(w *bufio.Writer) error { return WriteBulk(w, b) })
+	if got != "$5\r\nhello\r\n" {
+		t.Errorf("WriteBulk wrote %q", got)
+	}
+	if string(backing) != "helloXYZ" || len(b) != 5 || cap(b) != 8 {
+		t.Errorf("WriteBulk changed its argument: %q, len %d, cap %d", backing, len(b), cap(b))
+	}
+
+	if got := written(t, func(w *bufio.Writer) error { return WriteBulk(w, nil) }); got != "$-1\r\n" {
+		t.Errorf("WriteBulk(nil) wrote %q", got)
+	}
+	if got := written(t, func(w *bufio.Writer) error { return WriteBulk(w, []byte{}) }); got != "$0\r\n\r\n" {
+		t.Errorf("WriteBulk of an empty slice wrote %q", got)
+	}
+}
+
+func TestWriteValueNested(t *testing.T) {
+	v := Value{T: Array, A: []Value{
+		bulk("top"),
+		{T: Array, A: []Value{
+			{T: Integer, I: -7},
+			{T: Array, A: []Value{bulk("deep"), {T: SimpleString, S: "OK"}}},
+			{T: Array},      // the null array
+			{T: BulkString}, // the null bulk
+		}},
+		{T: Array, A: []Value{}},
+		{T: Error, S: "ERR no"},
+	}}
+	want := "*4\r\n$3\r\ntop\r\n" +
+		"*4\r\n:-7\r\n*2\r\n$4\r\ndeep\r\n+OK\r\n*-1\r\n$-1\r\n" +
+		"*0\r\n-ERR no\r\n"
+	if got := written(t, func(w *bufio.Writer) error { return WriteValue(w, v) }); got != want {
+		t.Errorf("wrote %q, want %q", got, want)
+	}
+
+	// and reads back as it was, but for the null array, which comes back Null
+	back, err := Read(bufio.NewReader(strings.NewReader(want)), DefaultLimits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inner := back.A[1].A; len(back.A) != 4 || len(inner) != 4 || inner[2].T != Null ||
+		string(inner[1].A[0].B) != "deep" || inner[3].B != nil {
+		t.Errorf("read back %+v", back)
+	}
+}
+
+func TestWriteValueUnsupported(t *testing.T) {
+	var b bytes.Buffer
+	v := Value{T: Array, A: []Value{bulk("a"), {T: Array, A: []Value{{T: Type(99)}}}}}
+	if err := WriteValue(bufio.NewWriter(&b), v); err == nil {
+		t.Error("WriteValue wrote a value of an unknown type")
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"hash/fnv"
+	"math/bits"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"reditlite/resp"
+)
+
+// Scan cursors are positions in a scanIndex, which groups names into
+// buckets by their hash. A call visits whole buckets from the cursor on, and
+// the next cursor names the bucket after the last one visited. Buckets are
+// taken in the order of their numbers with the bits reversed, as in Redis's
+// dictScan, so that when the index doubles or halves between calls the
+// buckets already visited map onto buckets the cursor has passed: a full
+// scan visits every name that is present for its whole duration, though a
+// name may come up twice if the index shrinks.
+
+// parseScanOptions parses the MATCH and COUNT modifiers shared by the SCAN
+// family. An empty pattern means no filtering; count defaults to 10.
+func parseScanOptions(opts []resp.Value) (pattern string, count int, err error) {
+	count = 10
+	for i := 0; i < len(opts); i += 2 {
+		if i+1 >= len(opts) {
+			return "", 0, errors.New("ERR syntax error")
+		}
+		switch strings.ToUpper(string(opts[i].B)) {
+		case "MATCH":
+			pattern = string(opts[i+1].B)
+			if pattern == "*" {
+				pattern = ""
+			}
+		case "COUNT":
+			count, err = strconv.Atoi(string(opts[i+1].B))
+			if err != nil {
+				return "", 0, errNotInteger
+			}
+			if count < 1 {
+				return "", 0, errors.New("ERR syntax error")
+			}
+		default:
+			return "", 0, errors.New("ERR syntax error")
+		}
+	}
+	return pattern, count, nil
+}
+
+func scanHash(name string) uint64 {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(name))
+	return h.Sum64()
+}
+
+// scanIndex is the index SCAN walks: the names of a keyspace shard or of a
+// collection's elements, in buckets picked by the low bits of their hash.
+// The zero value is empty and ready to use.
+type scanIndex struct {
+	buckets [][]scanName // a power of two of them, or none
+	n       int
+}
+
+type scanName struct {
+	h    uint64
+	name string
+}
+
+// add adds name, which must not be in x already.
+func (x *scanIndex) add(name string) {
+	if x.n >= len(x.buckets) {
+		x.resize(max(2*len(x.buckets), 4))
+	}
+	h := scanHash(name)
+	b := h & uint64(len(x.buckets)-1)
+	x.buckets[b] = append(x.buckets[b], scanName{h, name})
+	x.n++
+}
+
+// remove removes name if x holds it.
+func (x *scanIndex) remove(name string) {
+	if x.n == 0 {
+		return
+	}
+	b := &x.buckets[scanHash(name)&uint64(len(x.buckets)-1)]
+	i := slices.IndexFunc(*b, func(sn scanName) bool { return sn.name == name })
+	if i < 0 {
+		return
+	}
+	*b = slices.Delete(*b, i, i+1)
+	x.n--
+	if len(x.buckets) > 4 && x.n < len(x.buckets)/4 {
+		x.resize(len(x.buckets) / 2)
+	}
+}
+
+// resize spreads the names over size buckets.
+func (x *scanIndex) resize(size int) {
+	buckets := make([][]scanName, size)
+	for _, b := range x.buckets {
+		for _, sn := range b {
+			i := sn.h & uint64(size-1)
+			buckets[i] = append(buckets[i], sn)
+		}
+	}
+	x.buckets = buckets
+}
+
+// clone returns a copy of x that shares no memory with it.
+func (x *scanIndex) clone() *scanIndex {
+	c := &scanIndex{buckets: make([][]scanName, len(x.buckets)), n: x.n}
+	for i, b := range x.buckets {
+		c.buckets[i] = slices.Clone(b)
+	}
+	return c
+}
+
+// scan calls fn with each name in the buckets from cursor on, stopping
+// after the bucket at which it has been called count times, and returns the
+// cursor of the bucket to resume from, 0 once the last has been visited.
+// So that a call over a sparse index stays short, it also stops after
+// visiting 10*count buckets, empty or not.
+func (x *scanIndex) scan(cursor uint64, count int, fn func(name string)) uint64 {
+	if len(x.buckets) == 0 {
+		return 0
+	}
+	mask := uint64(len(x.buckets) - 1)
+	seen := 0
+	for visited := 1; ; visited++ {
+		for _, sn := range x.buckets[cursor&mask] {
+			fn(sn.name)
+			seen++
+		}
+		// step to the next bucket by adding one to the reversed bits
+		cursor = bits.Reverse64(bits.Reverse64(cursor|^mask) + 1)
+		if cursor == 0 || seen >= count || visited >= 10*count {
+			return cursor
+		}
+	}
+}
+
+// scan returns the live keys in the next batch of buckets from cursor, and
+// the cursor to resume from. The shards are scanned one after another, the
+// low bits of the cursor holding the shard and the rest the position in its
+// index, and each is read-locked only while it is scanned.
+func (s *Store) scan(cursor uint64, count int) ([]string, uint64) {
+	shardBits := bits.TrailingZeros(uint(len(s.shards)))
+	i := int(cursor & uint64(len(s.shards)-1))
+	cursor >>= shardBits
+	now := time.Now().UnixMilli()
+	var keys []string
+	seen := 0
+	for {
+		sh := s.shards[i]
+		sh.mu.RLock()
+		cursor = sh.keys.scan(cursor, count-seen, func(k string) {
+			seen++
+			if e := sh.data[k]; e.exp == 0 || now <= e.exp {
+				keys = append(keys, k)
+			}
+		})
+		sh.mu.RUnlock()
+		if cursor != 0 {
+			return keys, cursor<<shardBits | uint64(i)
+		}
+		if i++; i == len(s.shards) {
+			return keys, 0
+		}
+		if seen >= count {
+			return keys, uint64(i)
+		}
+	}
+}
+
+// scanKey is SCAN over the elements of the hash, set or sorted set at key,
+// which must be of kind k: a hash's fields or a set's or sorted set's
+// members, each followed in the result by its value or score if it has one.
+// A missing key scans as empty.
+func (s *Store) scanKey(key string, k Kind, cursor uint64, count int, pattern string) ([][]byte, uint64, error) {
+	defer s.rlock(key)()
+
+	e, ok, err := s.lookupRead(key, k)
+	if !ok {
+		return nil, 0, err
+	}
+	members := e.members
+	if k == KindZSet {
+		members = &e.zset.members
+	}
+	var out [][]byte
+	next := members.scan(cursor, count, func(n string) {
+		if pattern != "" && !matchPattern(pattern, n) {
+			return
+		}
+		out = append(out, []byte(n))
+		switch k {
+		case KindHash:
+			out = append(out, e.hash[n])
+		case KindZSet:
+			out = append(out, []byte(formatScore(e.zset.scores[n])))
+		}
+	})
+	return out, next, nil
+}
+
+func handleKeyScan(w *bufio.Writer, st *Store, args []resp.Value, k Kind) {
+	// HSCAN key cursor [MATCH pattern] [COUNT count], and SSCAN and ZSCAN
+	// likewise
+	cursor, err := strconv.ParseUint(string(args[2].B), 10, 64)
+	if err != nil {
+		_ = resp.WriteError(w, "ERR invalid cursor")
+		return
+	}
+	pattern, count, err := parseScanOptions(args[3:])
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	items, next, err := st.scanKey(string(args[1].B), k, cursor, count, pattern)
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	_ = resp.WriteArrayHeader(w, 2)
+	_ = resp.WriteBulk(w, []byte(strconv.FormatUint(next, 10)))
+	_ = resp.WriteArray(w, bulks(items))
+}
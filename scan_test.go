@@ -0,0 +1,60 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+// TestScanIndexResize checks that a full scan visits every name present for
+// its whole duration while the index grows and shrinks between calls.
+func TestScanIndexResize(t *testing.T) {
+	var x scanIndex
+	for i := range 1000 {
+		x.add("keep" + strconv.Itoa(i))
+	}
+	seen := make(map[string]bool)
+	added := 0
+	cursor, calls := uint64(0), 0
+	for {
+		cursor = x.scan(cursor, 10, func(name string) { seen[name] = true })
+		calls++
+		switch {
+		case calls < 20: // grow
+			for range 300 {
+				x.add("tmp" + strconv.Itoa(added))
+				added++
+			}
+		case calls == 20: // and shrink back again
+			for i := range added {
+				x.remove("tmp" + strconv.Itoa(i))
+			}
+		}
+		if cursor == 0 {
+			break
+		}
+	}
+	for i := range 1000 {
+		if name := "keep" + strconv.Itoa(i); !seen[name] {
+			t.Errorf("scan missed %s", name)
+		}
+	}
+	if x.n != 1000 {
+		t.Errorf("index holds %d names, want 1000", x.n)
+	}
+}
+
+func TestScanIndexRemove(t *testing.T) {
+	var x scanIndex
+	x.remove("absent") // on an empty index
+	x.add("a")
+	x.add("b")
+	x.remove("a")
+	x.remove("a")
+	var got []string
+	if next := x.scan(0, 10, func(name string) { got = append(got, name) }); next != 0 {
+		t.Errorf("scan of a one-name index returned cursor %d, want 0", next)
+	}
+	if len(got) != 1 || got[0] != "b" {
+		t.Errorf("scan = %q, want [b]", got)
+	}
+}
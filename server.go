@@ -0,0 +1,186 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"reditlite/resp"
+)
+
+// serverVersion is the Redis version redis-lite reports itself as, for
+// clients that check it.
+const serverVersion = "7.2.0"
+
+// server is the state shared by every connection: the databases and what
+// spans them.
+type server struct {
+	dbs []*Store
+
+	usedMemory atomic.Int64 // what every database's entries take, for maxmemory
+
+	// txmu is held for reading while a command runs and for writing while
+	// EXEC runs a transaction, so no other command interleaves with one.
+	txmu sync.RWMutex
+
+	// logmu holds a lock for each shard index, the same shard of every
+	// database. While the feed is on, a write holds those of its keys from
+	// before it runs until it is fed, and so does whatever else feeds a
+	// change, so changes to a key are fed in the order they were made
+	// while writes to other shards go on alongside. They are taken after
+	// txmu and before any shard's lock.
+	logmu []sync.Mutex
+
+	freeq chan []Entry // entries removed by UNLINK, released by the reclaimer
+
+	pubsub *pubsub // Pub/Sub subscriptions
+	config *config
+
+	monitorsMu   sync.Mutex
+	monitors     map[*client]struct{} // clients in MONITOR mode
+	monitorCount atomic.Int32         // len(monitors), to skip the lock when 0
+
+	clientsMu    sync.Mutex
+	clients      map[int64]*client // connected clients, by id
+	nextClientID atomic.Int64
+	connected    atomic.Int64 // connections open, for maxclients
+
+	saving         atomic.Bool  // a BGSAVE is writing the snapshot
+	lastSave       atomic.Int64 // unix time of the last successful save
+	lastSaveFailed atomic.Bool  // the last BGSAVE failed
+
+	feed    *feed        // the changes made, for the append-only file and replicas
+	replid  string       // this server's replication ID, for PSYNC
+	dirty   atomic.Int64 // changes made to the keyspace, for telling writes that changed nothing
+	loading atomic.Bool  // applying fed commands, during which keys don't expire
+
+	masterMu sync.Mutex                 // serializes REPLICAOF
+	master   atomic.Pointer[masterLink] // the master followed, nil if this is one
+
+	quit chan struct{} // closed once the server begins to shut down
+
+	started time.Time // when the server started, for uptime
+	stats   stats
+	slowlog slowlog
+}
+
+// stats are the counters INFO reports. They are updated from every
+// connection, so they are atomic.
+type stats struct {
+	totalConnections atomic.Int64
+	rejected         atomic.Int64 // connections turned away for maxclients
+	commands         atomic.Int64 // commands processed
+	hits, misses     atomic.Int64 // keys found and not found by reads
+	expiredKeys      atomic.Int64 // keys removed for having expired
+	evictedKeys      atomic.Int64 // keys removed for maxmemory
+}
+
+// lookedUp counts a read of a key as a hit if it was found, else a miss.
+func (s *stats) lookedUp(found bool) {
+	if found {
+		s.hits.Add(1)
+	} else {
+		s.misses.Add(1)
+	}
+}
+
+func newServer(cfg *config) *server {
+	srv := &server{
+		pubsub:   newPubSub(),
+		feed:     newFeed(),
+		replid:   newReplID(),
+		config:   cfg,
+		clients:  make(map[int64]*client),
+		monitors: make(map[*client]struct{}),
+		quit:     make(chan struct{}),
+		started:  time.Now(),
+		logmu:    make([]sync.Mutex, cfg.shards),
+	}
+	srv.lastSave.Store(srv.started.Unix())
+	srv.dbs = make([]*Store, cfg.databases)
+	for i := range srv.dbs {
+		srv.dbs[i] = newStore(srv, i, cfg.shards)
+	}
+	return srv
+}
+
+// db returns the database numbered by arg.
+func (srv *server) db(arg []byte) (*Store, error) {
+	i, err := strconv.Atoi(string(arg))
+	if err != nil {
+		return nil, errNotInteger
+	}
+	if i < 0 || i >= len(srv.dbs) {
+		return nil, errDBIndex
+	}
+	return srv.dbs[i], nil
+}
+
+func handleSelect(c *client, args []resp.Value) {
+	// SELECT index
+	db, err := c.srv.db(args[1].B)
+	if err != nil {
+		_ = resp.WriteError(c.w, err.Error())
+		return
+	}
+	c.srv.clientsMu.Lock()
+	c.db = db
+	c.srv.clientsMu.Unlock()
+	_ = resp.WriteSimpleString(c.w, "OK")
+}
+
+// swapDB swaps the contents of a and b. Clients keep their SELECTed
+// database, so those in either see the other's keys from their next command.
+func swapDB(a, b *Store) {
+	if a == b {
+		return
+	}
+	// lock in index order so two concurrent swaps cannot deadlock
+	if a.index > b.index {
+		a, b = b, a
+	}
+	defer a.lockAll()()
+	defer b.lockAll()()
+
+	a.srv.dirty.Add(1)
+	// a key is in the same shard in every store, so the shards can trade
+	// data pairwise; waiters and watchers stay with their store
+	for i := range a.shards {
+		sa, sb := a.shards[i], b.shards[i]
+		sa.changes.Add(1)
+		sa.data, sb.data = sb.data, sa.data
+		sa.expires, sb.expires = sb.expires, sa.expires
+		sa.keys, sb.keys = sb.keys, sa.keys
+		sa.used, sb.used = sb.used, sa.used
+	}
+	for _, s := range []*Store{a, b} {
+		for _, sh := range s.shards {
+			for _, wk := range sh.watched {
+				wk.version++
+			}
+			// a client blocked on a key that now holds a list can pop it
+			for k := range sh.waiters {
+				if _, ok := s.lookup(k); ok {
+					s.signalReady(k)
+				}
+			}
+		}
+	}
+}
+
+func handleSwapDB(c *client, args []resp.Value) {
+	// SWAPDB index1 index2
+	a, err := c.srv.db(args[1].B)
+	if err != nil {
+		_ = resp.WriteError(c.w, err.Error())
+		return
+	}
+	b, err := c.srv.db(args[2].B)
+	if err != nil {
+		_ = resp.WriteError(c.w, err.Error())
+		return
+	}
+	swapDB(a, b)
+	_ = resp.WriteSimpleString(c.w, "OK")
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"maps"
+	"math/rand/v2"
+	"slices"
+	"strconv"
+
+	"reditlite/resp"
+)
+
+// sadd adds members to the set at key, creating it if needed, and returns
+// how many were not already present.
+func (s *Store) sadd(key string, members []resp.Value) (int, error) {
+	defer s.lock(key)()
+
+	e, ok, err := s.lookupKind(key, KindSet)
+	if err != nil {
+		return 0, err
+	}
+	if !ok {
+		e = Entry{kind: KindSet, set: make(map[string]struct{}), members: new(scanIndex)}
+	}
+	n := 0
+	for _, m := range members {
+		if _, exists := e.set[string(m.B)]; !exists {
+			e.set[string(m.B)] = struct{}{}
+			e.members.add(string(m.B))
+			e.elemSize += int64(len(m.B))
+			n++
+		}
+	}
+	s.put(key, e)
+	return n, nil
+}
+
+// srem removes members from the set at key and returns how many were
+// present. A set left empty is deleted.
+func (s *Store) srem(key string, members []resp.Value) (int, error) {
+	defer s.lock(key)()
+
+	e, ok, err := s.lookupKind(key, KindSet)
+	if !ok {
+		return 0, err
+	}
+	n := 0
+	for _, m := range members {
+		if _, exists := e.set[string(m.B)]; exists {
+			delete(e.set, string(m.B))
+			e.members.remove(string(m.B))
+			e.elemSize -= int64(len(m.B))
+			n++
+		}
+	}
+	if len(e.set) == 0 {
+		s.remove(key)
+	} else if n > 0 {
+		s.put(key, e)
+	}
+	return n, nil
+}
+
+func handleSAdd(w *bufio.Writer, st *Store, args []resp.Value) {
+	// SADD key member [member ...]
+	n, err := st.sadd(string(args[1].B), args[2:])
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	_ = resp.WriteInteger(w, int64(n))
+}
+
+func handleSRem(w *bufio.Writer, st *Store, args []resp.Value) {
+	// SREM key member [member ...]
+	n, err := st.srem(string(args[1].B), args[2:])
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	_ = resp.WriteInteger(w, int64(n))
+}
+
+// lookupSet returns the members of the set at key, nil if it does not exist.
+// The caller must hold the lock of key's shard.
+func (s *Store) lookupSet(key string) (map[string]struct{}, error) {
+	e, _, err := s.lookupRead(key, KindSet)
+	return e.set, err
+}
+
+func handleSMembers(w *bufio.Writer, st *Store, args []resp.Value) {
+	// SMEMBERS key
+
+	unlock := st.rlock(string(args[1].B))
+	set, err := st.lookupSet(string(args[1].B))
+	members := make([][]byte, 0, len(set))
+	for m := range set {
+		members = append(members, []byte(m))
+	}
+	unlock()
+
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	_ = resp.WriteArray(w, bulks(members))
+}
+
+func handleSCard(w *bufio.Writer, st *Store, args []resp.Value) {
+	// SCARD key
+
+	unlock := st.rlock(string(args[1].B))
+	set, err := st.lookupSet(string(args[1].B))
+	n := len(set)
+	unlock()
+
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	_ = resp.WriteInteger(w, int64(n))
+}
+
+func handleSIsMember(w *bufio.Writer, st *Store, args []resp.Value) {
+	// SISMEMBER key member
+
+	unlock := st.rlock(string(args[1].B))
+	set, err := st.lookupSet(string(args[1].B))
+	_, ok := set[string(args[2].B)]
+	unlock()
+
+	switch {
+	case err != nil:
+		_ = resp.WriteError(w, err.Error())
+	case ok:
+		_ = resp.WriteInteger(w, 1)
+	default:
+		_ = resp.WriteInteger(w, 0)
+	}
+}
+
+// Set algebra operations for setOp.
+const (
+	setInter = iota
+	setUnion
+	setDiff
+)
+
+// setOp combines the sets at keys with op, treating missing keys as empty
+// sets. Every key is type-checked before any work is done.
+func (s *Store) setOp(op int, keys []resp.Value) ([][]byte, error) {
+	defer s.rlock(argStrings(keys)...)()
+
+	sets := make([]map[string]struct{}, len(keys))
+	for i, k := range keys {
+		set, err := s.lookupSet(string(k.B))
+		if err != nil {
+			return nil, err
+		}
+		sets[i] = set
+	}
+
+	var out [][]byte
+	switch op {
+	case setInter:
+		for _, set := range sets {
+			if len(set) == 0 {
+				return nil, nil // the intersection with an empty set is empty
+			}
+		}
+	members:
+		for m := range sets[0] {
+			for _, set := range sets[1:] {
+				if _, ok := set[m]; !ok {
+					continue members
+				}
+			}
+			out = append(out, []byte(m))
+		}
+	case setUnion:
+		seen := make(map[string]struct{})
+		for _, set := range sets {
+			for m := range set {
+				if _, ok := seen[m]; !ok {
+					seen[m] = struct{}{}
+					out = append(out, []byte(m))
+				}
+			}
+		}
+	case setDiff:
+	diff:
+		for m := range sets[0] {
+			for _, set := range sets[1:] {
+				if _, ok := set[m]; ok {
+					continue diff
+				}
+			}
+			out = append(out, []byte(m))
+		}
+	}
+	return out, nil
+}
+
+func handleSetOp(w *bufio.Writer, st *Store, args []resp.Value, op int) {
+	// SINTER key [key ...] / SUNION key [key ...] / SDIFF key [key ...]
+	members, err := st.setOp(op, args[1:])
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	_ = resp.WriteArray(w, bulks(members))
+}
+
+// randomMembers picks count distinct members of set, or -count members that
+// may repeat when count is negative. Members are snapshotted once, so the
+// cost is O(len(set)+|count|) for the whole call rather than per pick.
+func randomMembers(set map[string]struct{}, count int) []string {
+	if count > 0 && count >= len(set) {
+		return slices.Collect(maps.Keys(set))
+	}
+	all := slices.Collect(maps.Keys(set))
+	if count < 0 {
+		out := make([]string, -count)
+		for i := range out {
+			out[i] = all[rand.IntN(len(all))]
+		}
+		return out
+	}
+	// partial Fisher-Yates: the first count slots end up a uniform sample
+	for i := 0; i < count; i++ {
+		j := i + rand.IntN(len(all)-i)
+		all[i], all[j] = all[j], all[i]
+	}
+	return all[:count]
+}
+
+// anyMember returns a single random member. Map iteration starts at a
+// random position, which is a cheap, reasonably spread single pick.
+func anyMember(set map[string]struct{}) string {
+	for m := range set {
+		return m
+	}
+	return ""
+}
+
+// spop removes and returns random members from the set at key: one if
+// count is negative (no count given), otherwise up to count distinct ones.
+// A set left empty is deleted.
+func (s *Store) spop(key string, count int) ([]string, bool, error) {
+	defer s.lock(key)()
+
+	e, ok, err := s.lookupKind(key, KindSet)
+	if !ok {
+		return nil, false, err
+	}
+	var picked []string
+	if count < 0 {
+		picked = []string{anyMember(e.set)}
+	} else {
+		picked = randomMembers(e.set, count)
+	}
+	for _, m := range picked {
+		delete(e.set, m)
+		e.members.remove(m)
+		e.elemSize -= int64(len(m))
+	}
+	if len(e.set) == 0 {
+		s.remove(key)
+	} else {
+		s.put(key, e)
+	}
+	if len(picked) > 0 {
+		// logged as the members taken, as replaying SPOP would take others
+		s.srv.feed.logCommand(s.index, append([]string{"SREM", key}, picked...)...)
+	}
+	return picked, true, nil
+}
+
+func handleSPop(w *bufio.Writer, st *Store, args []resp.Value) {
+	// SPOP key [count]
+	count := -1
+	if len(args) == 3 {
+		var err error
+		if count, err = strconv.Atoi(string(args[2].B)); err != nil || count < 0 {
+			_ = resp.WriteError(w, "ERR value is out of range, must be positive")
+			return
+		}
+	}
+	picked, ok, err := st.spop(string(args[1].B), count)
+	switch {
+	case err != nil:
+		_ = resp.WriteError(w, err.Error())
+	case len(args) == 3:
+		_ = resp.WriteArray(w, bulkStrings(picked))
+	case !ok:
+		_ = resp.WriteBulk(w, nil)
+	default:
+		_ = resp.WriteBulk(w, []byte(picked[0]))
+	}
+}
+
+// maxRandRepeats bounds how many members SRANDMEMBER with a negative count
+// picks. They may repeat, so the set doesn't bound them, and each takes
+// room in the reply.
+const maxRandRepeats = 1 << 20
+
+func handleSRandMember(w *bufio.Writer, st *Store, args []resp.Value) {
+	// SRANDMEMBER key [count]; a negative count allows repeats
+	count := 0
+	if len(args) == 3 {
+		var err error
+		if count, err = strconv.Atoi(string(args[2].B)); err != nil {
+			_ = resp.WriteError(w, errNotInteger.Error())
+			return
+		}
+		if count < -maxRandRepeats {
+			_ = resp.WriteError(w, "ERR value is out of range")
+			return
+		}
+	}
+
+	unlock := st.rlock(string(args[1].B))
+	set, err := st.lookupSet(string(args[1].B))
+	var picked []string
+	switch {
+	case err != nil || len(set) == 0:
+	case len(args) == 2:
+		picked = []string{anyMember(set)}
+	case count != 0:
+		picked = randomMembers(set, count)
+	}
+	unlock()
+
+	switch {
+	case err != nil:
+		_ = resp.WriteError(w, err.Error())
+	case len(args) == 3:
+		_ = resp.WriteArray(w, bulkStrings(picked))
+	case len(picked) == 0:
+		_ = resp.WriteBulk(w, nil)
+	default:
+		_ = resp.WriteBulk(w, []byte(picked[0]))
+	}
+}
+
+// bulkStrings wraps each string in a bulk string Value.
+func bulkStrings(strs []string) []resp.Value {
+	arr := make([]resp.Value, len(strs))
+	for i, s := range strs {
+		arr[i] = resp.Value{T: resp.BulkString, B: []byte(s)}
+	}
+	return arr
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSRandMemberCount(t *testing.T) {
+	st := newTestServer(t).dbs[0]
+	if _, err := st.sadd("s", cmdArgs("a", "b")); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		count string
+		want  string // the reply, or its prefix for picks that vary
+	}{
+		{"-9000000000000000000", "-ERR value is out of range\r\n"},
+		{"-9223372036854775808", "-ERR value is out of range\r\n"},
+		{strconv.Itoa(-maxRandRepeats - 1), "-ERR value is out of range\r\n"},
+		{"99999999999999999999", "-ERR value is not an integer or out of range\r\n"},
+		{"x", "-ERR value is not an integer or out of range\r\n"},
+		{"0", "*0\r\n"},
+		{"-5", "*5\r\n"},
+		{"10", "*2\r\n"},
+		{"9223372036854775807", "*2\r\n"},
+	} {
+		got := run(st, handleSRandMember, "SRANDMEMBER", "s", tt.count)
+		if !strings.HasPrefix(got, tt.want) {
+			t.Errorf("SRANDMEMBER s %s = %q, want %q", tt.count, got, tt.want)
+		}
+	}
+	if got := run(st, handleSRandMember, "SRANDMEMBER", "missing", "-9000000000000000000"); got != "-ERR value is out of range\r\n" {
+		t.Errorf("SRANDMEMBER of a missing key with a huge count = %q", got)
+	}
+}
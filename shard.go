@@ -0,0 +1,136 @@
+package main
+
+import (
+	"hash/maphash"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// shard is one stripe of a Store's keyspace, with a lock of its own, so
+// commands on keys in different shards don't wait for each other. A key
+// always hashes to the same shard, and its waiters and watchers live there
+// with it.
+type shard struct {
+	mu      sync.RWMutex
+	data    map[string]Entry
+	expires map[string]struct{} // the keys in data with an expiry, for the janitor to sample
+	keys    scanIndex           // the keys in data, for SCAN to walk
+	used    int64               // memory the entries in data take, as entrySize counts it
+	changes atomic.Uint64       // puts and removes, for a fed write to tell if it changed anything
+
+	waiters map[string][]chan struct{} // clients blocked in BLPOP/BRPOP, by key
+	watched map[string]*watchedKey     // keys under WATCH
+}
+
+func newShard() *shard {
+	return &shard{
+		data:    make(map[string]Entry),
+		expires: make(map[string]struct{}),
+		waiters: make(map[string][]chan struct{}),
+		watched: make(map[string]*watchedKey),
+	}
+}
+
+// shardSeed hashes keys to shards. Every Store shares it and has as many
+// shards, so a key is in the same shard in each, which lets SWAPDB trade
+// the contents of shards pairwise.
+var shardSeed = maphash.MakeSeed()
+
+// shardOf returns the shard key lives in.
+func (s *Store) shardOf(key string) *shard {
+	return s.shards[s.shardIndex(key)]
+}
+
+func (s *Store) shardIndex(key string) int {
+	// the shard count is a power of two, so masking picks one evenly
+	return int(maphash.String(shardSeed, key) & uint64(len(s.shards)-1))
+}
+
+// lock write-locks the shards holding keys and returns the function that
+// unlocks them. rlock read-locks them instead. A command touching several
+// keys locks all their shards up front, each once and in index order, so
+// two commands on overlapping shards can't deadlock.
+func (s *Store) lock(keys ...string) (unlock func()) {
+	return s.lockShards(keys, true)
+}
+
+func (s *Store) rlock(keys ...string) (unlock func()) {
+	return s.lockShards(keys, false)
+}
+
+func (s *Store) lockShards(keys []string, write bool) func() {
+	if len(keys) == 1 {
+		sh := s.shardOf(keys[0])
+		if write {
+			sh.mu.Lock()
+			return sh.mu.Unlock
+		}
+		sh.mu.RLock()
+		return sh.mu.RUnlock
+	}
+	idx := make([]int, len(keys))
+	for i, k := range keys {
+		idx[i] = s.shardIndex(k)
+	}
+	slices.Sort(idx)
+	return s.lockIndexes(slices.Compact(idx), write)
+}
+
+// lockAll write-locks every shard, for what changes the whole keyspace at
+// once, such as FLUSHDB. rlockAll read-locks them, for what has to see it
+// at a single point in time, such as SAVE.
+func (s *Store) lockAll() (unlock func()) {
+	return s.lockIndexes(s.allShards(), true)
+}
+
+func (s *Store) rlockAll() (unlock func()) {
+	return s.lockIndexes(s.allShards(), false)
+}
+
+func (s *Store) allShards() []int {
+	idx := make([]int, len(s.shards))
+	for i := range idx {
+		idx[i] = i
+	}
+	return idx
+}
+
+// lockIndexes locks the shards at idx, which must be sorted and distinct.
+func (s *Store) lockIndexes(idx []int, write bool) func() {
+	for _, i := range idx {
+		if write {
+			s.shards[i].mu.Lock()
+		} else {
+			s.shards[i].mu.RLock()
+		}
+	}
+	return func() {
+		for _, i := range slices.Backward(idx) {
+			if write {
+				s.shards[i].mu.Unlock()
+			} else {
+				s.shards[i].mu.RUnlock()
+			}
+		}
+	}
+}
+
+// liveKeys returns the keys that have not expired. It locks one shard at a
+// time rather than the whole store, so the result is only a snapshot of
+// each shard, not of the store, when other clients write meanwhile.
+func (s *Store) liveKeys() []string {
+	now := time.Now().UnixMilli()
+	var keys []string
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		for k, e := range sh.data {
+			if e.exp == 0 || now <= e.exp {
+				keys = append(keys, k)
+			}
+		}
+		sh.mu.RUnlock()
+	}
+	return keys
+}
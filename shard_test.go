@@ -0,0 +1,41 @@
+package main
+
+import (
+	"math/rand/v2"
+	"strconv"
+	"testing"
+)
+
+// BenchmarkStore runs GETs and SETs in parallel, one SET to every four GETs,
+// against a store with a single shard, which is a single mutex, and one with
+// sixteen.
+func BenchmarkStore(b *testing.B) {
+	const nkeys = 10000
+	keys := make([]string, nkeys)
+	for i := range keys {
+		keys[i] = "key:" + strconv.Itoa(i)
+	}
+	val := []byte("value")
+	for _, shards := range []int{1, 16} {
+		b.Run("shards="+strconv.Itoa(shards), func(b *testing.B) {
+			srv := newTestServer(b)
+			srv.config.shards = shards
+			st := newStore(srv, 0, shards)
+			for _, k := range keys {
+				_, _, _ = st.setWith(k, val, setOptions{})
+			}
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				r := rand.New(rand.NewPCG(rand.Uint64(), 0))
+				for i := 0; pb.Next(); i++ {
+					k := keys[r.IntN(nkeys)]
+					if i%5 == 0 {
+						_, _, _ = st.setWith(k, val, setOptions{})
+					} else {
+						_, _, _ = st.getString(k)
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// shutdownGrace is how long shutting down waits for the commands running to
+// finish and their replies to be sent, before hanging up regardless.
+const shutdownGrace = 5 * time.Second
+
+// shuttingDown reports whether the server has begun to shut down.
+func (srv *server) shuttingDown() bool {
+	select {
+	case <-srv.quit:
+		return true
+	default:
+		return false
+	}
+}
+
+// closeConns ends every connection once the listener is closed. A client
+// waiting for its next command is hung up on at once, and one running a
+// command once it has its reply; blocking pops give up as though timed out.
+// Those still open after shutdownGrace are closed. conns is done once every
+// connection's handler has returned.
+func (srv *server) closeConns(conns *sync.WaitGroup) {
+	close(srv.quit)
+	srv.clientsMu.Lock()
+	log.Printf("shutting down with %d connections open", len(srv.clients))
+	for _, c := range srv.clients {
+		_ = c.conn.SetReadDeadline(time.Now()) // unblock the read of the next command
+	}
+	srv.clientsMu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		conns.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return
+	case <-time.After(shutdownGrace):
+	}
+	srv.clientsMu.Lock()
+	log.Printf("closing the %d connections still open", len(srv.clients))
+	for _, c := range srv.clients {
+		_ = c.conn.Close()
+	}
+	srv.clientsMu.Unlock()
+	<-done
+}
+
+// persist makes what the keyspace holds last past shutting down on sig: it
+// saves a snapshot unless shutdown-on-sigterm or shutdown-on-sigint, as sig
+// is, says nosave, and syncs and closes the append-only file. The caller
+// must have stopped everything that changes the keyspace.
+func (srv *server) persist(sig os.Signal) {
+	if srv.config.saveOnShutdown(sig) {
+		if err := srv.save(); err != nil {
+			log.Print("saving the snapshot on shutdown: ", err)
+		} else {
+			log.Print("saved the snapshot")
+		}
+	}
+	if err := srv.feed.closeAOF(); err != nil {
+		log.Print("closing the append-only file: ", err)
+	}
+}
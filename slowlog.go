@@ -0,0 +1,139 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"reditlite/resp"
+)
+
+// Limits on how much of a command a slow log entry keeps, as in Redis.
+const (
+	slowlogMaxArgc   = 32
+	slowlogMaxArgLen = 128
+)
+
+// slowlog records the commands that ran longer than slowlog-log-slower-than,
+// keeping the latest slowlog-max-len of them.
+type slowlog struct {
+	mu      sync.Mutex
+	entries []slowEntry // oldest first
+	nextID  int64
+}
+
+type slowEntry struct {
+	id       int64
+	at       time.Time
+	duration time.Duration
+	args     [][]byte
+	addr     string
+	name     string
+}
+
+// record logs the command args, run by c, if it took longer than the
+// threshold.
+func (l *slowlog) record(c *client, args []resp.Value, d time.Duration) {
+	threshold, maxLen := c.srv.config.slowlogSettings()
+	if threshold < 0 || d.Microseconds() < threshold {
+		return
+	}
+
+	// keep a copy, trimmed, since args alias the connection's read buffer
+	n := min(len(args), slowlogMaxArgc)
+	kept := make([][]byte, n)
+	for i := range n {
+		a := args[i].B
+		switch {
+		case i == n-1 && n < len(args):
+			a = []byte("... (" + strconv.Itoa(len(args)-n+1) + " more arguments)")
+		case redactArg(args, i):
+			a = []byte("(redacted)")
+		case len(a) > slowlogMaxArgLen:
+			a = append(a[:slowlogMaxArgLen:slowlogMaxArgLen], "... ("+strconv.Itoa(len(a)-slowlogMaxArgLen)+" more bytes)"...)
+		default:
+			a = append([]byte(nil), a...)
+		}
+		kept[i] = a
+	}
+	c.srv.clientsMu.Lock()
+	name := c.name
+	c.srv.clientsMu.Unlock()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.entries = append(l.entries, slowEntry{
+		id: l.nextID, at: time.Now(), duration: d,
+		args: kept, addr: c.addr(), name: name,
+	})
+	l.nextID++
+	l.trim(maxLen)
+}
+
+// trim drops the oldest entries beyond maxLen. The caller must hold l.mu.
+func (l *slowlog) trim(maxLen int) {
+	if extra := len(l.entries) - maxLen; extra > 0 {
+		l.entries = append(l.entries[:0], l.entries[extra:]...)
+	}
+}
+
+// latest returns up to n entries, newest first, or all of them if n < 0.
+func (l *slowlog) latest(n int) []slowEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if n < 0 || n > len(l.entries) {
+		n = len(l.entries)
+	}
+	out := make([]slowEntry, n)
+	for i := range out {
+		out[i] = l.entries[len(l.entries)-1-i]
+	}
+	return out
+}
+
+func handleSlowlog(c *client, args []resp.Value) {
+	// SLOWLOG GET [count] / SLOWLOG LEN / SLOWLOG RESET
+	l := &c.srv.slowlog
+	sub := strings.ToUpper(string(args[1].B))
+	if (sub == "GET" && len(args) > 3) || ((sub == "LEN" || sub == "RESET") && len(args) != 2) {
+		_ = resp.WriteError(c.w, "ERR wrong number of arguments for 'slowlog|"+strings.ToLower(sub)+"'")
+		return
+	}
+	switch sub {
+	case "GET":
+		n := 10
+		if len(args) == 3 {
+			v, err := strconv.Atoi(string(args[2].B))
+			if err != nil || v < -1 {
+				_ = resp.WriteError(c.w, "ERR count should be greater than or equal to -1")
+				return
+			}
+			n = v
+		}
+		entries := l.latest(n)
+		_ = resp.WriteArrayHeader(c.w, len(entries))
+		for _, e := range entries {
+			_ = resp.WriteArrayHeader(c.w, 6)
+			_ = resp.WriteInteger(c.w, e.id)
+			_ = resp.WriteInteger(c.w, e.at.Unix())
+			_ = resp.WriteInteger(c.w, e.duration.Microseconds())
+			_ = resp.WriteArray(c.w, bulks(e.args))
+			_ = resp.WriteBulk(c.w, []byte(e.addr))
+			_ = resp.WriteBulk(c.w, []byte(e.name))
+		}
+	case "LEN":
+		l.mu.Lock()
+		n := len(l.entries)
+		l.mu.Unlock()
+		_ = resp.WriteInteger(c.w, int64(n))
+	case "RESET":
+		l.mu.Lock()
+		l.entries = nil
+		l.mu.Unlock()
+		_ = resp.WriteSimpleString(c.w, "OK")
+	default:
+		_ = resp.WriteError(c.w, "ERR unknown subcommand '"+string(args[1].B)+"'. Try SLOWLOG HELP.")
+	}
+}
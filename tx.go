@@ -0,0 +1,167 @@
+package main
+
+import (
+	"slices"
+	"strings"
+
+	"reditlite/resp"
+)
+
+func (c *client) startMulti() {
+	// MULTI
+	if c.multi {
+		_ = resp.WriteError(c.w, "ERR MULTI calls can not be nested")
+		return
+	}
+	c.multi = true
+	_ = resp.WriteSimpleString(c.w, "OK")
+}
+
+// queue adds a command to the transaction.
+func (c *client) queue(args []resp.Value) {
+	c.queued = append(c.queued, args)
+	_ = resp.WriteSimpleString(c.w, "QUEUED")
+}
+
+// endMulti leaves the MULTI state, dropping whatever was queued along with
+// the watches.
+func (c *client) endMulti() {
+	c.multi, c.queued, c.dirty = false, nil, false
+	c.unwatch()
+}
+
+func (c *client) discard() {
+	// DISCARD
+	if !c.multi {
+		_ = resp.WriteError(c.w, "ERR DISCARD without MULTI")
+		return
+	}
+	c.endMulti()
+	_ = resp.WriteSimpleString(c.w, "OK")
+}
+
+// exec runs the queued commands as a transaction: it holds srv.txmu for the
+// whole run, so no other client's command runs in between, and replies with
+// an array of the commands' replies in order.
+func (c *client) exec() {
+	// EXEC
+	if !c.multi {
+		_ = resp.WriteError(c.w, "ERR EXEC without MULTI")
+		return
+	}
+	defer c.endMulti()
+	if c.dirty {
+		_ = resp.WriteError(c.w, "EXECABORT Transaction discarded because of previous errors.")
+		return
+	}
+
+	defer c.srv.feed.syncAOF() // once txmu is released
+	c.srv.txmu.Lock()
+	defer c.srv.txmu.Unlock()
+
+	for _, w := range c.watching {
+		if w.db.touched(w) {
+			_ = resp.WriteNullArray(c.w)
+			return
+		}
+	}
+
+	if c.srv.feed.on() {
+		c.srv.feed.beginTx()
+		defer c.srv.feed.endTx()
+	}
+	_ = resp.WriteArrayHeader(c.w, len(c.queued))
+	for _, args := range c.queued {
+		// each handler writes its own reply, which makes one array element
+		cmd := strings.ToUpper(string(args[0].B))
+		c.callLogged(cmd, commands[cmd], args, nil)
+	}
+}
+
+// Keys under WATCH carry a version that every write to them bumps, which
+// put and remove do. Versions are only kept while some client watches the
+// key, so the bookkeeping costs nothing for the rest of the keyspace.
+type watchedKey struct {
+	version uint64
+	clients int // clients watching the key
+}
+
+// watch is one key under WATCH by a client, as it was when watched.
+type watch struct {
+	db      *Store
+	key     string
+	version uint64
+	existed bool
+}
+
+// touchKey records a write to key; the caller must hold the lock of key's
+// shard.
+func (s *Store) touchKey(key string) {
+	if wk := s.shardOf(key).watched[key]; wk != nil {
+		wk.version++
+	}
+}
+
+// watchKey starts tracking the version of key for one more client and
+// returns its state as of now.
+func (s *Store) watchKey(key string) watch {
+	defer s.lock(key)()
+
+	sh := s.shardOf(key)
+	wk := sh.watched[key]
+	if wk == nil {
+		wk = &watchedKey{}
+		sh.watched[key] = wk
+	}
+	wk.clients++
+	_, existed := s.lookup(key)
+	return watch{db: s, key: key, version: wk.version, existed: existed}
+}
+
+// unwatchKey releases w, a watch on one of s's keys.
+func (s *Store) unwatchKey(w watch) {
+	defer s.lock(w.key)()
+
+	sh := s.shardOf(w.key)
+	if wk := sh.watched[w.key]; wk != nil {
+		if wk.clients--; wk.clients == 0 {
+			delete(sh.watched, w.key)
+		}
+	}
+}
+
+// touched reports whether the key of w was written to since it was watched.
+// A key that has expired since counts as written to, even if the janitor
+// has not removed it yet.
+func (s *Store) touched(w watch) bool {
+	defer s.rlock(w.key)()
+
+	if s.shardOf(w.key).watched[w.key].version != w.version {
+		return true
+	}
+	_, ok := s.lookup(w.key)
+	return w.existed && !ok
+}
+
+func (c *client) watch(args []resp.Value) {
+	// WATCH key [key ...]
+	if c.multi {
+		_ = resp.WriteError(c.w, "ERR WATCH inside MULTI is not allowed")
+		return
+	}
+	for _, a := range args[1:] {
+		key := string(a.B)
+		if !slices.ContainsFunc(c.watching, func(w watch) bool { return w.db == c.db && w.key == key }) {
+			c.watching = append(c.watching, c.db.watchKey(key))
+		}
+	}
+	_ = resp.WriteSimpleString(c.w, "OK")
+}
+
+// unwatch drops all of the client's watches.
+func (c *client) unwatch() {
+	for _, w := range c.watching {
+		w.db.unwatchKey(w)
+	}
+	c.watching = nil
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"reditlite/resp"
+)
+
+// zset is a sorted set: a member→score map for lookups plus a slice of the
+// members in ascending (score, member) order, which makes ranges by rank a
+// plain slice and ranks a binary search.
+type zset struct {
+	scores  map[string]float64
+	items   []zitem
+	members scanIndex // for ZSCAN
+}
+
+type zitem struct {
+	member string
+	score  float64
+}
+
+func newZSet() *zset {
+	return &zset{scores: make(map[string]float64)}
+}
+
+func zitemCmp(a, b zitem) int {
+	switch {
+	case a.score < b.score:
+		return -1
+	case a.score > b.score:
+		return 1
+	}
+	return strings.Compare(a.member, b.member)
+}
+
+// rank returns the 0-based ascending position of member.
+func (z *zset) rank(member string) (int, bool) {
+	score, ok := z.scores[member]
+	if !ok {
+		return 0, false
+	}
+	i, _ := slices.BinarySearchFunc(z.items, zitem{member, score}, zitemCmp)
+	return i, true
+}
+
+// set gives member the score, inserting it if new, and keeps items ordered.
+func (z *zset) set(member string, score float64) {
+	if i, ok := z.rank(member); ok {
+		z.items = slices.Delete(z.items, i, i+1)
+	} else {
+		z.members.add(member)
+	}
+	z.scores[member] = score
+	it := zitem{member, score}
+	i, _ := slices.BinarySearchFunc(z.items, it, zitemCmp)
+	z.items = slices.Insert(z.items, i, it)
+}
+
+func (z *zset) clone() *zset {
+	c := &zset{scores: make(map[string]float64, len(z.scores)), items: slices.Clone(z.items), members: *z.members.clone()}
+	for m, sc := range z.scores {
+		c.scores[m] = sc
+	}
+	return c
+}
+
+// zaddOptions are the modifiers accepted by ZADD.
+type zaddOptions struct {
+	nx, xx bool // only add new members / only update existing ones
+	gt, lt bool // only update if the new score is greater / less
+	ch     bool // count changed members as well as added ones
+	incr   bool // add the score to the current one, like ZINCRBY
+}
+
+// zadd applies the score/member pairs in sm to the sorted set at key,
+// creating it if needed. It returns the number of members added (plus
+// updated with ch), and for incr the resulting score, or false if the
+// options prevented the update.
+func (s *Store) zadd(key string, sm []resp.Value, opts zaddOptions) (int, float64, bool, error) {
+	// parse every score up front so that a bad one leaves the set untouched
+	scores := make([]float64, 0, len(sm)/2)
+	for i := 0; i+1 < len(sm); i += 2 {
+		sc, err := parseScore(sm[i].B)
+		if err != nil {
+			return 0, 0, false, err
+		}
+		scores = append(scores, sc)
+	}
+
+	defer s.lock(key)()
+
+	e, ok, err := s.lookupKind(key, KindZSet)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if !ok {
+		e = Entry{kind: KindZSet, zset: newZSet()}
+	}
+	n := 0
+	applied := false
+	var last float64
+	for i, sc := range scores {
+		member := string(sm[2*i+1].B)
+		cur, exists := e.zset.scores[member]
+		if (opts.nx && exists) || (opts.xx && !exists) {
+			continue
+		}
+		if opts.incr && exists {
+			sc += cur
+			if math.IsNaN(sc) {
+				return 0, 0, false, errors.New("ERR resulting score is not a number (NaN)")
+			}
+		}
+		if exists && ((opts.gt && sc <= cur) || (opts.lt && sc >= cur)) {
+			continue
+		}
+		applied, last = true, sc
+		switch {
+		case !exists:
+			e.elemSize += zitemSize(member)
+			n++
+		case sc != cur && opts.ch:
+			n++
+		case sc == cur:
+			continue
+		}
+		e.zset.set(member, sc)
+	}
+	if len(e.zset.items) > 0 {
+		s.put(key, e)
+	}
+	return n, last, applied, nil
+}
+
+func handleZAdd(w *bufio.Writer, st *Store, args []resp.Value) {
+	// ZADD key [NX|XX] [GT|LT] [CH] [INCR] score member [score member ...]
+	var opts zaddOptions
+	i := 2
+flags:
+	for ; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i].B)) {
+		case "NX":
+			opts.nx = true
+		case "XX":
+			opts.xx = true
+		case "GT":
+			opts.gt = true
+		case "LT":
+			opts.lt = true
+		case "CH":
+			opts.ch = true
+		case "INCR":
+			opts.incr = true
+		default:
+			break flags
+		}
+	}
+	sm := args[i:]
+	switch {
+	case len(sm) == 0 || len(sm)%2 != 0:
+		_ = resp.WriteError(w, "ERR syntax error")
+		return
+	case opts.nx && opts.xx:
+		_ = resp.WriteError(w, "ERR XX and NX options at the same time are not compatible")
+		return
+	case (opts.gt && opts.lt) || (opts.nx && (opts.gt || opts.lt)):
+		_ = resp.WriteError(w, "ERR GT, LT, and/or NX options at the same time are not compatible")
+		return
+	case opts.incr && len(sm) != 2:
+		_ = resp.WriteError(w, "ERR INCR option supports a single increment-element pair")
+		return
+	}
+
+	n, score, applied, err := st.zadd(string(args[1].B), sm, opts)
+	switch {
+	case err != nil:
+		_ = resp.WriteError(w, err.Error())
+	case !opts.incr:
+		_ = resp.WriteInteger(w, int64(n))
+	case !applied:
+		_ = resp.WriteBulk(w, nil)
+	default:
+		_ = resp.WriteBulk(w, []byte(formatScore(score)))
+	}
+}
+
+// parseScore parses a sorted set score. Unlike parseFloat it accepts the
+// infinities, which are valid scores.
+func parseScore(b []byte) (float64, error) {
+	f, err := strconv.ParseFloat(string(b), 64)
+	if err != nil || math.IsNaN(f) {
+		return 0, errNotFloat
+	}
+	return f, nil
+}
+
+// formatScore renders a score the way Redis replies with it: %.17g layout
+// (plain notation unless the exponent is below -4 or at least 17) with the
+// shortest digits that round-trip, and "inf"/"-inf" for the infinities.
+func formatScore(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	s := strconv.FormatFloat(f, 'e', -1, 64)
+	exp, _ := strconv.Atoi(s[strings.IndexByte(s, 'e')+1:])
+	if exp < -4 || exp >= 17 {
+		return s
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// zrange returns the members of the sorted set at key between the ranks
+// start and stop inclusive, counted from the highest score when rev is set.
+func (s *Store) zrange(key string, start, stop int64, rev bool) ([]zitem, error) {
+	defer s.rlock(key)()
+
+	e, ok, err := s.lookupRead(key, KindZSet)
+	if err != nil || !ok {
+		return nil, err
+	}
+	n := len(e.zset.items)
+	lo, hi := normalizeRange(start, stop, n)
+	if !rev {
+		return slices.Clone(e.zset.items[lo:hi]), nil
+	}
+	items := slices.Clone(e.zset.items[n-hi : n-lo])
+	slices.Reverse(items)
+	return items, nil
+}
+
+func handleZRange(w *bufio.Writer, st *Store, args []resp.Value) {
+	// ZRANGE key start stop [REV] [WITHSCORES]
+	var rev, withScores bool
+	for _, a := range args[4:] {
+		switch strings.ToUpper(string(a.B)) {
+		case "REV":
+			rev = true
+		case "WITHSCORES":
+			withScores = true
+		default:
+			_ = resp.WriteError(w, "ERR syntax error")
+			return
+		}
+	}
+	start, err1 := strconv.ParseInt(string(args[2].B), 10, 64)
+	stop, err2 := strconv.ParseInt(string(args[3].B), 10, 64)
+	if err1 != nil || err2 != nil {
+		_ = resp.WriteError(w, errNotInteger.Error())
+		return
+	}
+	items, err := st.zrange(string(args[1].B), start, stop, rev)
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	writeZItems(w, items, withScores)
+}
+
+// writeZItems replies with the members of items, each followed by its score
+// when withScores is set.
+func writeZItems(w *bufio.Writer, items []zitem, withScores bool) {
+	per := 1
+	if withScores {
+		per = 2
+	}
+	arr := make([]resp.Value, 0, per*len(items))
+	for _, it := range items {
+		arr = append(arr, resp.Value{T: resp.BulkString, B: []byte(it.member)})
+		if withScores {
+			arr = append(arr, resp.Value{T: resp.BulkString, B: []byte(formatScore(it.score))})
+		}
+	}
+	_ = resp.WriteArray(w, arr)
+}
+
+// lookupZSet returns the sorted set at key, or nil if there is none. The
+// caller must hold the lock of key's shard.
+func (s *Store) lookupZSet(key string) (*zset, error) {
+	e, _, err := s.lookupRead(key, KindZSet)
+	return e.zset, err
+}
+
+func handleZScore(w *bufio.Writer, st *Store, args []resp.Value) {
+	// ZSCORE key member
+
+	unlock := st.rlock(string(args[1].B))
+	z, err := st.lookupZSet(string(args[1].B))
+	var score float64
+	ok := false
+	if z != nil {
+		score, ok = z.scores[string(args[2].B)]
+	}
+	unlock()
+
+	switch {
+	case err != nil:
+		_ = resp.WriteError(w, err.Error())
+	case !ok:
+		_ = resp.WriteBulk(w, nil)
+	default:
+		_ = resp.WriteBulk(w, []byte(formatScore(score)))
+	}
+}
+
+// handleZRank serves ZRANK and, with rev, ZREVRANK.
+func handleZRank(w *bufio.Writer, st *Store, args []resp.Value, rev bool) {
+	// ZRANK key member / ZREVRANK key member
+
+	unlock := st.rlock(string(args[1].B))
+	z, err := st.lookupZSet(string(args[1].B))
+	var rank int
+	ok := false
+	if z != nil {
+		rank, ok = z.rank(string(args[2].B))
+		if rev {
+			rank = len(z.items) - 1 - rank
+		}
+	}
+	unlock()
+
+	switch {
+	case err != nil:
+		_ = resp.WriteError(w, err.Error())
+	case !ok:
+		_ = resp.WriteBulk(w, nil)
+	default:
+		_ = resp.WriteInteger(w, int64(rank))
+	}
+}
+
+// scoreBound is one end of a ZRANGEBYSCORE interval.
+type scoreBound struct {
+	v    float64
+	excl bool // "(v": the bound itself is not in the range
+}
+
+// parseScoreBound parses a score interval bound: a score, optionally
+// prefixed with '(' to make it exclusive, where "-inf" and "+inf" are valid.
+func parseScoreBound(b []byte) (scoreBound, error) {
+	var sb scoreBound
+	if len(b) > 0 && b[0] == '(' {
+		sb.excl = true
+		b = b[1:]
+	}
+	v, err := parseScore(b)
+	if err != nil {
+		return scoreBound{}, errors.New("ERR min or max is not a float")
+	}
+	sb.v = v
+	return sb, nil
+}
+
+// above reports whether score is on the inner side of sb taken as a minimum.
+func (sb scoreBound) above(score float64) bool {
+	if sb.excl {
+		return score > sb.v
+	}
+	return score >= sb.v
+}
+
+// below reports whether score is on the inner side of sb taken as a maximum.
+func (sb scoreBound) below(score float64) bool {
+	if sb.excl {
+		return score < sb.v
+	}
+	return score <= sb.v
+}
+
+// zrangeByScore returns the members of the sorted set at key whose scores
+// lie between lo and hi, in ascending order, skipping the first offset of
+// them and returning at most count (all of them if count is negative).
+func (s *Store) zrangeByScore(key string, lo, hi scoreBound, offset, count int64) ([]zitem, error) {
+	defer s.rlock(key)()
+
+	z, err := s.lookupZSet(key)
+	if err != nil || z == nil || offset < 0 {
+		return nil, err
+	}
+	i := sort.Search(len(z.items), func(i int) bool { return lo.above(z.items[i].score) })
+	i += int(min(offset, int64(len(z.items)-i)))
+	var items []zitem
+	for ; i < len(z.items) && hi.below(z.items[i].score); i++ {
+		if count >= 0 && int64(len(items)) >= count {
+			break
+		}
+		items = append(items, z.items[i])
+	}
+	return items, nil
+}
+
+func handleZRangeByScore(w *bufio.Writer, st *Store, args []resp.Value) {
+	// ZRANGEBYSCORE key min max [WITHSCORES] [LIMIT offset count]
+	withScores := false
+	offset, count := int64(0), int64(-1)
+	for i := 4; i < len(args); i++ {
+		switch strings.ToUpper(string(args[i].B)) {
+		case "WITHSCORES":
+			withScores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				_ = resp.WriteError(w, "ERR syntax error")
+				return
+			}
+			var err1, err2 error
+			offset, err1 = strconv.ParseInt(string(args[i+1].B), 10, 64)
+			count, err2 = strconv.ParseInt(string(args[i+2].B), 10, 64)
+			if err1 != nil || err2 != nil {
+				_ = resp.WriteError(w, errNotInteger.Error())
+				return
+			}
+			i += 2
+		default:
+			_ = resp.WriteError(w, "ERR syntax error")
+			return
+		}
+	}
+	lo, err := parseScoreBound(args[2].B)
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	hi, err := parseScoreBound(args[3].B)
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	items, err := st.zrangeByScore(string(args[1].B), lo, hi, offset, count)
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	writeZItems(w, items, withScores)
+}
+
+func handleZIncrBy(w *bufio.Writer, st *Store, args []resp.Value) {
+	// ZINCRBY key increment member
+	// the same as ZADD key INCR increment member
+	_, score, _, err := st.zadd(string(args[1].B), args[2:], zaddOptions{incr: true})
+	if err != nil {
+		_ = resp.WriteError(w, err.Error())
+		return
+	}
+	_ = resp.WriteBulk(w, []byte(formatScore(score)))
+}
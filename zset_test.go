@@ -0,0 +1,64 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestParseScoreBound(t *testing.T) {
+	tests := []struct {
+		in   string
+		want scoreBound
+	}{
+		{"1.5", scoreBound{v: 1.5}},
+		{"-3", scoreBound{v: -3}},
+		{"(1.5", scoreBound{v: 1.5, excl: true}},
+		{"(-3", scoreBound{v: -3, excl: true}},
+		{"-inf", scoreBound{v: math.Inf(-1)}},
+		{"+inf", scoreBound{v: math.Inf(1)}},
+		{"inf", scoreBound{v: math.Inf(1)}},
+		{"(-inf", scoreBound{v: math.Inf(-1), excl: true}},
+		{"(+inf", scoreBound{v: math.Inf(1), excl: true}},
+	}
+	for _, tt := range tests {
+		got, err := parseScoreBound([]byte(tt.in))
+		if err != nil || got != tt.want {
+			t.Errorf("parseScoreBound(%q) = %+v, %v, want %+v", tt.in, got, err, tt.want)
+		}
+	}
+
+	for _, in := range []string{"", "(", "abc", "((1", "1(", "[1", "nan", "(nan", "1 "} {
+		_, err := parseScoreBound([]byte(in))
+		if err == nil || err.Error() != "ERR min or max is not a float" {
+			t.Errorf("parseScoreBound(%q) error = %v, want ERR min or max is not a float", in, err)
+		}
+	}
+}
+
+func TestScoreBoundSides(t *testing.T) {
+	incl := scoreBound{v: 2}
+	excl := scoreBound{v: 2, excl: true}
+	tests := []struct {
+		sb           scoreBound
+		score        float64
+		above, below bool
+	}{
+		{incl, 2, true, true},
+		{excl, 2, false, false},
+		{incl, 1, false, true},
+		{excl, 1, false, true},
+		{incl, 3, true, false},
+		{excl, 3, true, false},
+		{scoreBound{v: math.Inf(-1)}, math.Inf(-1), true, true},
+		{scoreBound{v: math.Inf(-1), excl: true}, math.Inf(-1), false, false},
+		{scoreBound{v: math.Inf(1)}, math.MaxFloat64, false, true},
+	}
+	for _, tt := range tests {
+		if got := tt.sb.above(tt.score); got != tt.above {
+			t.Errorf("%+v.above(%v) = %v, want %v", tt.sb, tt.score, got, tt.above)
+		}
+		if got := tt.sb.below(tt.score); got != tt.below {
+			t.Errorf("%+v.below(%v) = %v, want %v", tt.sb, tt.score, got, tt.below)
+		}
+	}
+}